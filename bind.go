@@ -0,0 +1,338 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+const (
+	PATH_SYS_BUS_PCI_DRIVERS       = "/sys/bus/pci/drivers"
+	PATH_SYS_BUS_PCI_DRIVERS_PROBE = "/sys/bus/pci/drivers_probe"
+
+	// DriverNone is the bind target that only unbinds the device
+	DriverNone = "none"
+)
+
+const (
+	BindActionBound   = "bound"
+	BindActionUnbound = "unbound"
+	BindActionNoop    = "noop"
+	BindActionFailed  = "failed"
+)
+
+// bindFlags are the flags shared by the commands that change device drivers
+type bindFlags struct {
+	Bus         []string `short:"b" required:"" help:"Comma separated lisf of Bus addresses. Use 'list' command to get them. Example: 0000:07:00.0,0000:07:00.1" placeholder:"bus-address1"`
+	Wake        bool     `short:"w" help:"Wake devices to D0 before unbinding them. Needed for devices sleeping in D3cold"`
+	outputFlags `embed:""`
+}
+
+// beforeBindHooks returns the hooks requested by the shared flags, for devices below root
+func (f *bindFlags) beforeBindHooks(log *zerolog.Logger, root string) []func(dev string) error {
+	hooks := []func(dev string) error{}
+	if f.Wake {
+		hooks = append(hooks, func(dev string) error {
+			return wakeDevice(log, root, dev)
+		})
+	}
+	return hooks
+}
+
+type _bind struct {
+	bindFlags `embed:""`
+	Driver    string `short:"d" required:"" help:"Target driver. Use '${driver_none}' to only unbind. Example: vfio-pci, pci-stub, amdgpu"`
+	Save      bool   `short:"s" help:"Save the binding in ${bindings_file}, applied at boot by the service from 'install-service'"`
+}
+
+type BindCmd struct {
+	Bind _bind `cmd:"" aliases:"b" help:"Bind devices to an arbitrary driver"`
+}
+
+// BindResult holds the outcome of binding a single device
+type BindResult struct {
+	Device         string
+	PreviousDriver string
+	NewDriver      string
+	Action         string
+	Error          string
+	Duration       string
+}
+
+// driverHandler holds driver specific hooks run while moving a device
+type driverHandler struct {
+	// BeforeUnbind runs before the device is unbound from this driver
+	BeforeUnbind func(log *zerolog.Logger, dev string) error
+}
+
+// driverHandlers maps driver names to their handlers
+var driverHandlers = map[string]driverHandler{
+	"nvidia": {BeforeUnbind: nvidiaBeforeUnbind},
+}
+
+// nvidiaBeforeUnbind disables nvidia_drm modeset, which otherwise blocks the unbind
+func nvidiaBeforeUnbind(log *zerolog.Logger, dev string) error {
+	modeset := "/sys/module/nvidia_drm/parameters/modeset"
+	modesetValue, err := os.ReadFile(modeset)
+	if err != nil {
+		return fmt.Errorf("failed to read %q: %w", modeset, err)
+	}
+	if string(modesetValue) == "Y\n" {
+		log.Info().Msg("Disabling nvidia_drm modeset")
+		err = writeSysfsFileWithTimeout(modeset, "N")
+		if err != nil {
+			return fmt.Errorf("failed to disable nvidia_drm modeset: %w", err)
+		}
+	}
+	return nil
+}
+
+// Run executes the command
+func (cmd *_bind) Run(globals *Globals) error {
+	// Re-run elevated
+	if err := reRunElevated(); err != nil {
+		return err
+	}
+
+	log := globals.config.Logger()
+	hooks := cmd.beforeBindHooks(log, "/")
+	if cmd.Save {
+		hooks = append(hooks, func(dev string) error {
+			return saveBinding(PATH_BINDINGS, dev, cmd.Driver)
+		})
+	}
+	results := bindDevices(log, cmd.Bus, cmd.Driver, hooks...)
+	if err := printBindResults(globals, results, cmd.OutputFormat, cmd.YQ); err != nil {
+		return err
+	}
+	return bindExitError(results)
+}
+
+// bindDevices moves every device to the target driver. The beforeBind hooks run for each device before touching its driver
+func bindDevices(log *zerolog.Logger, devices []string, target string, beforeBind ...func(dev string) error) []BindResult {
+	results := make([]BindResult, 0, len(devices))
+	for _, dev := range devices {
+		start := time.Now()
+		result := bindDevice(log, "/", dev, target, beforeBind)
+		result.Duration = time.Since(start).Round(time.Millisecond).String()
+		results = append(results, result)
+	}
+	return results
+}
+
+// currentDriver returns the name of the driver the device is bound to, or empty if unbound
+func currentDriver(dev string) (string, error) {
+	return currentDriverFrom(PATH_SYS_BUS_PCI_DEVICES, dev)
+}
+
+// currentDriverFrom returns the driver of the device in the devices directory, or empty if unbound
+func currentDriverFrom(devicesPath, dev string) (string, error) {
+	driver, err := os.Readlink(filepath.Join(devicesPath, dev, "driver"))
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return path.Base(driver), nil
+}
+
+// ensureDriverLoaded loads the driver module when the driver is not registered on the PCI bus
+func ensureDriverLoaded(log *zerolog.Logger, root, driver string) error {
+	driverPath := filepath.Join(root, PATH_SYS_BUS_PCI_DRIVERS, driver)
+	if _, err := os.Stat(driverPath); err == nil {
+		return nil
+	}
+	log.Info().Msgf("Loading module %q", driver)
+	if out, err := exec.Command("modprobe", driver).CombinedOutput(); err != nil { //nolint:gosec
+		return fmt.Errorf("failed to load module %q: %w: %s", driver, err, out)
+	}
+	if _, err := os.Stat(driverPath); err != nil {
+		return fmt.Errorf("driver %q is not available: %w", driver, err)
+	}
+	return nil
+}
+
+// readDriverOverride returns the driver_override of the device directory, empty if unset
+func readDriverOverride(devPath string) (string, error) {
+	content, err := os.ReadFile(filepath.Join(devPath, "driver_override"))
+	if err != nil {
+		return "", err
+	}
+	override := strings.TrimSpace(string(content))
+	if override == "(null)" {
+		return "", nil
+	}
+	return override, nil
+}
+
+// keepsDriverOverride reports whether the driver_override of a device bound to the driver is left set,
+// so the device stays away from host drivers until it is bound elsewhere
+func keepsDriverOverride(driver string) bool {
+	return driver == "vfio-pci" || driver == "pci-stub"
+}
+
+// bindDevice unbinds a device from its current driver and binds it to the target driver.
+// Device files are read and written below root
+func bindDevice(log *zerolog.Logger, root, dev, target string, beforeBind []func(dev string) error) BindResult {
+	result := BindResult{Device: dev}
+	devicesPath := filepath.Join(root, PATH_SYS_BUS_PCI_DEVICES)
+	devPath := filepath.Join(devicesPath, dev)
+	overridden := false
+	previousOverride := ""
+	writeOverride := func(override string) {
+		if err := writeSysfsFileWithTimeout(filepath.Join(devPath, "driver_override"), override); err != nil {
+			log.Warn().Err(err).Msgf("Failed to reset driver override of device %q to %q", dev, override)
+		}
+	}
+	fail := func(err error, msg string) BindResult {
+		log.Error().Err(err).Msg(msg)
+		if overridden {
+			writeOverride(previousOverride)
+		}
+		result.Action = BindActionFailed
+		if err != nil {
+			msg = fmt.Sprintf("%s: %s", msg, err)
+		}
+		result.Error = msg
+		return result
+	}
+
+	// Check device
+	if _, err := os.Stat(devPath); err != nil {
+		return fail(err, fmt.Sprintf("Device %q not found", dev))
+	}
+	driverName, err := currentDriverFrom(devicesPath, dev)
+	if err != nil {
+		return fail(err, fmt.Sprintf("Failed to read driver of device %q", dev))
+	}
+	result.PreviousDriver = driverName
+
+	for _, hook := range beforeBind {
+		if err := hook(dev); err != nil {
+			return fail(err, fmt.Sprintf("Failed to prepare device %q", dev))
+		}
+	}
+
+	if driverName == target || (driverName == "" && target == DriverNone) {
+		log.Warn().Msgf("Device %q is already bound to %s", dev, target)
+		result.NewDriver = driverName
+		result.Action = BindActionNoop
+		return result
+	}
+	if target != DriverNone {
+		if err := ensureDriverLoaded(log, root, target); err != nil {
+			return fail(err, fmt.Sprintf("Target driver %q is not usable", target))
+		}
+	}
+
+	// Pin the device to the target driver so no other driver claims it after the unbind,
+	// the override it had being put back if the bind fails
+	previousOverride, err = readDriverOverride(devPath)
+	if err != nil {
+		return fail(err, fmt.Sprintf("Failed to read driver override of device %q", dev))
+	}
+	err = writeSysfsFileWithTimeout(filepath.Join(devPath, "driver_override"), target)
+	if err != nil {
+		return fail(err, fmt.Sprintf("Failed to set driver override of device %q", dev))
+	}
+	overridden = true
+
+	// Unbind device from current driver
+	if driverName != "" {
+		if handler, ok := driverHandlers[driverName]; ok && handler.BeforeUnbind != nil {
+			if err := handler.BeforeUnbind(log, dev); err != nil {
+				return fail(err, fmt.Sprintf("Failed to prepare driver %q of device %q", driverName, dev))
+			}
+		}
+		log.Info().Msgf("Unbinding device %q from driver %q", dev, driverName)
+		err = writeSysfsFileWithTimeout(filepath.Join(root, PATH_SYS_BUS_PCI_DRIVERS, driverName, "unbind"), dev)
+		if err != nil {
+			return fail(err, fmt.Sprintf("Failed to unbind device %q", dev))
+		}
+	}
+
+	if target != DriverNone {
+		log.Info().Msgf("Binding device %q to %s", dev, target)
+		err = writeSysfsFileWithTimeout(filepath.Join(root, PATH_SYS_BUS_PCI_DRIVERS_PROBE), dev)
+		if err != nil {
+			return fail(err, fmt.Sprintf("Failed to bind device %q to %s", dev, target))
+		}
+	}
+
+	// Verify the binding
+	result.NewDriver, err = currentDriverFrom(devicesPath, dev)
+	if err != nil {
+		return fail(err, fmt.Sprintf("Failed to verify driver of device %q", dev))
+	}
+	if target == DriverNone {
+		if result.NewDriver != "" {
+			return fail(nil, fmt.Sprintf("Device %q is still bound to %q", dev, result.NewDriver))
+		}
+		// Without the override the device is probed again by the next driver loaded for it
+		writeOverride("")
+		log.Info().Msgf("Device %q unbound successfully", dev)
+		result.Action = BindActionUnbound
+		return result
+	}
+	if result.NewDriver != target {
+		return fail(nil, fmt.Sprintf("Device %q is bound to %q instead of %s", dev, result.NewDriver, target))
+	}
+
+	if !keepsDriverOverride(target) {
+		writeOverride("")
+	}
+	log.Info().Msgf("Device %q bound successfully", dev)
+	result.Action = BindActionBound
+	return result
+}
+
+// printBindResults prints the bind results as a table or in the requested output format
+func printBindResults(globals *Globals, results []BindResult, outFormat, expression string) error {
+	if len(outFormat) > 0 {
+		out, err := yqOutput(globals, results, expression, outFormat)
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(out))
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "DEVICE\tPREVIOUS DRIVER\tNEW DRIVER\tACTION\tDURATION\tERROR")
+	for _, r := range results {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", r.Device, r.PreviousDriver, r.NewDriver, r.Action, r.Duration, r.Error)
+	}
+	return w.Flush()
+}
+
+// bindExitError maps the bind results to an exit code
+func bindExitError(results []BindResult) error {
+	failed, noop := 0, 0
+	for _, r := range results {
+		switch r.Action {
+		case BindActionFailed:
+			failed++
+		case BindActionNoop:
+			noop++
+		}
+	}
+
+	switch {
+	case failed > 0 && failed == len(results):
+		return &ExitCodeError{Code: ExitCodeTotalFailure, Err: errors.New("all devices failed")}
+	case failed > 0:
+		return &ExitCodeError{Code: ExitCodePartialFailure, Err: fmt.Errorf("%d of %d devices failed", failed, len(results))}
+	case noop == len(results):
+		return &ExitCodeError{Code: ExitCodeNoop}
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/rs/zerolog"
+)
+
+// writeTestBindSysfs writes a device bound to driver, and the nvme and vfio-pci drivers, below root
+func writeTestBindSysfs(t *testing.T, root, dev, driver string) {
+	t.Helper()
+	for _, name := range []string{"nvme", "vfio-pci"} {
+		writeTestFile(t, root, filepath.Join(PATH_SYS_BUS_PCI_DRIVERS, name, "unbind"), "")
+	}
+	writeTestFile(t, root, PATH_SYS_BUS_PCI_DRIVERS_PROBE, "")
+	writeTestFile(t, root, filepath.Join(PATH_SYS_BUS_PCI_DEVICES, dev, "driver_override"), "\n")
+	setTestDriver(t, root, dev, driver)
+}
+
+// setTestDriver points the driver link of the device to driver, or removes it for an empty driver
+func setTestDriver(t *testing.T, root, dev, driver string) {
+	t.Helper()
+	link := filepath.Join(root, PATH_SYS_BUS_PCI_DEVICES, dev, "driver")
+	if err := os.Remove(link); err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	if driver == "" {
+		return
+	}
+	if err := os.Symlink(filepath.Join(root, PATH_SYS_BUS_PCI_DRIVERS, driver), link); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestBindDevice tests the driver_override left behind by binds that succeed and fail
+func TestBindDevice(t *testing.T) {
+	const dev = "0000:01:00.0"
+	log := zerolog.Nop()
+
+	testCases := []struct {
+		name   string
+		driver string
+		target string
+		// previous is the driver_override of the device before the bind
+		previous string
+		// probed is the driver the fake kernel binds the device to
+		probed   string
+		action   string
+		override string
+	}{
+		{"VfioKeepsOverride", "nvme", "vfio-pci", "(null)", "vfio-pci", BindActionBound, "vfio-pci"},
+		{"HostDriverClearsOverride", "vfio-pci", "nvme", "vfio-pci", "nvme", BindActionBound, ""},
+		{"NoneClearsOverride", "nvme", DriverNone, "(null)", "", BindActionUnbound, ""},
+		{"FailedBindClearsOverride", "vfio-pci", "nvme", "(null)", "vfio-pci", BindActionFailed, ""},
+		{"FailedBindRestoresOverride", "vfio-pci", "nvme", "pci-stub", "vfio-pci", BindActionFailed, "pci-stub"},
+		{"FailedUnbindRestoresOverride", "nvme", DriverNone, "vfio-pci", "nvme", BindActionFailed, "vfio-pci"},
+		{"Noop", "vfio-pci", "vfio-pci", "vfio-pci", "vfio-pci", BindActionNoop, "vfio-pci"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			root := t.TempDir()
+			writeTestBindSysfs(t, root, dev, tc.driver)
+			writeTestFile(t, root, filepath.Join(PATH_SYS_BUS_PCI_DEVICES, dev, "driver_override"), tc.previous+"\n")
+			// The kernel moves the device on the sysfs writes. The fake one moves it up front,
+			// after bindDevice read the current driver
+			kernel := func(string) error {
+				setTestDriver(t, root, dev, tc.probed)
+				return nil
+			}
+
+			result := bindDevice(&log, root, dev, tc.target, []func(dev string) error{kernel})
+			if result.Action != tc.action || result.PreviousDriver != tc.driver {
+				t.Errorf("bindDevice() got = %+v, expected action %s from %s", result, tc.action, tc.driver)
+			}
+			override := readTestFile(t, root, filepath.Join(PATH_SYS_BUS_PCI_DEVICES, dev, "driver_override"))
+			if strings.TrimSpace(override) != tc.override {
+				t.Errorf("bindDevice() left driver_override = %q, expected %q", override, tc.override)
+			}
+		})
+	}
+
+	t.Run("UnbindError", func(t *testing.T) {
+		root := t.TempDir()
+		writeTestBindSysfs(t, root, dev, "nvme")
+		writeTestFile(t, root, filepath.Join(PATH_SYS_BUS_PCI_DEVICES, dev, "driver_override"), "pci-stub\n")
+		if err := os.Remove(filepath.Join(root, PATH_SYS_BUS_PCI_DRIVERS, "nvme", "unbind")); err != nil {
+			t.Fatal(err)
+		}
+		result := bindDevice(&log, root, dev, "vfio-pci", nil)
+		if result.Action != BindActionFailed || !strings.Contains(result.Error, "Failed to unbind") {
+			t.Errorf("bindDevice() got = %+v, expected an unbind failure", result)
+		}
+		if override := readTestFile(t, root, filepath.Join(PATH_SYS_BUS_PCI_DEVICES, dev, "driver_override")); override != "pci-stub\n" {
+			t.Errorf("bindDevice() left driver_override = %q after a failed unbind", override)
+		}
+	})
+
+	t.Run("MissingDevice", func(t *testing.T) {
+		result := bindDevice(&log, t.TempDir(), dev, "vfio-pci", nil)
+		if result.Action != BindActionFailed || result.Error == "" {
+			t.Errorf("bindDevice() of a missing device got = %+v", result)
+		}
+	})
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/rs/zerolog"
+)
+
+const (
+	PATH_BINDINGS = "/etc/auto-vfio/bindings.json"
+
+	PersistBackendService = "service"
+)
+
+// savedBinding is a device binding applied at boot by the service
+type savedBinding struct {
+	Bus    string
+	Driver string
+}
+
+// readBindings reads the saved bindings. A missing file has none
+func readBindings(file string) ([]savedBinding, error) {
+	content, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return []savedBinding{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	bindings := []savedBinding{}
+	if err := json.Unmarshal(content, &bindings); err != nil {
+		return nil, fmt.Errorf("failed to parse %q: %w", file, err)
+	}
+	return bindings, nil
+}
+
+// writeBindings atomically writes the saved bindings, sorted by bus address
+func writeBindings(file string, bindings []savedBinding) error {
+	slices.SortFunc(bindings, func(a, b savedBinding) int {
+		return NaturalCompare(a.Bus, b.Bus)
+	})
+	content, err := json.MarshalIndent(bindings, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(file, append(content, '\n'), 0644)
+}
+
+// saveBinding adds or replaces the saved binding of the device
+func saveBinding(file, bus, driver string) error {
+	bindings, err := readBindings(file)
+	if err != nil {
+		return err
+	}
+	bindings = slices.DeleteFunc(bindings, func(s savedBinding) bool { return s.Bus == bus })
+	return writeBindings(file, append(bindings, savedBinding{Bus: bus, Driver: driver}))
+}
+
+// serviceBackend saves bindings by bus address for the boot service to apply with driver_override
+type serviceBackend struct {
+	root string
+}
+
+func (b *serviceBackend) Name() string {
+	return PersistBackendService
+}
+
+func (b *serviceBackend) path() string {
+	return filepath.Join(b.root, PATH_BINDINGS)
+}
+
+func (b *serviceBackend) Persist(log *zerolog.Logger, devices []persistedDevice) error {
+	for _, dev := range devices {
+		if dev.Bus == "" {
+			return fmt.Errorf("the %s backend needs the bus address of %s", b.Name(), dev.ID)
+		}
+		if err := saveBinding(b.path(), dev.Bus, "vfio-pci"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *serviceBackend) Unpersist(log *zerolog.Logger, devices []persistedDevice) error {
+	bindings, err := readBindings(b.path())
+	if err != nil {
+		return err
+	}
+	buses := []string{}
+	for _, s := range bindings {
+		buses = append(buses, s.Bus)
+	}
+	remove := overridesFor(b.root, devices, buses)
+	updated := slices.DeleteFunc(slices.Clone(bindings), func(s savedBinding) bool { return slices.Contains(remove, s.Bus) })
+	if len(updated) == len(bindings) {
+		return nil
+	}
+	return writeBindings(b.path(), updated)
+}
+
+func (b *serviceBackend) RegenerateCommand() string {
+	if _, err := os.Stat(filepath.Join(b.root, PATH_SYSTEMD_SYSTEM, SystemdUnitName)); err != nil {
+		return "auto-vfio install-service"
+	}
+	return ""
+}
+
+type _apply struct {
+	BindingsFile string `short:"f" help:"File with the saved bindings" default:"${bindings_file}" type:"path"`
+	outputFlags  `embed:""`
+}
+
+type ApplyCmd struct {
+	Apply _apply `cmd:"" help:"Apply the saved bindings. Run at boot by the service from 'install-service'"`
+}
+
+// Run executes the command
+func (cmd *_apply) Run(globals *Globals) error {
+	log := globals.config.Logger()
+
+	// Re-run elevated
+	if err := reRunElevated(); err != nil {
+		return err
+	}
+
+	bindings, err := readBindings(cmd.BindingsFile)
+	if err != nil {
+		return err
+	}
+	if len(bindings) == 0 {
+		log.Info().Msgf("No saved bindings in %q", cmd.BindingsFile)
+		return nil
+	}
+
+	results := make([]BindResult, 0, len(bindings))
+	for _, s := range bindings {
+		results = append(results, bindDevices(log, []string{s.Bus}, s.Driver)...)
+	}
+	if err := printBindResults(globals, results, cmd.OutputFormat, cmd.YQ); err != nil {
+		return err
+	}
+	return bindExitError(results)
+}
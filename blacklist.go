@@ -0,0 +1,223 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"text/tabwriter"
+)
+
+const (
+	PATH_BLACKLIST_CONF = "/etc/modprobe.d/auto-vfio-blacklist.conf"
+
+	// Class prefixes of the devices the host must keep at least one of
+	classPrefixDisplay = "03"
+	classPrefixAudio   = "0403"
+)
+
+type _blacklist struct {
+	Drivers       []string `arg:"" optional:"" help:"Host drivers to blacklist. Shows the managed blacklist if empty. Example: nouveau nvidia radeon snd_hda_intel"`
+	Force         bool     `short:"f" help:"Blacklist even when the host would be left without a GPU or audio device"`
+	DryRun        bool     `short:"n" help:"Only show the devices relying on the drivers"`
+	snapshotFlags `embed:""`
+}
+
+type _unblacklist struct {
+	Drivers []string `arg:"" help:"Host drivers to remove from the managed blacklist"`
+}
+
+type BlacklistCmd struct {
+	Blacklist   _blacklist   `cmd:"" help:"Blacklist host drivers in ${blacklist_conf}"`
+	Unblacklist _unblacklist `cmd:"" help:"Remove host drivers from ${blacklist_conf}"`
+}
+
+// driverUser is a present device that relies on a driver
+type driverUser struct {
+	Driver string
+	Device liveDevice
+}
+
+// readBlacklisted returns the modules blacklisted in any modprobe.d file below root
+func readBlacklisted(root string) []string {
+	modules := []string{}
+	for _, dir := range PATHS_MODPROBE_D {
+		files, _ := filepath.Glob(filepath.Join(root, dir, "*.conf"))
+		for _, file := range files {
+			if conf, err := readModprobeConf(file); err == nil {
+				modules = mergeIds(modules, conf.Blacklisted()...)
+			}
+		}
+	}
+	return modules
+}
+
+// candidateModules returns the modules that can drive the device, including its current driver
+func candidateModules(aliases []moduleAlias, dev liveDevice) []string {
+	modules := []string{}
+	if dev.Driver != "" {
+		modules = append(modules, normalizeModuleName(dev.Driver))
+	}
+	for _, module := range matchModules(aliases, dev.Modalias) {
+		modules = mergeIds(modules, normalizeModuleName(module))
+	}
+	return modules
+}
+
+// driverUsers returns the present devices that the drivers can drive
+func driverUsers(aliases []moduleAlias, devices []liveDevice, drivers []string) []driverUser {
+	users := []driverUser{}
+	for _, driver := range drivers {
+		for _, dev := range devices {
+			if slices.Contains(candidateModules(aliases, dev), normalizeModuleName(driver)) {
+				users = append(users, driverUser{Driver: driver, Device: dev})
+			}
+		}
+	}
+	return users
+}
+
+// hostLosses returns the device kinds the host would have none of left with the blacklist.
+// A host device keeps working when it has a candidate module that is not blacklisted
+func hostLosses(aliases []moduleAlias, devices []liveDevice, blacklisted []string) []string {
+	losses := []string{}
+	for _, kind := range []struct{ name, classPrefix string }{
+		{"GPU", classPrefixDisplay},
+		{"audio", classPrefixAudio},
+	} {
+		before, after := 0, 0
+		for _, dev := range devices {
+			if !strings.HasPrefix(dev.Class, kind.classPrefix) || dev.Driver == "vfio-pci" || dev.Driver == "pci-stub" {
+				continue
+			}
+			candidates := candidateModules(aliases, dev)
+			if len(candidates) == 0 {
+				continue
+			}
+			before++
+			if slices.ContainsFunc(candidates, func(m string) bool { return !slices.Contains(blacklisted, m) }) {
+				after++
+			}
+		}
+		if before > 0 && after == 0 {
+			losses = append(losses, kind.name)
+		}
+	}
+	return losses
+}
+
+// Run executes the command
+func (cmd *_blacklist) Run(globals *Globals) error {
+	log := globals.config.Logger()
+
+	if len(cmd.Drivers) > 0 && !cmd.DryRun {
+		if cmd.FromSnapshot != "" {
+			return fmt.Errorf("--from-snapshot only shows the blacklist, or the devices relying on the drivers with --dry-run")
+		}
+		// Re-run elevated before printing anything, the elevated run prints the devices
+		if err := reRunElevated(); err != nil {
+			return err
+		}
+	}
+	root, cleanup, err := cmd.root(log)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	conf, err := readModprobeConf(filepath.Join(root, PATH_BLACKLIST_CONF))
+	if err != nil {
+		return err
+	}
+	if len(cmd.Drivers) == 0 {
+		for _, module := range conf.Blacklisted() {
+			fmt.Println(module)
+		}
+		return nil
+	}
+
+	devices, err := readLiveDevices(root)
+	if err != nil {
+		return err
+	}
+	aliases, err := readModulesAlias(root, kernelRelease(root))
+	if err != nil {
+		log.Warn().Err(err).Msg("Only devices currently bound to the drivers are considered")
+	}
+
+	users := driverUsers(aliases, devices, cmd.Drivers)
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "DRIVER\tDEVICE\tID\tCLASS\tCURRENT DRIVER")
+	for _, u := range users {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", u.Driver, u.Device.Bus, u.Device.ID, u.Device.Class, u.Device.Driver)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	blacklisted := readBlacklisted(root)
+	for _, driver := range cmd.Drivers {
+		blacklisted = mergeIds(blacklisted, normalizeModuleName(driver))
+	}
+	if losses := hostLosses(aliases, devices, blacklisted); len(losses) > 0 {
+		err := fmt.Errorf("blacklisting %s would leave the host without %s", strings.Join(cmd.Drivers, ", "), strings.Join(losses, " and "))
+		if !cmd.Force {
+			return fmt.Errorf("%w. Use --force to blacklist anyway", err)
+		}
+		log.Warn().Err(err).Msg("Forcing the blacklist")
+	}
+	if cmd.DryRun {
+		return nil
+	}
+
+	modules := conf.Blacklisted()
+	for _, driver := range cmd.Drivers {
+		modules = mergeIds(modules, normalizeModuleName(driver))
+	}
+	conf.SetBlacklisted(modules)
+	if err := writeModprobeConf(PATH_BLACKLIST_CONF, conf); err != nil {
+		return err
+	}
+	log.Info().Msgf("Blacklisted %s in %q", strings.Join(cmd.Drivers, ", "), PATH_BLACKLIST_CONF)
+	logRegenerateInitramfs(globals)
+	return nil
+}
+
+// Run executes the command
+func (cmd *_unblacklist) Run(globals *Globals) error {
+	log := globals.config.Logger()
+
+	// Re-run elevated
+	if err := reRunElevated(); err != nil {
+		return err
+	}
+
+	conf, err := readModprobeConf(PATH_BLACKLIST_CONF)
+	if err != nil {
+		return err
+	}
+	remaining := slices.DeleteFunc(conf.Blacklisted(), func(m string) bool {
+		return slices.ContainsFunc(cmd.Drivers, func(d string) bool { return normalizeModuleName(d) == m })
+	})
+	conf.SetBlacklisted(remaining)
+	if len(remaining) == 0 {
+		if err := os.Remove(PATH_BLACKLIST_CONF); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	} else if err := writeModprobeConf(PATH_BLACKLIST_CONF, conf); err != nil {
+		return err
+	}
+	log.Info().Msgf("Removed %s from %q", strings.Join(cmd.Drivers, ", "), PATH_BLACKLIST_CONF)
+	logRegenerateInitramfs(globals)
+	return nil
+}
+
+// logRegenerateInitramfs tells to regenerate the initramfs, which has its own copy of modprobe.d
+func logRegenerateInitramfs(globals *Globals) {
+	backend, err := newPersistBackend(detectPersistBackend("/"), "/", nil)
+	if err == nil && backend.RegenerateCommand() != "" {
+		globals.config.Logger().Warn().Msgf("Run %q for the change to apply at next boot", backend.RegenerateCommand())
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/rs/zerolog"
+)
+
+// TestHostLosses tests that blacklisting is refused only when no host GPU or audio device keeps a driver
+func TestHostLosses(t *testing.T) {
+	aliases := []moduleAlias{
+		{Pattern: "pci:v000010DEd*sv*sd*bc03sc*i*", Module: "nouveau"},
+		{Pattern: "pci:v000010DEd*sv*sd*bc03sc*i*", Module: "nvidia"},
+		{Pattern: "pci:v00001002d*sv*sd*bc03sc*i*", Module: "amdgpu"},
+		{Pattern: "pci:v*d*sv*sd*bc04sc03i*", Module: "snd_hda_intel"},
+	}
+	nvidia := liveDevice{Bus: "0000:01:00.0", ID: "10de:2882", Driver: "nouveau", Class: "030000", Modalias: "pci:v000010DEd00002882sv00001458sd00004116bc03sc00i00"}
+	nvidiaAudio := liveDevice{Bus: "0000:01:00.1", ID: "10de:22be", Driver: "snd_hda_intel", Class: "040300", Modalias: "pci:v000010DEd000022BEsv00001458sd00004116bc04sc03i00"}
+	amd := liveDevice{Bus: "0000:0c:00.0", ID: "1002:164e", Driver: "amdgpu", Class: "030000", Modalias: "pci:v00001002d0000164Esv00001458sd0000D000bc03sc00i00"}
+	vfio := liveDevice{Bus: "0000:02:00.0", ID: "10de:2882", Driver: "vfio-pci", Class: "030000", Modalias: "pci:v000010DEd00002882sv00001458sd00004116bc03sc00i00"}
+
+	testCases := []struct {
+		name        string
+		devices     []liveDevice
+		blacklisted []string
+		expected    []string
+	}{
+		{"OtherGpuLeft", []liveDevice{nvidia, amd}, []string{"nouveau", "nvidia"}, []string{}},
+		{"OtherDriverLeft", []liveDevice{nvidia}, []string{"nouveau"}, []string{}},
+		{"OnlyGpu", []liveDevice{nvidia, vfio}, []string{"nouveau", "nvidia"}, []string{"GPU"}},
+		{"OnlyAudio", []liveDevice{nvidia, nvidiaAudio, amd}, []string{"snd_hda_intel"}, []string{"audio"}},
+		{"NoHostDevices", []liveDevice{vfio}, []string{"nouveau", "nvidia"}, []string{}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if actual := hostLosses(aliases, tc.devices, tc.blacklisted); !reflect.DeepEqual(actual, tc.expected) {
+				t.Errorf("hostLosses() got = %v, expected %v", actual, tc.expected)
+			}
+		})
+	}
+
+	users := driverUsers(aliases, []liveDevice{nvidia, nvidiaAudio, amd}, []string{"nvidia"})
+	if len(users) != 1 || users[0].Device.Bus != nvidia.Bus {
+		t.Errorf("driverUsers() got = %v", users)
+	}
+}
+
+// TestBlacklistElevatesFirst tests that blacklisting prints nothing before re-running elevated, so the devices show once
+func TestBlacklistElevatesFirst(t *testing.T) {
+	elevated := errors.New("elevated run done")
+	stubElevation(t, elevated)
+	globals := &Globals{config: &Config{logger: zerolog.Nop()}}
+
+	var err error
+	cmd := &_blacklist{Drivers: []string{"nouveau"}}
+	if output := captureStdout(t, func() { err = cmd.Run(globals) }); output != "" {
+		t.Errorf("Run() printed before re-running elevated: %q", output)
+	}
+	if !errors.Is(err, elevated) {
+		t.Errorf("Run() error = %v, expected the elevation result", err)
+	}
+}
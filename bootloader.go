@@ -0,0 +1,397 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+const (
+	PATH_DEFAULT_GRUB = "/etc/default/grub"
+
+	BootloaderGrub        = "grub"
+	BootloaderSystemdBoot = "systemd-boot"
+	BootloaderGrubby      = "grubby"
+	BootloaderKernelstub  = "kernelstub"
+
+	PATH_KERNELSTUB_CONFIGURATION = "/etc/kernelstub/configuration"
+)
+
+// PATHS_LOADER_ENTRIES are the directories systemd-boot reads its entries from
+var PATHS_LOADER_ENTRIES = []string{"/boot/loader/entries", "/efi/loader/entries", "/boot/efi/loader/entries"}
+
+var grubCmdlineRegex = regexp.MustCompile(`^(\s*GRUB_CMDLINE_LINUX_DEFAULT=)(.*)$`)
+
+// bootloader edits the kernel command line configured in a bootloader
+type bootloader interface {
+	Name() string
+	// Location returns where the kernel command line is configured
+	Location() string
+	// Args returns the kernel command line arguments configured in the bootloader
+	Args() ([]string, error)
+	// Update sets the given key=value arguments, replacing any with the same key, and removes the arguments with the given keys
+	Update(set, remove []string) error
+	// RegenerateCommand returns the command that must be run for the change to apply at next boot, if any
+	RegenerateCommand() string
+}
+
+// newBootloader returns the bootloader with the given name, editing files below root
+func newBootloader(name, root string) (bootloader, error) {
+	switch name {
+	case BootloaderGrub:
+		return &grubBootloader{root: root}, nil
+	case BootloaderSystemdBoot:
+		return &systemdBootBootloader{root: root}, nil
+	case BootloaderGrubby:
+		return &grubbyBootloader{}, nil
+	case BootloaderKernelstub:
+		return &kernelstubBootloader{root: root}, nil
+	}
+	return nil, fmt.Errorf("unsupported bootloader %q", name)
+}
+
+// detectBootloader returns the name of the bootloader configured on the system below root
+func detectBootloader(root string) (string, error) {
+	// grubby manages the BLS entries on Fedora and RHEL, prefer it on the live system
+	if _, err := exec.LookPath("grubby"); err == nil && root == "/" {
+		return BootloaderGrubby, nil
+	}
+	// kernelstub manages the systemd-boot entries on Pop!_OS
+	if _, err := os.Stat(filepath.Join(root, PATH_KERNELSTUB_CONFIGURATION)); err == nil {
+		return BootloaderKernelstub, nil
+	}
+	for _, dir := range PATHS_LOADER_ENTRIES {
+		if entries, _ := filepath.Glob(filepath.Join(root, dir, "*.conf")); len(entries) > 0 {
+			return BootloaderSystemdBoot, nil
+		}
+	}
+	if _, err := os.Stat(filepath.Join(root, PATH_DEFAULT_GRUB)); err == nil {
+		return BootloaderGrub, nil
+	}
+	return "", errors.New("no supported bootloader found")
+}
+
+// splitCmdline splits a kernel command line into arguments, keeping double quoted values together
+func splitCmdline(cmdline string) []string {
+	args := []string{}
+	var current strings.Builder
+	quoted := false
+	for _, r := range cmdline {
+		switch {
+		case r == '"':
+			quoted = !quoted
+			current.WriteRune(r)
+		case (r == ' ' || r == '\t' || r == '\n') && !quoted:
+			if current.Len() > 0 {
+				args = append(args, current.String())
+				current.Reset()
+			}
+		default:
+			current.WriteRune(r)
+		}
+	}
+	if current.Len() > 0 {
+		args = append(args, current.String())
+	}
+	return args
+}
+
+// cmdlineKey returns the key of a kernel command line argument.
+// video= can be given once per output, so its key includes the output, e.g. video=efifb
+func cmdlineKey(arg string) string {
+	key, value, _ := strings.Cut(arg, "=")
+	if output, _, ok := strings.Cut(value, ":"); ok && key == "video" {
+		return key + "=" + output
+	}
+	return key
+}
+
+// cmdlineValue returns the value of the argument with the given key, and whether it was found
+func cmdlineValue(args []string, key string) (string, bool) {
+	for _, arg := range args {
+		if cmdlineKey(arg) == key {
+			_, value, _ := strings.Cut(arg, "=")
+			return value, true
+		}
+	}
+	return "", false
+}
+
+// updateCmdline replaces or appends the set arguments and drops the arguments with the removed keys
+func updateCmdline(args, set, remove []string) []string {
+	result := make([]string, 0, len(args)+len(set))
+	pending := slices.Clone(set)
+	for _, arg := range args {
+		key := cmdlineKey(arg)
+		if slices.Contains(remove, key) {
+			continue
+		}
+		i := slices.IndexFunc(pending, func(s string) bool { return cmdlineKey(s) == key })
+		if i < 0 {
+			result = append(result, arg)
+			continue
+		}
+		// Keep the position of the replaced argument
+		result = append(result, pending[i])
+		pending = slices.Delete(pending, i, i+1)
+	}
+	return append(result, pending...)
+}
+
+// grubBootloader edits GRUB_CMDLINE_LINUX_DEFAULT in /etc/default/grub
+type grubBootloader struct {
+	root string
+}
+
+func (b *grubBootloader) Name() string {
+	return BootloaderGrub
+}
+
+func (b *grubBootloader) Location() string {
+	return PATH_DEFAULT_GRUB
+}
+
+func (b *grubBootloader) path() string {
+	return filepath.Join(b.root, PATH_DEFAULT_GRUB)
+}
+
+func (b *grubBootloader) Args() ([]string, error) {
+	content, err := os.ReadFile(b.path())
+	if err != nil {
+		return nil, err
+	}
+	scanner := bufio.NewScanner(strings.NewReader(string(content)))
+	for scanner.Scan() {
+		if m := grubCmdlineRegex.FindStringSubmatch(scanner.Text()); m != nil {
+			return splitCmdline(strings.Trim(m[2], `"'`)), nil
+		}
+	}
+	return []string{}, scanner.Err()
+}
+
+func (b *grubBootloader) Update(set, remove []string) error {
+	content, err := os.ReadFile(b.path())
+	if err != nil {
+		return err
+	}
+	lines := strings.Split(strings.TrimSuffix(string(content), "\n"), "\n")
+	found := false
+	for i, line := range lines {
+		m := grubCmdlineRegex.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		args := updateCmdline(splitCmdline(strings.Trim(m[2], `"'`)), set, remove)
+		lines[i] = m[1] + `"` + strings.Join(args, " ") + `"`
+		found = true
+		break
+	}
+	if !found {
+		lines = append(lines, `GRUB_CMDLINE_LINUX_DEFAULT="`+strings.Join(updateCmdline(nil, set, remove), " ")+`"`)
+	}
+	return writeFileAtomic(b.path(), []byte(strings.Join(lines, "\n")+"\n"), 0644)
+}
+
+func (b *grubBootloader) RegenerateCommand() string {
+	if _, err := exec.LookPath("update-grub"); err == nil {
+		return "update-grub"
+	}
+	if _, err := exec.LookPath("grub2-mkconfig"); err == nil {
+		return "grub2-mkconfig -o /boot/grub2/grub.cfg"
+	}
+	return "grub-mkconfig -o /boot/grub/grub.cfg"
+}
+
+// systemdBootBootloader edits the options lines of the systemd-boot loader entries
+type systemdBootBootloader struct {
+	root string
+}
+
+func (b *systemdBootBootloader) Name() string {
+	return BootloaderSystemdBoot
+}
+
+func (b *systemdBootBootloader) Location() string {
+	if entries := b.entries(); len(entries) > 0 {
+		return strings.TrimPrefix(filepath.Dir(entries[0]), strings.TrimSuffix(b.root, "/"))
+	}
+	return PATHS_LOADER_ENTRIES[0]
+}
+
+func (b *systemdBootBootloader) entries() []string {
+	entries := []string{}
+	for _, dir := range PATHS_LOADER_ENTRIES {
+		found, _ := filepath.Glob(filepath.Join(b.root, dir, "*.conf"))
+		entries = append(entries, found...)
+	}
+	return entries
+}
+
+// Args returns the arguments of the first loader entry
+func (b *systemdBootBootloader) Args() ([]string, error) {
+	entries := b.entries()
+	if len(entries) == 0 {
+		return nil, errors.New("no systemd-boot loader entries found")
+	}
+	content, err := os.ReadFile(entries[0])
+	if err != nil {
+		return nil, err
+	}
+	args := []string{}
+	for _, line := range strings.Split(string(content), "\n") {
+		if fields := strings.Fields(line); len(fields) > 0 && fields[0] == "options" {
+			args = append(args, splitCmdline(strings.Join(fields[1:], " "))...)
+		}
+	}
+	return args, nil
+}
+
+// Update changes all loader entries
+func (b *systemdBootBootloader) Update(set, remove []string) error {
+	entries := b.entries()
+	if len(entries) == 0 {
+		return errors.New("no systemd-boot loader entries found")
+	}
+	for _, entry := range entries {
+		content, err := os.ReadFile(entry)
+		if err != nil {
+			return err
+		}
+		lines := strings.Split(strings.TrimSuffix(string(content), "\n"), "\n")
+		found := false
+		for i, line := range lines {
+			fields := strings.Fields(line)
+			if len(fields) == 0 || fields[0] != "options" {
+				continue
+			}
+			lines[i] = "options " + strings.Join(updateCmdline(splitCmdline(strings.Join(fields[1:], " ")), set, remove), " ")
+			found = true
+			break
+		}
+		if !found {
+			lines = append(lines, "options "+strings.Join(updateCmdline(nil, set, remove), " "))
+		}
+		if err := writeFileAtomic(entry, []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *systemdBootBootloader) RegenerateCommand() string {
+	return ""
+}
+
+// grubbyBootloader edits all kernels through grubby
+type grubbyBootloader struct{}
+
+func (b *grubbyBootloader) Name() string {
+	return BootloaderGrubby
+}
+
+func (b *grubbyBootloader) Location() string {
+	return "grubby --info=DEFAULT"
+}
+
+func (b *grubbyBootloader) Args() ([]string, error) {
+	out, err := exec.Command("grubby", "--info=DEFAULT").Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to run grubby: %w", err)
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		if value, ok := strings.CutPrefix(line, "args="); ok {
+			return splitCmdline(strings.Trim(value, `"`)), nil
+		}
+	}
+	return []string{}, nil
+}
+
+func (b *grubbyBootloader) Update(set, remove []string) error {
+	// grubby removes arguments by their value: the key video=efifb would not remove video=efifb:off
+	current, err := b.Args()
+	if err != nil {
+		return err
+	}
+	removed, added := diffCmdline(current, updateCmdline(current, set, remove))
+	if len(removed) == 0 && len(added) == 0 {
+		return nil
+	}
+	cmdArgs := []string{"--update-kernel=ALL"}
+	if len(added) > 0 {
+		cmdArgs = append(cmdArgs, "--args="+strings.Join(added, " "))
+	}
+	if len(removed) > 0 {
+		cmdArgs = append(cmdArgs, "--remove-args="+strings.Join(removed, " "))
+	}
+	if out, err := exec.Command("grubby", cmdArgs...).CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to run grubby: %w: %s", err, out)
+	}
+	return nil
+}
+
+func (b *grubbyBootloader) RegenerateCommand() string {
+	return ""
+}
+
+// kernelstubBootloader edits the kernel options of kernelstub
+type kernelstubBootloader struct {
+	root string
+}
+
+func (b *kernelstubBootloader) Name() string {
+	return BootloaderKernelstub
+}
+
+func (b *kernelstubBootloader) Location() string {
+	return PATH_KERNELSTUB_CONFIGURATION
+}
+
+func (b *kernelstubBootloader) Args() ([]string, error) {
+	content, err := os.ReadFile(filepath.Join(b.root, PATH_KERNELSTUB_CONFIGURATION))
+	if err != nil {
+		return nil, err
+	}
+	config := struct {
+		User struct {
+			KernelOptions []string `json:"kernel_options"`
+		} `json:"user"`
+	}{}
+	if err := json.Unmarshal(content, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse %q: %w", PATH_KERNELSTUB_CONFIGURATION, err)
+	}
+	return config.User.KernelOptions, nil
+}
+
+// Update deletes the replaced and removed arguments, then adds the set ones
+func (b *kernelstubBootloader) Update(set, remove []string) error {
+	args, err := b.Args()
+	if err != nil {
+		return err
+	}
+	updated := updateCmdline(args, set, remove)
+	deleted := slices.DeleteFunc(slices.Clone(args), func(arg string) bool { return slices.Contains(updated, arg) })
+	added := slices.DeleteFunc(slices.Clone(updated), func(arg string) bool { return slices.Contains(args, arg) })
+
+	if len(deleted) > 0 {
+		if out, err := exec.Command("kernelstub", "-d", strings.Join(deleted, " ")).CombinedOutput(); err != nil {
+			return fmt.Errorf("failed to run kernelstub: %w: %s", err, out)
+		}
+	}
+	if len(added) > 0 {
+		if out, err := exec.Command("kernelstub", "-a", strings.Join(added, " ")).CombinedOutput(); err != nil {
+			return fmt.Errorf("failed to run kernelstub: %w: %s", err, out)
+		}
+	}
+	return nil
+}
+
+func (b *kernelstubBootloader) RegenerateCommand() string {
+	return ""
+}
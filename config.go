@@ -43,6 +43,7 @@ type Option func(*Config) error
 type Globals struct {
 	ConfigFile configFile `short:"c" help:"Config file location. Supported formats: ${supported_formats}" default:"default.yaml" type:"path"`
 	LogLevel   string     `short:"l" help:"Logging level. One of: ${log_levels}" default:"${default_log_level}"`
+	PciIds     string     `name:"pci-ids" help:"pci.ids database to use when newer than ${pci_ids_paths} and the embedded one" type:"path"`
 
 	config *Config
 }
@@ -0,0 +1,453 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+const (
+	PATH_SYS_DEVICES_SYSTEM_CPU  = "/sys/devices/system/cpu"
+	PATH_SYS_DEVICES_SYSTEM_NODE = "/sys/devices/system/node"
+)
+
+// cpuTopologyFiles are the CPU topology files, as globs, read by cpus
+var cpuTopologyFiles = []string{
+	filepath.Join(PATH_SYS_DEVICES_SYSTEM_CPU, "online"),
+	filepath.Join(PATH_SYS_DEVICES_SYSTEM_CPU, "cpu[0-9]*", "topology", "physical_package_id"),
+	filepath.Join(PATH_SYS_DEVICES_SYSTEM_CPU, "cpu[0-9]*", "topology", "core_id"),
+	filepath.Join(PATH_SYS_DEVICES_SYSTEM_CPU, "cpu[0-9]*", "topology", "thread_siblings_list"),
+	filepath.Join(PATH_SYS_DEVICES_SYSTEM_CPU, "cpu[0-9]*", "cache", "index[0-9]*", "level"),
+	filepath.Join(PATH_SYS_DEVICES_SYSTEM_CPU, "cpu[0-9]*", "cache", "index[0-9]*", "shared_cpu_list"),
+	filepath.Join(PATH_SYS_DEVICES_SYSTEM_NODE, "node[0-9]*", "cpulist"),
+}
+
+type _cpus struct {
+	VCpus         int `name:"vcpus" help:"Number of vCPUs to pin. Default: all the local CPUs left after the host and the emulator" placeholder:"count"`
+	EmulatorCores int `help:"Number of cores for the emulator and I/O threads" default:"1" placeholder:"count"`
+	listFilters   `embed:""`
+	outputFlags   `embed:""`
+	snapshotFlags `embed:""`
+}
+
+type CpusCmd struct {
+	Cpus _cpus `cmd:"" help:"Recommend vCPU and emulator pinning local to the passthrough devices, from the CPU topology. Devices bound to vfio-pci unless filtered"`
+}
+
+// CpuThread is an online logical CPU and where it sits in the topology
+type CpuThread struct {
+	CPU     int
+	Package int
+	Core    int
+	// Node is the NUMA node, -1 if unknown
+	Node int
+	// Siblings are the SMT threads of its core, itself included, as a cpu list
+	Siblings string
+	// Cache are the CPUs sharing its last level cache, the L3 of a CCX on AMD, as a cpu list
+	Cache string
+}
+
+// CpuTopology are the online CPUs, in CPU order, and the CPUs of each NUMA node
+type CpuTopology struct {
+	Threads []CpuThread
+	Nodes   map[int][]int
+}
+
+// CpuDevice is a device and the CPUs local to it
+type CpuDevice struct {
+	Bus       string
+	NumaNode  string
+	LocalCpus string
+	Name      string
+}
+
+// CpuPinning is the recommended placement of a VM next to its devices
+type CpuPinning struct {
+	Devices []CpuDevice
+	// Local are the CPUs local to the devices
+	Local []int
+	// Caches are the last level caches of the local CPUs, as cpu lists
+	Caches []string
+	// VCpus is the CPU each vCPU is pinned to, the threads of a core being consecutive vCPUs
+	VCpus    []int
+	Emulator []int
+	// Host are the local CPUs left to the host, its first core included
+	Host []int
+	// Cores and Threads are the guest CPU topology matching VCpus
+	Cores   int
+	Threads int
+	// Nodes are the NUMA nodes of VCpus, to allocate the guest memory from
+	Nodes []int
+}
+
+// parseCpuList parses a kernel cpu list, e.g. 0-3,8-11
+func parseCpuList(list string) ([]int, error) {
+	cpus := []int{}
+	if list == "" {
+		return cpus, nil
+	}
+	for _, part := range strings.Split(list, ",") {
+		first, last, isRange := strings.Cut(part, "-")
+		start, err := strconv.Atoi(first)
+		if err != nil || start < 0 {
+			return nil, fmt.Errorf("invalid cpu list %q", list)
+		}
+		end := start
+		if isRange {
+			if end, err = strconv.Atoi(last); err != nil || end < start {
+				return nil, fmt.Errorf("invalid cpu list %q", list)
+			}
+		}
+		for cpu := start; cpu <= end; cpu++ {
+			cpus = append(cpus, cpu)
+		}
+	}
+	slices.Sort(cpus)
+	return slices.Compact(cpus), nil
+}
+
+// formatCpuList formats CPUs as a kernel cpu list, with ranges
+func formatCpuList(cpus []int) string {
+	sorted := slices.Compact(slices.Sorted(slices.Values(cpus)))
+	parts := []string{}
+	for i := 0; i < len(sorted); {
+		j := i
+		for j+1 < len(sorted) && sorted[j+1] == sorted[j]+1 {
+			j++
+		}
+		if j == i {
+			parts = append(parts, strconv.Itoa(sorted[i]))
+		} else {
+			parts = append(parts, fmt.Sprintf("%d-%d", sorted[i], sorted[j]))
+		}
+		i = j + 1
+	}
+	return strings.Join(parts, ",")
+}
+
+// normalizedCpuList returns a cpu list in the canonical form of formatCpuList, "" if invalid
+func normalizedCpuList(list string) string {
+	cpus, err := parseCpuList(list)
+	if err != nil {
+		return ""
+	}
+	return formatCpuList(cpus)
+}
+
+// readCpuTopology reads the online CPUs, their cores, caches and NUMA nodes below root
+func readCpuTopology(root string) (CpuTopology, error) {
+	read := func(path string) string {
+		content, _ := os.ReadFile(path)
+		return strings.TrimSpace(string(content))
+	}
+	cpuPath := filepath.Join(root, PATH_SYS_DEVICES_SYSTEM_CPU)
+	online, err := os.ReadFile(filepath.Join(cpuPath, "online"))
+	if err != nil {
+		return CpuTopology{}, fmt.Errorf("failed to read the online CPUs: %w", err)
+	}
+	cpus, err := parseCpuList(strings.TrimSpace(string(online)))
+	if err != nil {
+		return CpuTopology{}, err
+	}
+
+	topo := CpuTopology{Nodes: map[int][]int{}}
+	nodeOf := map[int]int{}
+	nodeDirs, _ := filepath.Glob(filepath.Join(root, PATH_SYS_DEVICES_SYSTEM_NODE, "node[0-9]*"))
+	for _, dir := range nodeDirs {
+		node, err := strconv.Atoi(strings.TrimPrefix(filepath.Base(dir), "node"))
+		if err != nil {
+			continue
+		}
+		nodeCpus, err := parseCpuList(read(filepath.Join(dir, "cpulist")))
+		if err != nil {
+			continue
+		}
+		topo.Nodes[node] = nodeCpus
+		for _, cpu := range nodeCpus {
+			nodeOf[cpu] = node
+		}
+	}
+
+	for _, cpu := range cpus {
+		dir := filepath.Join(cpuPath, fmt.Sprintf("cpu%d", cpu))
+		t := CpuThread{CPU: cpu, Node: -1, Siblings: normalizedCpuList(read(filepath.Join(dir, "topology", "thread_siblings_list")))}
+		t.Package, _ = strconv.Atoi(read(filepath.Join(dir, "topology", "physical_package_id")))
+		t.Core, _ = strconv.Atoi(read(filepath.Join(dir, "topology", "core_id")))
+		if node, ok := nodeOf[cpu]; ok {
+			t.Node = node
+		}
+		if t.Siblings == "" {
+			t.Siblings = strconv.Itoa(cpu)
+		}
+		// The last level cache is the one of the highest level
+		indexes, _ := filepath.Glob(filepath.Join(dir, "cache", "index[0-9]*"))
+		lastLevel := 0
+		for _, index := range indexes {
+			level, err := strconv.Atoi(read(filepath.Join(index, "level")))
+			if err != nil || level <= lastLevel {
+				continue
+			}
+			if shared := normalizedCpuList(read(filepath.Join(index, "shared_cpu_list"))); shared != "" {
+				lastLevel, t.Cache = level, shared
+			}
+		}
+		topo.Threads = append(topo.Threads, t)
+	}
+	return topo, nil
+}
+
+// localCpus returns the CPUs local to a device: its local_cpulist, else the CPUs of its NUMA node, else all of them
+func localCpus(topo CpuTopology, dev PciDevice) []int {
+	if cpus, err := parseCpuList(dev.LocalCpuList); err == nil && len(cpus) > 0 {
+		return cpus
+	}
+	if node, err := strconv.Atoi(dev.NumaNode); err == nil && len(topo.Nodes[node]) > 0 {
+		return topo.Nodes[node]
+	}
+	cpus := make([]int, 0, len(topo.Threads))
+	for _, t := range topo.Threads {
+		cpus = append(cpus, t.CPU)
+	}
+	return cpus
+}
+
+// cpuCore is a core and its threads, local to the devices
+type cpuCore struct {
+	threads []int
+	cache   string
+}
+
+// recommendPinning pins vcpus vCPUs, all the local CPUs left if 0, and the emulator to cores local to the devices.
+// The first core of the host is left to its housekeeping and interrupts, and the emulator shares its last level
+// cache when local, so that vCPUs get whole caches, biggest first
+func recommendPinning(topo CpuTopology, local []int, vcpus, emulatorCores int) (CpuPinning, error) {
+	p := CpuPinning{Local: local, Host: []int{}, Emulator: []int{}, VCpus: []int{}, Caches: []string{}, Nodes: []int{}}
+	if vcpus < 0 {
+		return p, fmt.Errorf("invalid number of vCPUs %d: expected 0 or more, 0 pinning all the local CPUs left", vcpus)
+	}
+	if emulatorCores < 0 {
+		return p, fmt.Errorf("invalid number of emulator cores %d: expected 0 or more", emulatorCores)
+	}
+	cores := []cpuCore{}
+	bySiblings := map[string]int{}
+	for _, t := range topo.Threads {
+		if !slices.Contains(local, t.CPU) {
+			continue
+		}
+		i, ok := bySiblings[t.Siblings]
+		if !ok {
+			cores = append(cores, cpuCore{cache: t.Cache})
+			i = len(cores) - 1
+			bySiblings[t.Siblings] = i
+		}
+		cores[i].threads = append(cores[i].threads, t.CPU)
+		if !slices.Contains(p.Caches, t.Cache) {
+			p.Caches = append(p.Caches, t.Cache)
+		}
+	}
+	if len(cores) == 0 {
+		return p, fmt.Errorf("no online CPU is local to the devices")
+	}
+
+	emulatorCache := cores[len(cores)-1].cache
+	if slices.Contains(cores[0].threads, topo.Threads[0].CPU) && len(cores) > 1 {
+		p.Host = append(p.Host, cores[0].threads...)
+		emulatorCache = cores[0].cache
+		cores = cores[1:]
+	}
+
+	// Emulator cores come from the cache of the host core first, then from the last cores
+	candidates := []int{}
+	for i := range cores {
+		if cores[i].cache == emulatorCache {
+			candidates = append(candidates, i)
+		}
+	}
+	for i := len(cores) - 1; i >= 0; i-- {
+		if !slices.Contains(candidates, i) {
+			candidates = append(candidates, i)
+		}
+	}
+	emulator := candidates[:min(emulatorCores, len(candidates)-1)]
+	for _, i := range emulator {
+		p.Emulator = append(p.Emulator, cores[i].threads...)
+	}
+	slices.Sort(p.Emulator)
+	remaining := []cpuCore{}
+	for i, core := range cores {
+		if !slices.Contains(emulator, i) {
+			remaining = append(remaining, core)
+		}
+	}
+
+	// vCPUs fill the caches without the host and emulator first, the biggest first
+	byCache := map[string]int{}
+	for _, core := range remaining {
+		byCache[core.cache]++
+	}
+	slices.SortStableFunc(remaining, func(a, b cpuCore) int {
+		if (a.cache == emulatorCache) != (b.cache == emulatorCache) {
+			if a.cache == emulatorCache {
+				return 1
+			}
+			return -1
+		}
+		return cmp.Or(byCache[b.cache]-byCache[a.cache], slices.Index(p.Caches, a.cache)-slices.Index(p.Caches, b.cache))
+	})
+	available := 0
+	for _, core := range remaining {
+		available += len(core.threads)
+	}
+	if vcpus == 0 {
+		vcpus = available
+	}
+	if vcpus > available {
+		return p, fmt.Errorf("%d vCPUs requested, only %d local CPUs are left after the host and the emulator", vcpus, available)
+	}
+	threads := 0
+	for _, core := range remaining {
+		if len(p.VCpus) < vcpus {
+			taken := core.threads[:min(len(core.threads), vcpus-len(p.VCpus))]
+			p.VCpus = append(p.VCpus, taken...)
+			if threads == 0 {
+				threads = len(taken)
+			} else if threads != len(taken) {
+				threads = 1
+			}
+			continue
+		}
+		p.Host = append(p.Host, core.threads...)
+	}
+	slices.Sort(p.Host)
+	if threads == 0 || len(p.VCpus)%threads != 0 {
+		threads = 1
+	}
+	p.Threads, p.Cores = threads, len(p.VCpus)/threads
+
+	for _, t := range topo.Threads {
+		if slices.Contains(p.VCpus, t.CPU) && t.Node >= 0 && !slices.Contains(p.Nodes, t.Node) {
+			p.Nodes = append(p.Nodes, t.Node)
+		}
+	}
+	slices.Sort(p.Nodes)
+	return p, nil
+}
+
+// printLibvirtPinning prints the domain XML elements applying the pinning
+func printLibvirtPinning(w io.Writer, p CpuPinning) {
+	fmt.Fprintf(w, "<vcpu placement=\"static\">%d</vcpu>\n", len(p.VCpus))
+	fmt.Fprintln(w, "<cputune>")
+	for vcpu, cpu := range p.VCpus {
+		fmt.Fprintf(w, "  <vcpupin vcpu=\"%d\" cpuset=\"%d\"/>\n", vcpu, cpu)
+	}
+	if len(p.Emulator) > 0 {
+		fmt.Fprintf(w, "  <emulatorpin cpuset=\"%s\"/>\n", formatCpuList(p.Emulator))
+	}
+	fmt.Fprintln(w, "</cputune>")
+	if len(p.Nodes) > 0 {
+		nodes := make([]string, 0, len(p.Nodes))
+		for _, node := range p.Nodes {
+			nodes = append(nodes, strconv.Itoa(node))
+		}
+		fmt.Fprintln(w, "<numatune>")
+		fmt.Fprintf(w, "  <memory mode=\"strict\" nodeset=\"%s\"/>\n", strings.Join(nodes, ","))
+		fmt.Fprintln(w, "</numatune>")
+	}
+	fmt.Fprintln(w, "<cpu mode=\"host-passthrough\">")
+	fmt.Fprintf(w, "  <topology sockets=\"1\" dies=\"1\" cores=\"%d\" threads=\"%d\"/>\n", p.Cores, p.Threads)
+	fmt.Fprintln(w, "</cpu>")
+}
+
+// Run executes the command
+func (cmd *_cpus) Run(globals *Globals) error {
+	log := globals.config.Logger()
+
+	root, cleanup, err := cmd.root(log)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	devices, err := parsePciDevices(root)
+	if err != nil {
+		return err
+	}
+	db, err := pciIdsAt(root)
+	if err != nil {
+		return err
+	}
+	filters := cmd.listFilters
+	if reflect.ValueOf(filters).IsZero() {
+		filters.BoundTo = []string{"vfio-pci"}
+	}
+	devices, err = filters.filter(db, devices)
+	if err != nil {
+		return err
+	}
+	if len(devices) == 0 {
+		return fmt.Errorf("no device selected: bind the passthrough devices to vfio-pci, or select them with the filters")
+	}
+	topo, err := readCpuTopology(root)
+	if err != nil {
+		return err
+	}
+
+	local := []int{}
+	nodes := []string{}
+	cpuDevices := make([]CpuDevice, 0, len(devices))
+	for _, dev := range devices {
+		cpus := localCpus(topo, dev)
+		local = append(local, cpus...)
+		if !slices.Contains(nodes, dev.NumaNode) {
+			nodes = append(nodes, dev.NumaNode)
+		}
+		cpuDevices = append(cpuDevices, CpuDevice{
+			Bus:       dev.Bus,
+			NumaNode:  dev.NumaNode,
+			LocalCpus: formatCpuList(cpus),
+			Name:      strings.TrimSpace(dev.VendorName + " " + dev.DeviceName),
+		})
+	}
+	local = slices.Compact(slices.Sorted(slices.Values(local)))
+	if len(nodes) > 1 {
+		log.Warn().Msgf("The devices are on different NUMA nodes (%s): the vCPUs span them", strings.Join(nodes, ", "))
+	}
+
+	pinning, err := recommendPinning(topo, local, cmd.VCpus, cmd.EmulatorCores)
+	if err != nil {
+		return err
+	}
+	pinning.Devices = cpuDevices
+
+	if len(cmd.OutputFormat) > 0 {
+		out, err := yqOutput(globals, pinning, cmd.YQ, cmd.OutputFormat)
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(out))
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "DEVICE\tNUMA NODE\tLOCAL CPUS\tNAME")
+	for _, dev := range pinning.Devices {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", dev.Bus, dev.NumaNode, dev.LocalCpus, dev.Name)
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintf(w, "Last level caches:\t%s\n", strings.Join(pinning.Caches, "  "))
+	fmt.Fprintf(w, "vCPUs:\t%s (%d vCPUs, %d cores x %d threads)\n", formatCpuList(pinning.VCpus), len(pinning.VCpus), pinning.Cores, pinning.Threads)
+	fmt.Fprintf(w, "Emulator:\t%s\n", formatCpuList(pinning.Emulator))
+	fmt.Fprintf(w, "Host:\t%s\n", formatCpuList(pinning.Host))
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	fmt.Println()
+	printLibvirtPinning(os.Stdout, pinning)
+	return nil
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// writeTestTopology writes a dual socket topology: 16 cores of 2 threads, CPU n and n+16 being siblings,
+// 8 cores per NUMA node and 4 cores per L3 cache
+func writeTestTopology(t *testing.T, root string) {
+	t.Helper()
+	writeTestFile(t, root, filepath.Join(PATH_SYS_DEVICES_SYSTEM_CPU, "online"), "0-31\n")
+	for cpu := range 32 {
+		core := cpu % 16
+		dir := filepath.Join(PATH_SYS_DEVICES_SYSTEM_CPU, fmt.Sprintf("cpu%d", cpu))
+		cache := fmt.Sprintf("%d-%d,%d-%d", core/4*4, core/4*4+3, core/4*4+16, core/4*4+19)
+		writeTestFile(t, root, filepath.Join(dir, "topology", "physical_package_id"), fmt.Sprintf("%d\n", core/8))
+		writeTestFile(t, root, filepath.Join(dir, "topology", "core_id"), fmt.Sprintf("%d\n", core%8))
+		writeTestFile(t, root, filepath.Join(dir, "topology", "thread_siblings_list"), fmt.Sprintf("%d,%d\n", core, core+16))
+		writeTestFile(t, root, filepath.Join(dir, "cache", "index2", "level"), "2\n")
+		writeTestFile(t, root, filepath.Join(dir, "cache", "index2", "shared_cpu_list"), fmt.Sprintf("%d,%d\n", core, core+16))
+		writeTestFile(t, root, filepath.Join(dir, "cache", "index3", "level"), "3\n")
+		writeTestFile(t, root, filepath.Join(dir, "cache", "index3", "shared_cpu_list"), cache+"\n")
+	}
+	writeTestFile(t, root, filepath.Join(PATH_SYS_DEVICES_SYSTEM_NODE, "node0", "cpulist"), "0-7,16-23\n")
+	writeTestFile(t, root, filepath.Join(PATH_SYS_DEVICES_SYSTEM_NODE, "node1", "cpulist"), "8-15,24-31\n")
+}
+
+// TestCpuList tests parsing and formatting kernel cpu lists
+func TestCpuList(t *testing.T) {
+	cpus, err := parseCpuList("8-11,0-3,5,4")
+	if err != nil || !reflect.DeepEqual(cpus, []int{0, 1, 2, 3, 4, 5, 8, 9, 10, 11}) {
+		t.Errorf("parseCpuList() got = %v, %v", cpus, err)
+	}
+	if list := formatCpuList(cpus); list != "0-5,8-11" {
+		t.Errorf("formatCpuList() got = %q, expected 0-5,8-11", list)
+	}
+	for _, invalid := range []string{"3-1", "a", "1,", "-1"} {
+		if _, err := parseCpuList(invalid); err == nil {
+			t.Errorf("parseCpuList(%q) expected an error", invalid)
+		}
+	}
+}
+
+// TestRecommendPinning tests pinning next to devices of either NUMA node
+func TestRecommendPinning(t *testing.T) {
+	root := t.TempDir()
+	writeTestTopology(t, root)
+	topo, err := readCpuTopology(root)
+	if err != nil {
+		t.Fatalf("readCpuTopology() error = %v", err)
+	}
+	if len(topo.Threads) != 32 || topo.Threads[20].Node != 0 || topo.Threads[20].Siblings != "4,20" || topo.Threads[20].Cache != "4-7,20-23" {
+		t.Fatalf("readCpuTopology() got = %+v", topo.Threads[20])
+	}
+
+	tests := []struct {
+		name     string
+		device   PciDevice
+		vcpus    int
+		vCpus    []int
+		emulator string
+		host     string
+		nodes    []int
+	}{
+		{
+			// The host core 0 is local: the emulator shares its cache, the vCPUs get the other cache whole
+			name:     "node 0",
+			device:   PciDevice{NumaNode: "0", LocalCpuList: "0-7,16-23"},
+			vcpus:    8,
+			vCpus:    []int{4, 20, 5, 21, 6, 22, 7, 23},
+			emulator: "1,17",
+			host:     "0,2-3,16,18-19",
+			nodes:    []int{0},
+		},
+		{
+			name:     "node 0, all CPUs",
+			device:   PciDevice{NumaNode: "0"},
+			vCpus:    []int{4, 20, 5, 21, 6, 22, 7, 23, 2, 18, 3, 19},
+			emulator: "1,17",
+			host:     "0,16",
+			nodes:    []int{0},
+		},
+		{
+			// Without the host core, the emulator shares the last cache
+			name:     "node 1",
+			device:   PciDevice{NumaNode: "1", LocalCpuList: "8-15,24-31"},
+			vcpus:    6,
+			vCpus:    []int{8, 24, 9, 25, 10, 26},
+			emulator: "12,28",
+			host:     "11,13-15,27,29-31",
+			nodes:    []int{1},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			p, err := recommendPinning(topo, localCpus(topo, tc.device), tc.vcpus, 1)
+			if err != nil {
+				t.Fatalf("recommendPinning() error = %v", err)
+			}
+			if !reflect.DeepEqual(p.VCpus, tc.vCpus) || formatCpuList(p.Emulator) != tc.emulator || formatCpuList(p.Host) != tc.host || !reflect.DeepEqual(p.Nodes, tc.nodes) {
+				t.Errorf("recommendPinning() got vCPUs %v, emulator %s, host %s, nodes %v", p.VCpus, formatCpuList(p.Emulator), formatCpuList(p.Host), p.Nodes)
+			}
+			if p.Threads != 2 || p.Cores != len(tc.vCpus)/2 {
+				t.Errorf("recommendPinning() got topology %d cores x %d threads", p.Cores, p.Threads)
+			}
+		})
+	}
+
+	if _, err := recommendPinning(topo, localCpus(topo, PciDevice{NumaNode: "1"}), 16, 1); err == nil {
+		t.Errorf("recommendPinning() of more vCPUs than local CPUs expected an error")
+	}
+	for _, counts := range [][2]int{{-1, 1}, {0, -1}, {4, -1}} {
+		if _, err := recommendPinning(topo, localCpus(topo, PciDevice{NumaNode: "1"}), counts[0], counts[1]); err == nil {
+			t.Errorf("recommendPinning() of %d vCPUs and %d emulator cores expected an error", counts[0], counts[1])
+		}
+	}
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+const (
+	PATH_SYS_BUS_PCI_RESCAN = "/sys/bus/pci/rescan"
+
+	// sysfsSlowWriteTimeout bounds writes that reset, remove or probe devices
+	sysfsSlowWriteTimeout = 30 * time.Second
+)
+
+const (
+	DeviceChangeAdded   = "added"
+	DeviceChangeRemoved = "removed"
+	DeviceChangeDriver  = "driver"
+)
+
+type _deviceReset struct {
+	Bus         []string `short:"b" required:"" help:"Comma separated list of Bus addresses to reset" placeholder:"bus-address1"`
+	Method      string   `short:"m" help:"Reset method written to reset_method before the reset. Example: flr, pm, bus. Device default if empty"`
+	Force       bool     `short:"f" help:"Also reset devices bound to host drivers"`
+	outputFlags `embed:""`
+}
+
+type _deviceRemove struct {
+	Bus         []string `short:"b" required:"" help:"Comma separated list of Bus addresses to remove" placeholder:"bus-address1"`
+	Force       bool     `short:"f" help:"Also remove devices bound to host drivers"`
+	outputFlags `embed:""`
+}
+
+type _device struct {
+	Reset  _deviceReset  `cmd:"" help:"Reset PCI devices"`
+	Remove _deviceRemove `cmd:"" help:"Remove PCI devices from the bus. Use 'bus rescan' to bring them back"`
+}
+
+type DeviceCmd struct {
+	Device _device `cmd:"" help:"Recover PCI devices"`
+}
+
+type _busRescan struct {
+	Bridge      string `help:"Bus address of the bridge to rescan. Rescans all PCI buses if empty" placeholder:"bus-address"`
+	outputFlags `embed:""`
+}
+
+type _bus struct {
+	Rescan _busRescan `cmd:"" help:"Rescan the PCI bus for devices"`
+}
+
+type BusCmd struct {
+	Bus _bus `cmd:"" help:"Manage the PCI bus"`
+}
+
+// DeviceChange describes how a device differs between two discoveries
+type DeviceChange struct {
+	Bus    string
+	Change string
+	Before string
+	After  string
+}
+
+// Run executes the command
+func (cmd *_deviceReset) Run(globals *Globals) error {
+	if err := reRunElevated(); err != nil {
+		return err
+	}
+	log := globals.config.Logger()
+
+	return recoverDevices(globals, cmd.outputFlags, func() error {
+		var errs []error
+		for _, dev := range cmd.Bus {
+			if err := checkHostDriver(PATH_SYS_BUS_PCI_DEVICES, dev, "reset", cmd.Force); err != nil {
+				log.Error().Err(err).Msgf("Refusing to reset device %q", dev)
+				errs = append(errs, err)
+				continue
+			}
+			if err := resetDevice(log, dev, cmd.Method); err != nil {
+				log.Error().Err(err).Msgf("Failed to reset device %q", dev)
+				errs = append(errs, err)
+				continue
+			}
+			log.Info().Msgf("Device %q reset successfully", dev)
+		}
+		return errors.Join(errs...)
+	})
+}
+
+// checkHostDriver returns an error when the device is bound to a host driver, unless forced,
+// so that devices the host is using are not reset or removed by mistake
+func checkHostDriver(devicesPath, dev, action string, force bool) error {
+	driver, err := currentDriverFrom(devicesPath, dev)
+	if err != nil {
+		return fmt.Errorf("failed to read driver of device %q: %w", dev, err)
+	}
+	if !force && driver != "" && driver != "vfio-pci" && driver != "pci-stub" {
+		return fmt.Errorf("device %q is bound to host driver %q. Use --force to %s it anyway", dev, driver, action)
+	}
+	return nil
+}
+
+// resetDevice resets the device, optionally with a specific method
+func resetDevice(log *zerolog.Logger, dev, method string) error {
+	devPath := filepath.Join(PATH_SYS_BUS_PCI_DEVICES, dev)
+	if _, err := os.Stat(filepath.Join(devPath, "reset")); err != nil {
+		return fmt.Errorf("device %q does not support reset: %w", dev, err)
+	}
+
+	if method != "" {
+		resetMethodPath := filepath.Join(devPath, "reset_method")
+		previous, err := os.ReadFile(resetMethodPath)
+		if err != nil {
+			return fmt.Errorf("failed to read reset methods of device %q: %w", dev, err)
+		}
+		if !slices.Contains(strings.Fields(string(previous)), method) {
+			return fmt.Errorf("reset method %q is not supported by device %q. Supported: %s", method, dev, strings.TrimSpace(string(previous)))
+		}
+		log.Info().Msgf("Setting reset method of device %q to %q", dev, method)
+		if err := writeSysfsFileWithTimeout(resetMethodPath, method); err != nil {
+			return fmt.Errorf("failed to set reset method: %w", err)
+		}
+		// Restore the reset methods the device had before
+		defer func() {
+			if err := writeSysfsFileWithTimeout(resetMethodPath, strings.TrimSpace(string(previous))); err != nil {
+				log.Warn().Err(err).Msgf("Failed to restore reset methods of device %q", dev)
+			}
+		}()
+	}
+
+	log.Info().Msgf("Resetting device %q", dev)
+	return writeSysfsFileTimeout(filepath.Join(devPath, "reset"), "1", sysfsSlowWriteTimeout)
+}
+
+// Run executes the command
+func (cmd *_deviceRemove) Run(globals *Globals) error {
+	if err := reRunElevated(); err != nil {
+		return err
+	}
+	log := globals.config.Logger()
+
+	return recoverDevices(globals, cmd.outputFlags, func() error {
+		var errs []error
+		for _, dev := range cmd.Bus {
+			if err := checkHostDriver(PATH_SYS_BUS_PCI_DEVICES, dev, "remove", cmd.Force); err != nil {
+				log.Error().Err(err).Msgf("Refusing to remove device %q", dev)
+				errs = append(errs, err)
+				continue
+			}
+			log.Info().Msgf("Removing device %q", dev)
+			err := writeSysfsFileTimeout(filepath.Join(PATH_SYS_BUS_PCI_DEVICES, dev, "remove"), "1", sysfsSlowWriteTimeout)
+			if err != nil {
+				log.Error().Err(err).Msgf("Failed to remove device %q", dev)
+				errs = append(errs, err)
+			}
+		}
+		return errors.Join(errs...)
+	})
+}
+
+// Run executes the command
+func (cmd *_busRescan) Run(globals *Globals) error {
+	if err := reRunElevated(); err != nil {
+		return err
+	}
+	log := globals.config.Logger()
+
+	return recoverDevices(globals, cmd.outputFlags, func() error {
+		rescan := PATH_SYS_BUS_PCI_RESCAN
+		if cmd.Bridge != "" {
+			rescan = filepath.Join(PATH_SYS_BUS_PCI_DEVICES, cmd.Bridge, "rescan")
+		}
+		log.Info().Msgf("Rescanning via %q", rescan)
+		return writeSysfsFileTimeout(rescan, "1", sysfsSlowWriteTimeout)
+	})
+}
+
+// recoverDevices runs the recovery action between two discoveries and reports what changed
+func recoverDevices(globals *Globals, flags outputFlags, action func() error) error {
+	log := globals.config.Logger()
+
+	before, err := ParsePciDevices()
+	if err != nil {
+		log.Warn().Err(err).Msg("Some devices could not be parsed before the recovery")
+	}
+	actionErr := action()
+	after, err := ParsePciDevices()
+	if err != nil {
+		log.Warn().Err(err).Msg("Some devices could not be parsed after the recovery")
+	}
+
+	if err := printDeviceChanges(globals, diffDevices(before, after), flags); err != nil {
+		return err
+	}
+	return actionErr
+}
+
+// diffDevices compares two discoveries by bus address
+func diffDevices(before, after []PciDevice) []DeviceChange {
+	changes := []DeviceChange{}
+	afterByBus := make(map[string]PciDevice, len(after))
+	for _, dev := range after {
+		afterByBus[dev.Bus] = dev
+	}
+	beforeByBus := make(map[string]PciDevice, len(before))
+	for _, dev := range before {
+		beforeByBus[dev.Bus] = dev
+		a, ok := afterByBus[dev.Bus]
+		switch {
+		case !ok:
+			changes = append(changes, DeviceChange{Bus: dev.Bus, Change: DeviceChangeRemoved, Before: dev.KernelDriver})
+		case a.KernelDriver != dev.KernelDriver:
+			changes = append(changes, DeviceChange{Bus: dev.Bus, Change: DeviceChangeDriver, Before: dev.KernelDriver, After: a.KernelDriver})
+		}
+	}
+	for _, dev := range after {
+		if _, ok := beforeByBus[dev.Bus]; !ok {
+			changes = append(changes, DeviceChange{Bus: dev.Bus, Change: DeviceChangeAdded, After: dev.KernelDriver})
+		}
+	}
+	slices.SortFunc(changes, func(a, b DeviceChange) int {
+		return NaturalCompare(a.Bus, b.Bus)
+	})
+	return changes
+}
+
+// printDeviceChanges prints the device changes as a table or in the requested output format
+func printDeviceChanges(globals *Globals, changes []DeviceChange, flags outputFlags) error {
+	if len(flags.OutputFormat) > 0 {
+		out, err := yqOutput(globals, changes, flags.YQ, flags.OutputFormat)
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(out))
+		return nil
+	}
+
+	if len(changes) == 0 {
+		fmt.Println("No device changes")
+		return nil
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "DEVICE\tCHANGE\tDRIVER BEFORE\tDRIVER AFTER")
+	for _, c := range changes {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", c.Bus, c.Change, c.Before, c.After)
+	}
+	return w.Flush()
+}
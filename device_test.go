@@ -0,0 +1,64 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// TestDiffDevices tests the comparison of two discoveries
+func TestDiffDevices(t *testing.T) {
+	before := []PciDevice{
+		{Bus: "0000:01:00.0", KernelDriver: "nvidia"},
+		{Bus: "0000:01:00.1", KernelDriver: "snd_hda_intel"},
+		{Bus: "0000:02:00.0", KernelDriver: "nvme"},
+	}
+	after := []PciDevice{
+		{Bus: "0000:01:00.0", KernelDriver: "vfio-pci"},
+		{Bus: "0000:02:00.0", KernelDriver: "nvme"},
+		{Bus: "0000:10:00.0", KernelDriver: ""},
+	}
+	expected := []DeviceChange{
+		{Bus: "0000:01:00.0", Change: DeviceChangeDriver, Before: "nvidia", After: "vfio-pci"},
+		{Bus: "0000:01:00.1", Change: DeviceChangeRemoved, Before: "snd_hda_intel"},
+		{Bus: "0000:10:00.0", Change: DeviceChangeAdded},
+	}
+
+	actual := diffDevices(before, after)
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("diffDevices() got = %+v, expected %+v", actual, expected)
+	}
+	if changes := diffDevices(before, before); len(changes) != 0 {
+		t.Errorf("diffDevices() of identical discoveries got = %+v, expected none", changes)
+	}
+}
+
+// TestCheckHostDriver tests that devices bound to host drivers are only reset or removed when forced
+func TestCheckHostDriver(t *testing.T) {
+	const dev = "0000:01:00.0"
+	testCases := []struct {
+		name   string
+		driver string
+		force  bool
+		refuse bool
+	}{
+		{"HostDriver", "nvme", false, true},
+		{"HostDriverForced", "nvme", true, false},
+		{"Vfio", "vfio-pci", false, false},
+		{"Unbound", "", false, false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			root := t.TempDir()
+			writeTestBindSysfs(t, root, dev, tc.driver)
+			err := checkHostDriver(filepath.Join(root, PATH_SYS_BUS_PCI_DEVICES), dev, "reset", tc.force)
+			if (err != nil) != tc.refuse {
+				t.Errorf("checkHostDriver() error = %v, expected a refusal %v", err, tc.refuse)
+			}
+			if err != nil && !strings.Contains(err.Error(), "--force to reset") {
+				t.Errorf("checkHostDriver() error = %v, expected to name --force", err)
+			}
+		})
+	}
+}
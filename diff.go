@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/rs/zerolog"
+)
+
+const (
+	DeviceChangeRenumbered = "renumbered"
+	DeviceChangeIommuGroup = "iommu-group"
+
+	// InventoryLive is the inventory of the devices of this host
+	InventoryLive = "live"
+)
+
+type _diff struct {
+	Before      string `arg:"" help:"Inventory to compare from: '${inventory_live}', a tarball of 'snapshot' or a JSON export of 'list -o json'"`
+	After       string `arg:"" optional:"" default:"${inventory_live}" help:"Inventory to compare to, like the first one. Default: ${default}"`
+	ExitCode    bool   `help:"Exit with code 1 when the inventories differ"`
+	outputFlags `embed:""`
+}
+
+type DiffCmd struct {
+	Diff _diff `cmd:"" help:"Compare two inventories of PCI devices, each live, a snapshot or a list JSON export"`
+}
+
+// InventoryChange is a difference of a device between two inventories
+type InventoryChange struct {
+	// Bus is the bus address in the second inventory, or in the first one for removed devices
+	Bus    string
+	Change string
+	Before string
+	After  string
+	// Identity is vendor:device subvendor:subdevice, followed by the serial number if any
+	Identity string
+	Name     string
+}
+
+// deviceIdentity returns how a device is shown across inventories: its model, followed by its serial number if any
+func deviceIdentity(dev PciDevice) string {
+	identity := deviceModel(dev)
+	if dev.SerialNumber != "" {
+		identity += " " + dev.SerialNumber
+	}
+	return identity
+}
+
+// deviceModel returns what devices are matched by across inventories, whatever their bus address
+func deviceModel(dev PciDevice) string {
+	return fmt.Sprintf("%s:%s %s:%s", dev.VendorID, dev.DeviceID, dev.SubsysVendor, dev.SubsysDevice)
+}
+
+// matchInventories pairs the devices of the same model, by index in before and in after.
+// Identical devices are told apart by serial number when both inventories have it, then paired
+// at the same bus address, then in bus order
+func matchInventories(before, after []PciDevice) map[int]int {
+	byModel := func(devices []PciDevice) map[string][]int {
+		indexes := map[string][]int{}
+		for i, dev := range devices {
+			indexes[deviceModel(dev)] = append(indexes[deviceModel(dev)], i)
+		}
+		for _, list := range indexes {
+			slices.SortFunc(list, func(a, b int) int { return NaturalCompare(devices[a].Bus, devices[b].Bus) })
+		}
+		return indexes
+	}
+	afterByModel := byModel(after)
+	pairs := map[int]int{}
+	for model, beforeIndexes := range byModel(before) {
+		afterIndexes := afterByModel[model]
+		// pair removes the devices of before paired by same with one of after
+		pair := func(same func(b, a PciDevice) bool) {
+			remaining := []int{}
+			for _, b := range beforeIndexes {
+				if i := slices.IndexFunc(afterIndexes, func(a int) bool { return same(before[b], after[a]) }); i >= 0 {
+					pairs[b] = afterIndexes[i]
+					afterIndexes = slices.Delete(slices.Clone(afterIndexes), i, i+1)
+					continue
+				}
+				remaining = append(remaining, b)
+			}
+			beforeIndexes = remaining
+		}
+		pair(func(b, a PciDevice) bool { return b.SerialNumber != "" && b.SerialNumber == a.SerialNumber })
+		pair(func(b, a PciDevice) bool { return b.Bus == a.Bus })
+		for i, b := range beforeIndexes {
+			if i < len(afterIndexes) {
+				pairs[b] = afterIndexes[i]
+			}
+		}
+	}
+	return pairs
+}
+
+// groupMembers returns the bus addresses of the devices in the IOMMU group of devices[i], itself included
+func groupMembers(devices []PciDevice, i int) []string {
+	members := []string{}
+	if devices[i].IommuGroup == "" {
+		return members
+	}
+	for _, dev := range devices {
+		if dev.IommuGroup == devices[i].IommuGroup {
+			members = append(members, dev.Bus)
+		}
+	}
+	slices.SortFunc(members, NaturalCompare)
+	return members
+}
+
+// groupLabel describes an IOMMU group and its members, none without IOMMU group
+func groupLabel(group string, members []string) string {
+	if group == "" {
+		return "none"
+	}
+	return fmt.Sprintf("%s (%s)", group, strings.Join(members, ", "))
+}
+
+// diffInventories compares two inventories, matching devices by model: added, removed and renumbered devices,
+// changed drivers, and changed IOMMU groups, by number or by the devices they hold
+func diffInventories(before, after []PciDevice) []InventoryChange {
+	pairs := matchInventories(before, after)
+	matched := make(map[int]bool, len(pairs))
+	afterBus := map[string]string{}
+	for b, a := range pairs {
+		matched[a] = true
+		afterBus[before[b].Bus] = after[a].Bus
+	}
+	change := func(dev PciDevice, kind, beforeValue, afterValue string) InventoryChange {
+		return InventoryChange{
+			Bus:      dev.Bus,
+			Change:   kind,
+			Before:   beforeValue,
+			After:    afterValue,
+			Identity: deviceIdentity(dev),
+			Name:     strings.TrimSpace(dev.VendorName + " " + dev.DeviceName),
+		}
+	}
+
+	changes := []InventoryChange{}
+	for b, dev := range before {
+		a, ok := pairs[b]
+		if !ok {
+			changes = append(changes, change(dev, DeviceChangeRemoved, dev.KernelDriver, ""))
+			continue
+		}
+		next := after[a]
+		if next.Bus != dev.Bus {
+			changes = append(changes, change(next, DeviceChangeRenumbered, dev.Bus, next.Bus))
+		}
+		if next.KernelDriver != dev.KernelDriver {
+			changes = append(changes, change(next, DeviceChangeDriver, dev.KernelDriver, next.KernelDriver))
+		}
+		// Members are compared at their bus address in after, removed ones keeping theirs
+		beforeMembers := groupMembers(before, b)
+		translated := make([]string, 0, len(beforeMembers))
+		for _, bus := range beforeMembers {
+			translated = append(translated, cmp.Or(afterBus[bus], "removed "+bus))
+		}
+		slices.SortFunc(translated, NaturalCompare)
+		afterMembers := groupMembers(after, a)
+		if next.IommuGroup != dev.IommuGroup || !slices.Equal(translated, afterMembers) {
+			changes = append(changes, change(next, DeviceChangeIommuGroup, groupLabel(dev.IommuGroup, beforeMembers), groupLabel(next.IommuGroup, afterMembers)))
+		}
+	}
+	for a, dev := range after {
+		if !matched[a] {
+			changes = append(changes, change(dev, DeviceChangeAdded, "", dev.KernelDriver))
+		}
+	}
+
+	changeOrder := []string{DeviceChangeRemoved, DeviceChangeAdded, DeviceChangeRenumbered, DeviceChangeDriver, DeviceChangeIommuGroup}
+	slices.SortStableFunc(changes, func(a, b InventoryChange) int {
+		return cmp.Or(NaturalCompare(a.Bus, b.Bus), cmp.Compare(slices.Index(changeOrder, a.Change), slices.Index(changeOrder, b.Change)))
+	})
+	return changes
+}
+
+// parseListJSON parses the devices of list -o json, its versioned document or, with --compat,
+// grouped by IOMMU group or a flat list
+func parseListJSON(content []byte) ([]PciDevice, error) {
+	if devices, ok, err := parseInventory(content); ok {
+		return devices, err
+	}
+	groups := map[string][]PciDevice{}
+	if err := json.Unmarshal(content, &groups); err == nil {
+		devices := []PciDevice{}
+		for _, group := range groups {
+			devices = append(devices, group...)
+		}
+		slices.SortFunc(devices, func(a, b PciDevice) int { return NaturalCompare(a.Bus, b.Bus) })
+		return devices, nil
+	}
+	devices := []PciDevice{}
+	if err := json.Unmarshal(content, &devices); err != nil {
+		return nil, fmt.Errorf("neither the document nor the grouped or flat JSON of list: %w", err)
+	}
+	return devices, nil
+}
+
+// loadInventory reads the devices of this host, of a snapshot or of a JSON export of list
+func loadInventory(source string, log *zerolog.Logger) ([]PciDevice, error) {
+	if source == InventoryLive {
+		devices, err := ParsePciDevices()
+		if err != nil && len(devices) == 0 {
+			return nil, err
+		}
+		if err != nil {
+			log.Warn().Err(err).Msg("Some devices could not be read")
+		}
+		return devices, nil
+	}
+
+	content, err := os.ReadFile(source)
+	if err != nil {
+		return nil, err
+	}
+	// Snapshots are gzipped tarballs
+	if !bytes.HasPrefix(content, []byte{0x1f, 0x8b}) {
+		devices, err := parseListJSON(content)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", source, err)
+		}
+		return devices, nil
+	}
+	snapshot := snapshotFlags{FromSnapshot: source}
+	root, cleanup, err := snapshot.root(log)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+	devices, err := parsePciDevices(root)
+	if err != nil {
+		log.Warn().Err(err).Msgf("Some devices of %s could not be read", source)
+	}
+	return devices, nil
+}
+
+// Run executes the command
+func (cmd *_diff) Run(globals *Globals) error {
+	log := globals.config.Logger()
+
+	before, err := loadInventory(cmd.Before, log)
+	if err != nil {
+		return err
+	}
+	after, err := loadInventory(cmd.After, log)
+	if err != nil {
+		return err
+	}
+	changes := diffInventories(before, after)
+
+	if len(cmd.OutputFormat) > 0 {
+		out, err := yqOutput(globals, changes, cmd.YQ, cmd.OutputFormat)
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(out))
+	} else if len(changes) == 0 {
+		fmt.Println("No device changes")
+	} else {
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "DEVICE\tCHANGE\tBEFORE\tAFTER\tNAME")
+		for _, c := range changes {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", c.Bus, c.Change, c.Before, c.After, c.Name)
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+	}
+
+	if cmd.ExitCode && len(changes) > 0 {
+		return &ExitCodeError{Code: ExitCodeDifferences}
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// TestDiffInventories tests matching by identity across renumbered buses and shifted IOMMU groups
+func TestDiffInventories(t *testing.T) {
+	gpu := PciDevice{VendorID: "10de", DeviceID: "2882", SubsysVendor: "1458", SubsysDevice: "4116", VendorName: "NVIDIA Corporation", DeviceName: "AD107 [GeForce RTX 4060]"}
+	audio := PciDevice{VendorID: "10de", DeviceID: "22be", SubsysVendor: "1458", SubsysDevice: "4116"}
+	nvme := PciDevice{VendorID: "144d", DeviceID: "a80c", SubsysVendor: "144d", SubsysDevice: "a801"}
+	at := func(dev PciDevice, bus, group, driver string) PciDevice {
+		dev.Bus, dev.IommuGroup, dev.KernelDriver = bus, group, driver
+		return dev
+	}
+	// Two identical NVMe drives, one staying at its address, and a NIC removed after a BIOS update
+	before := []PciDevice{
+		at(gpu, "0000:01:00.0", "12", "nvidia"),
+		at(audio, "0000:01:00.1", "12", "snd_hda_intel"),
+		at(nvme, "0000:02:00.0", "13", "nvme"),
+		at(nvme, "0000:03:00.0", "14", "nvme"),
+		at(PciDevice{VendorID: "8086", DeviceID: "125c"}, "0000:04:00.0", "15", "igc"),
+	}
+	after := []PciDevice{
+		at(gpu, "0000:02:00.0", "14", "vfio-pci"),
+		at(audio, "0000:02:00.1", "14", "snd_hda_intel"),
+		at(nvme, "0000:03:00.0", "14", "nvme"),
+		at(nvme, "0000:05:00.0", "16", "nvme"),
+		at(PciDevice{VendorID: "1022", DeviceID: "43f4"}, "0000:06:00.0", "", ""),
+	}
+	expected := []InventoryChange{
+		{Bus: "0000:02:00.0", Change: DeviceChangeRenumbered, Before: "0000:01:00.0", After: "0000:02:00.0", Identity: "10de:2882 1458:4116", Name: "NVIDIA Corporation AD107 [GeForce RTX 4060]"},
+		{Bus: "0000:02:00.0", Change: DeviceChangeDriver, Before: "nvidia", After: "vfio-pci", Identity: "10de:2882 1458:4116", Name: "NVIDIA Corporation AD107 [GeForce RTX 4060]"},
+		{Bus: "0000:02:00.0", Change: DeviceChangeIommuGroup, Before: "12 (0000:01:00.0, 0000:01:00.1)", After: "14 (0000:02:00.0, 0000:02:00.1, 0000:03:00.0)", Identity: "10de:2882 1458:4116", Name: "NVIDIA Corporation AD107 [GeForce RTX 4060]"},
+		{Bus: "0000:02:00.1", Change: DeviceChangeRenumbered, Before: "0000:01:00.1", After: "0000:02:00.1", Identity: "10de:22be 1458:4116"},
+		{Bus: "0000:02:00.1", Change: DeviceChangeIommuGroup, Before: "12 (0000:01:00.0, 0000:01:00.1)", After: "14 (0000:02:00.0, 0000:02:00.1, 0000:03:00.0)", Identity: "10de:22be 1458:4116"},
+		{Bus: "0000:03:00.0", Change: DeviceChangeIommuGroup, Before: "14 (0000:03:00.0)", After: "14 (0000:02:00.0, 0000:02:00.1, 0000:03:00.0)", Identity: "144d:a80c 144d:a801"},
+		{Bus: "0000:04:00.0", Change: DeviceChangeRemoved, Before: "igc", Identity: "8086:125c :"},
+		{Bus: "0000:05:00.0", Change: DeviceChangeRenumbered, Before: "0000:02:00.0", After: "0000:05:00.0", Identity: "144d:a80c 144d:a801"},
+		{Bus: "0000:05:00.0", Change: DeviceChangeIommuGroup, Before: "13 (0000:02:00.0)", After: "16 (0000:05:00.0)", Identity: "144d:a80c 144d:a801"},
+		{Bus: "0000:06:00.0", Change: DeviceChangeAdded, Identity: "1022:43f4 :"},
+	}
+
+	actual := diffInventories(before, after)
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("diffInventories() got:\n%+v\nexpected:\n%+v", actual, expected)
+	}
+	if changes := diffInventories(before, before); len(changes) != 0 {
+		t.Errorf("diffInventories() of identical inventories got = %+v, expected none", changes)
+	}
+}
+
+// TestDiffInventoriesSerialNumber tests that serial numbers only tell identical devices apart
+func TestDiffInventoriesSerialNumber(t *testing.T) {
+	nvme := func(bus, serial string) PciDevice {
+		return PciDevice{Bus: bus, VendorID: "144d", DeviceID: "a80c", SubsysVendor: "144d", SubsysDevice: "a801", KernelDriver: "nvme", SerialNumber: serial}
+	}
+	// An inventory read without root, then one read as root
+	before := []PciDevice{nvme("0000:02:00.0", ""), nvme("0000:03:00.0", "")}
+	after := []PciDevice{nvme("0000:02:00.0", "00-11-22-33-44-55-66-77"), nvme("0000:03:00.0", "88-99-aa-bb-cc-dd-ee-ff")}
+	if changes := diffInventories(before, after); len(changes) != 0 {
+		t.Errorf("diffInventories() with serial numbers only after got = %+v, expected none", changes)
+	}
+	if changes := diffInventories(after, before); len(changes) != 0 {
+		t.Errorf("diffInventories() with serial numbers only before got = %+v, expected none", changes)
+	}
+
+	// The drives swapped slots
+	swapped := []PciDevice{nvme("0000:02:00.0", "88-99-aa-bb-cc-dd-ee-ff"), nvme("0000:03:00.0", "00-11-22-33-44-55-66-77")}
+	expected := []InventoryChange{
+		{Bus: "0000:02:00.0", Change: DeviceChangeRenumbered, Before: "0000:03:00.0", After: "0000:02:00.0", Identity: "144d:a80c 144d:a801 88-99-aa-bb-cc-dd-ee-ff"},
+		{Bus: "0000:03:00.0", Change: DeviceChangeRenumbered, Before: "0000:02:00.0", After: "0000:03:00.0", Identity: "144d:a80c 144d:a801 00-11-22-33-44-55-66-77"},
+	}
+	if actual := diffInventories(after, swapped); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("diffInventories() of swapped drives got:\n%+v\nexpected:\n%+v", actual, expected)
+	}
+}
+
+// TestDeviceSerialNumber tests reading the serial number capability after another extended capability
+func TestDeviceSerialNumber(t *testing.T) {
+	config := make([]byte, 0x200)
+	// AER at 0x100, linking to the serial number at 0x140
+	copy(config[0x100:], []byte{0x01, 0x00, 0x02, 0x14})
+	copy(config[0x140:], []byte{0x03, 0x00, 0x01, 0x00, 0x08, 0x07, 0x06, 0x05, 0x04, 0x03, 0x02, 0x01})
+	if serial := deviceSerialNumber(config); serial != "01-02-03-04-05-06-07-08" {
+		t.Errorf("deviceSerialNumber() got = %q", serial)
+	}
+	if serial := deviceSerialNumber(config[:64]); serial != "" {
+		t.Errorf("deviceSerialNumber() of an unprivileged read got = %q, expected none", serial)
+	}
+}
+
+// TestParseListJSON tests reading the grouped and the flat JSON of list
+func TestParseListJSON(t *testing.T) {
+	for _, content := range []string{
+		`{"2": [{"Bus": "0000:02:00.0"}], "1": [{"Bus": "0000:01:00.0"}, {"Bus": "0000:01:00.1"}]}`,
+		`[{"Bus": "0000:01:00.0"}, {"Bus": "0000:01:00.1"}, {"Bus": "0000:02:00.0"}]`,
+	} {
+		devices, err := parseListJSON([]byte(content))
+		if err != nil || len(devices) != 3 || devices[0].Bus != "0000:01:00.0" || devices[2].Bus != "0000:02:00.0" {
+			t.Errorf("parseListJSON(%s) got = %+v, %v", content, devices, err)
+		}
+	}
+	if _, err := parseListJSON([]byte(`"devices"`)); err == nil {
+		t.Errorf("parseListJSON() expected an error")
+	}
+}
@@ -0,0 +1,28 @@
+package main
+
+import "fmt"
+
+const (
+	// ExitCodeDifferences is returned by diff --exit-code when the inventories differ
+	ExitCodeDifferences    = 1
+	ExitCodeTotalFailure   = 2
+	ExitCodePartialFailure = 3
+	ExitCodeNoop           = 4
+)
+
+// ExitCodeError is returned by commands that need a specific process exit code
+type ExitCodeError struct {
+	Code int
+	Err  error
+}
+
+func (e *ExitCodeError) Error() string {
+	if e.Err == nil {
+		return fmt.Sprintf("exit code %d", e.Code)
+	}
+	return e.Err.Error()
+}
+
+func (e *ExitCodeError) Unwrap() error {
+	return e.Err
+}
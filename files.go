@@ -58,6 +58,11 @@ func writeSysfsFile(file, data string) error {
 
 // Write to sysfs file with timeout
 func writeSysfsFileWithTimeout(file, data string) error {
+	return writeSysfsFileTimeout(file, data, 2*time.Second)
+}
+
+// Write to sysfs file with a custom timeout, for slow operations like resets
+func writeSysfsFileTimeout(file, data string, timeout time.Duration) error {
 	done := make(chan error, 1)
 	go func() {
 		done <- writeSysfsFile(file, data)
@@ -66,7 +71,43 @@ func writeSysfsFileWithTimeout(file, data string) error {
 	select {
 	case err := <-done:
 		return err
-	case <-time.After(2 * time.Second):
+	case <-time.After(timeout):
 		return fmt.Errorf("timeout writing to %q", file)
 	}
 }
+
+// writeFileAtomic writes data to a temporary file next to the target and renames it over the target.
+// The mode of an existing target is kept
+func writeFileAtomic(file string, data []byte, perm fs.FileMode) error {
+	if fstat, err := os.Stat(file); err == nil {
+		perm = fstat.Mode().Perm()
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(file), "."+filepath.Base(file)+".*")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write temporary file: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to sync temporary file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to close temporary file: %w", err)
+	}
+	if err := os.Chmod(tmp.Name(), perm); err != nil {
+		return fmt.Errorf("failed to set file mode: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), file); err != nil {
+		return fmt.Errorf("failed to rename temporary file: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+)
+
+// classPrefixBridge is the class of PCI bridges, which do not break the isolation of an IOMMU group
+const classPrefixBridge = "0604"
+
+// listFilters select devices. Values of a flag are alternatives, flags must all match
+type listFilters struct {
+	Class    []string `help:"Comma separated list of classes, as code (e.g. 03, 0300) or name (e.g. VGA, Display controller)" placeholder:"class"`
+	Vendor   []string `help:"Comma separated list of vendors, as ID (e.g. 10de) or name (e.g. NVIDIA)" placeholder:"vendor"`
+	Driver   []string `help:"Comma separated list of drivers in use or able to drive the device, as lspci -k Kernel modules. '${driver_none}' for unbound devices" placeholder:"driver"`
+	Group    []string `help:"Comma separated list of IOMMU groups" placeholder:"group"`
+	Bus      []string `help:"Comma separated list of bus address globs. The 0000: domain can be omitted. Example: 01:00.*" placeholder:"bus-glob"`
+	BoundTo  []string `help:"Comma separated list of drivers in use. '${driver_none}' for unbound devices" placeholder:"driver"`
+	Isolated bool     `help:"Only devices whose IOMMU group holds no other device than the functions of their slot, besides PCI bridges"`
+}
+
+// isHex reports whether s is a hex number of the given length, with an optional 0x prefix
+func isHex(s string, lengths ...int) bool {
+	s = strings.TrimPrefix(strings.ToLower(s), "0x")
+	return slices.Contains(lengths, len(s)) && strings.Trim(s, "0123456789abcdef") == ""
+}
+
+// containsFold reports whether substr is in s, ignoring case
+func containsFold(s, substr string) bool {
+	return strings.Contains(strings.ToLower(s), strings.ToLower(substr))
+}
+
+// matchClass matches the class code prefix, or the class or subclass names
+func matchClass(db *pciIdsDatabase, dev PciDevice, class string) bool {
+	if isHex(class, 2, 4, 6) {
+		return strings.HasPrefix(dev.Class+dev.ProgIf, strings.TrimPrefix(strings.ToLower(class), "0x"))
+	}
+	if containsFold(dev.DeviceClass, class) {
+		return true
+	}
+	return db != nil && len(dev.Class) >= 2 && containsFold(db.Names("", "", dev.Class[:2], "", "").Class, class)
+}
+
+// matchVendor matches the vendor id or name
+func matchVendor(dev PciDevice, vendor string) bool {
+	if isHex(vendor, 4) {
+		return strings.TrimPrefix(strings.ToLower(vendor), "0x") == dev.VendorID
+	}
+	return containsFold(dev.VendorName, vendor)
+}
+
+// matchBus matches the bus address against a glob, with or without the domain
+func matchBus(dev PciDevice, glob string) (bool, error) {
+	if _, err := path.Match(glob, ""); err != nil {
+		return false, fmt.Errorf("invalid bus glob %q: %w", glob, err)
+	}
+	matched, _ := path.Match(glob, dev.Bus)
+	if !matched {
+		_, short, _ := strings.Cut(dev.Bus, ":")
+		matched, _ = path.Match(glob, short)
+	}
+	return matched, nil
+}
+
+// matchDriverInUse matches the driver in use, DriverNone matching unbound devices
+func matchDriverInUse(dev PciDevice, driver string) bool {
+	if driver == DriverNone {
+		return dev.KernelDriver == ""
+	}
+	return normalizeModuleName(driver) == normalizeModuleName(dev.KernelDriver)
+}
+
+// isolatedGroups returns the IOMMU groups whose devices, besides bridges, are all functions of one slot
+func isolatedGroups(devices []PciDevice) map[string]bool {
+	slots := map[string][]string{}
+	for _, dev := range devices {
+		if dev.IommuGroup == "" || strings.HasPrefix(dev.Class, classPrefixBridge) {
+			continue
+		}
+		slot, _, _ := strings.Cut(dev.Bus, ".")
+		if !slices.Contains(slots[dev.IommuGroup], slot) {
+			slots[dev.IommuGroup] = append(slots[dev.IommuGroup], slot)
+		}
+	}
+	isolated := map[string]bool{}
+	for group, s := range slots {
+		isolated[group] = len(s) == 1
+	}
+	return isolated
+}
+
+// filter returns the devices matching all filters
+func (f *listFilters) filter(db *pciIdsDatabase, devices []PciDevice) ([]PciDevice, error) {
+	isolated := isolatedGroups(devices)
+	filtered := []PciDevice{}
+	for _, dev := range devices {
+		matches := []bool{
+			len(f.Class) == 0 || slices.ContainsFunc(f.Class, func(c string) bool { return matchClass(db, dev, c) }),
+			len(f.Vendor) == 0 || slices.ContainsFunc(f.Vendor, func(v string) bool { return matchVendor(dev, v) }),
+			len(f.Driver) == 0 || slices.ContainsFunc(f.Driver, func(d string) bool {
+				return matchDriverInUse(dev, d) || slices.ContainsFunc(dev.KernelModules, func(m KernelModule) bool {
+					return normalizeModuleName(m.Name) == normalizeModuleName(d)
+				})
+			}),
+			len(f.Group) == 0 || slices.Contains(f.Group, dev.IommuGroup),
+			len(f.BoundTo) == 0 || slices.ContainsFunc(f.BoundTo, func(d string) bool { return matchDriverInUse(dev, d) }),
+			!f.Isolated || isolated[dev.IommuGroup],
+		}
+		if len(f.Bus) > 0 {
+			busMatched := false
+			for _, glob := range f.Bus {
+				matched, err := matchBus(dev, glob)
+				if err != nil {
+					return nil, err
+				}
+				busMatched = busMatched || matched
+			}
+			matches = append(matches, busMatched)
+		}
+		if !slices.Contains(matches, false) {
+			filtered = append(filtered, dev)
+		}
+	}
+	return filtered, nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// TestListFilters tests each filter and their combination
+func TestListFilters(t *testing.T) {
+	db, err := parsePciIds(strings.NewReader(testPciIds))
+	if err != nil {
+		t.Fatalf("parsePciIds() error = %v", err)
+	}
+	devices := []PciDevice{
+		{Bus: "0000:00:01.1", VendorID: "1022", VendorName: "Advanced Micro Devices, Inc. [AMD]", Class: "0604", DeviceClass: "PCI bridge", KernelDriver: "pcieport", IommuGroup: "2"},
+		{Bus: "0000:01:00.0", VendorID: "10de", VendorName: "NVIDIA Corporation", Class: "0300", ProgIf: "00", DeviceClass: "VGA compatible controller", KernelDriver: "vfio-pci", IommuGroup: "2",
+			KernelModules: []KernelModule{{Name: "nouveau"}, {Name: "nvidia"}}},
+		{Bus: "0000:01:00.1", VendorID: "10de", VendorName: "NVIDIA Corporation", Class: "0403", DeviceClass: "Audio device", KernelDriver: "snd_hda_intel", IommuGroup: "2",
+			KernelModules: []KernelModule{{Name: "snd_hda_intel"}}},
+		{Bus: "0000:0c:00.0", VendorID: "1002", VendorName: "Advanced Micro Devices, Inc. [AMD/ATI]", Class: "0300", DeviceClass: "VGA compatible controller", KernelDriver: "amdgpu", IommuGroup: "15"},
+		{Bus: "0000:0d:00.0", VendorID: "1002", VendorName: "Advanced Micro Devices, Inc. [AMD/ATI]", Class: "0400", DeviceClass: "Multimedia video controller", IommuGroup: "15"},
+	}
+	busOf := func(devices []PciDevice) []string {
+		buses := []string{}
+		for _, dev := range devices {
+			buses = append(buses, dev.Bus)
+		}
+		return buses
+	}
+
+	testCases := []struct {
+		name     string
+		filters  listFilters
+		expected []string
+	}{
+		{"None", listFilters{}, []string{"0000:00:01.1", "0000:01:00.0", "0000:01:00.1", "0000:0c:00.0", "0000:0d:00.0"}},
+		{"ClassCode", listFilters{Class: []string{"0x03"}}, []string{"0000:01:00.0", "0000:0c:00.0"}},
+		{"ClassProgIf", listFilters{Class: []string{"030000"}}, []string{"0000:01:00.0"}},
+		{"ClassName", listFilters{Class: []string{"display controller", "audio"}}, []string{"0000:01:00.0", "0000:01:00.1", "0000:0c:00.0"}},
+		{"VendorIdOrName", listFilters{Vendor: []string{"10DE", "ATI"}}, []string{"0000:01:00.0", "0000:01:00.1", "0000:0c:00.0", "0000:0d:00.0"}},
+		{"DriverCapable", listFilters{Driver: []string{"nvidia", "snd-hda-intel"}}, []string{"0000:01:00.0", "0000:01:00.1"}},
+		{"BoundTo", listFilters{BoundTo: []string{"vfio-pci", DriverNone}}, []string{"0000:01:00.0", "0000:0d:00.0"}},
+		{"Group", listFilters{Group: []string{"15"}}, []string{"0000:0c:00.0", "0000:0d:00.0"}},
+		{"BusGlob", listFilters{Bus: []string{"01:00.*", "0000:0d:*"}}, []string{"0000:01:00.0", "0000:01:00.1", "0000:0d:00.0"}},
+		{"Isolated", listFilters{Isolated: true}, []string{"0000:00:01.1", "0000:01:00.0", "0000:01:00.1"}},
+		{"Combined", listFilters{Class: []string{"03"}, Isolated: true}, []string{"0000:01:00.0"}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			filtered, err := tc.filters.filter(db, devices)
+			if err != nil {
+				t.Fatalf("filter() error = %v", err)
+			}
+			if actual := busOf(filtered); !reflect.DeepEqual(actual, tc.expected) {
+				t.Errorf("filter() got = %v, expected %v", actual, tc.expected)
+			}
+		})
+	}
+
+	if _, err := (&listFilters{Bus: []string{"["}}).filter(db, devices); err == nil {
+		t.Errorf("filter() expected an error for an invalid glob")
+	}
+}
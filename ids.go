@@ -0,0 +1,186 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"text/tabwriter"
+)
+
+const (
+	IdTypeVendor    = "vendor"
+	IdTypeDevice    = "device"
+	IdTypeSubsystem = "subsystem"
+	IdTypeClass     = "class"
+)
+
+type _idsSearch struct {
+	Pattern       string   `arg:"" help:"Case insensitive text to look for in names, or a regular expression with --regex"`
+	Regex         bool     `short:"r" help:"Treat the pattern as a regular expression"`
+	Type          []string `short:"t" help:"Comma separated list of entry types to search. One of: ${enum}" enum:"vendor,device,subsystem,class" default:"vendor,device,subsystem,class"`
+	Present       bool     `short:"p" help:"Mark the entries present on this host"`
+	outputFlags   `embed:""`
+	snapshotFlags `embed:""`
+}
+
+type _ids struct {
+	Search _idsSearch `cmd:"" help:"Search the pci.ids database by vendor, device, subsystem or class name"`
+}
+
+type IdsCmd struct {
+	Ids _ids `cmd:"" help:"Query the pci.ids database"`
+}
+
+// IdMatch is a pci.ids entry matching a search
+type IdMatch struct {
+	Type string
+	// ID is vendor, vendor:device or class[subclass[prog-if]]
+	ID string
+	// Subsystem is subvendor:subdevice for subsystem entries
+	Subsystem string
+	Name      string
+	Present   bool
+}
+
+// searchPciIds returns the entries whose name matches, sorted by type and id
+func searchPciIds(db *pciIdsDatabase, types []string, match func(name string) bool) []IdMatch {
+	matches := []IdMatch{}
+	if slices.Contains(types, IdTypeVendor) {
+		for vendor, name := range db.vendors {
+			if match(name) {
+				matches = append(matches, IdMatch{Type: IdTypeVendor, ID: fmt.Sprintf("%04x", vendor), Name: name})
+			}
+		}
+	}
+	if slices.Contains(types, IdTypeDevice) {
+		for key, name := range db.devices {
+			if match(name) {
+				matches = append(matches, IdMatch{Type: IdTypeDevice, ID: fmt.Sprintf("%04x:%04x", key.Vendor, key.Device), Name: name})
+			}
+		}
+	}
+	if slices.Contains(types, IdTypeSubsystem) {
+		for key, name := range db.subsystems {
+			if match(name) {
+				matches = append(matches, IdMatch{
+					Type:      IdTypeSubsystem,
+					ID:        fmt.Sprintf("%04x:%04x", key.Vendor, key.Device),
+					Subsystem: fmt.Sprintf("%04x:%04x", key.SubVendor, key.SubDevice),
+					Name:      name,
+				})
+			}
+		}
+	}
+	if slices.Contains(types, IdTypeClass) {
+		for class, name := range db.classes {
+			if match(name) {
+				matches = append(matches, IdMatch{Type: IdTypeClass, ID: fmt.Sprintf("%02x", class), Name: name})
+			}
+		}
+		for key, name := range db.subclasses {
+			if match(name) {
+				matches = append(matches, IdMatch{Type: IdTypeClass, ID: fmt.Sprintf("%02x%02x", key.Class, key.Subclass), Name: name})
+			}
+		}
+		for key, name := range db.progIfs {
+			if match(name) {
+				matches = append(matches, IdMatch{Type: IdTypeClass, ID: fmt.Sprintf("%02x%02x%02x", key.Class, key.Subclass, key.ProgIf), Name: name})
+			}
+		}
+	}
+	typeOrder := []string{IdTypeVendor, IdTypeDevice, IdTypeSubsystem, IdTypeClass}
+	slices.SortFunc(matches, func(a, b IdMatch) int {
+		return cmp.Or(
+			cmp.Compare(slices.Index(typeOrder, a.Type), slices.Index(typeOrder, b.Type)),
+			cmp.Compare(a.ID, b.ID),
+			cmp.Compare(a.Subsystem, b.Subsystem),
+		)
+	})
+	return matches
+}
+
+// markPresent sets Present on the matches that describe one of the devices
+func markPresent(matches []IdMatch, devices []PciDevice) {
+	for i := range matches {
+		m := &matches[i]
+		m.Present = slices.ContainsFunc(devices, func(dev PciDevice) bool {
+			switch m.Type {
+			case IdTypeVendor:
+				return m.ID == dev.VendorID
+			case IdTypeDevice:
+				return m.ID == dev.VendorID+":"+dev.DeviceID
+			case IdTypeSubsystem:
+				return m.ID == dev.VendorID+":"+dev.DeviceID && m.Subsystem == dev.SubsysVendor+":"+dev.SubsysDevice
+			case IdTypeClass:
+				return strings.HasPrefix(dev.Class+dev.ProgIf, m.ID)
+			}
+			return false
+		})
+	}
+}
+
+// Run executes the command
+func (cmd *_idsSearch) Run(globals *Globals) error {
+	log := globals.config.Logger()
+
+	match := func(name string) bool {
+		return strings.Contains(strings.ToLower(name), strings.ToLower(cmd.Pattern))
+	}
+	if cmd.Regex {
+		re, err := regexp.Compile("(?i)" + cmd.Pattern)
+		if err != nil {
+			return fmt.Errorf("invalid regular expression: %w", err)
+		}
+		match = re.MatchString
+	}
+
+	root, cleanup, err := cmd.root(log)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	db, err := pciIdsAt(root)
+	if err != nil {
+		return err
+	}
+	matches := searchPciIds(db, cmd.Type, match)
+	if cmd.Present {
+		devices, err := parsePciDevices(root)
+		if err != nil {
+			log.Warn().Err(err).Msg("Some devices could not be read")
+		}
+		markPresent(matches, devices)
+	}
+
+	if len(cmd.OutputFormat) > 0 {
+		out, err := yqOutput(globals, matches, cmd.YQ, cmd.OutputFormat)
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(out))
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	header := "TYPE\tID\tSUBSYSTEM\tNAME"
+	if cmd.Present {
+		header += "\tPRESENT"
+	}
+	fmt.Fprintln(w, header)
+	for _, m := range matches {
+		line := fmt.Sprintf("%s\t%s\t%s\t%s", m.Type, m.ID, m.Subsystem, m.Name)
+		if cmd.Present {
+			present := ""
+			if m.Present {
+				present = "yes"
+			}
+			line += "\t" + present
+		}
+		fmt.Fprintln(w, line)
+	}
+	return w.Flush()
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// TestSearchPciIds tests searching every entry type and marking the present ones
+func TestSearchPciIds(t *testing.T) {
+	db, err := parsePciIds(strings.NewReader(testPciIds))
+	if err != nil {
+		t.Fatalf("parsePciIds() error = %v", err)
+	}
+	devices := []PciDevice{{VendorID: "10de", DeviceID: "2882", Class: "0300", ProgIf: "00", SubsysVendor: "1458", SubsysDevice: "4116"}}
+
+	testCases := []struct {
+		name     string
+		types    []string
+		pattern  string
+		expected []IdMatch
+	}{
+		{
+			"AllTypes",
+			[]string{IdTypeVendor, IdTypeDevice, IdTypeSubsystem, IdTypeClass},
+			"(?i)nvidia|4060|vga",
+			[]IdMatch{
+				{Type: IdTypeVendor, ID: "10de", Name: "NVIDIA Corporation", Present: true},
+				{Type: IdTypeDevice, ID: "10de:2882", Name: "AD107 [GeForce RTX 4060]", Present: true},
+				{Type: IdTypeSubsystem, ID: "10de:2882", Subsystem: "1458:4116", Name: "GV-N4060WF2OC-8GD", Present: true},
+				{Type: IdTypeClass, ID: "0300", Name: "VGA compatible controller", Present: true},
+				{Type: IdTypeClass, ID: "030000", Name: "VGA controller", Present: true},
+			},
+		},
+		{
+			"OnlyClasses",
+			[]string{IdTypeClass},
+			"controller$",
+			[]IdMatch{
+				{Type: IdTypeClass, ID: "03", Name: "Display controller", Present: true},
+				{Type: IdTypeClass, ID: "0300", Name: "VGA compatible controller", Present: true},
+				{Type: IdTypeClass, ID: "030000", Name: "VGA controller", Present: true},
+				{Type: IdTypeClass, ID: "030001", Name: "8514 controller"},
+				{Type: IdTypeClass, ID: "0302", Name: "3D controller"},
+				{Type: IdTypeClass, ID: "04", Name: "Multimedia controller"},
+			},
+		},
+		{
+			"NoMatch",
+			[]string{IdTypeVendor},
+			"Intel",
+			[]IdMatch{},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			matches := searchPciIds(db, tc.types, regexp.MustCompile(tc.pattern).MatchString)
+			markPresent(matches, devices)
+			if !reflect.DeepEqual(matches, tc.expected) {
+				t.Errorf("searchPciIds() got = %+v, expected %+v", matches, tc.expected)
+			}
+		})
+	}
+}
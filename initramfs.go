@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/rs/zerolog"
+)
+
+const (
+	PATH_MKINITCPIO_CONF         = "/etc/mkinitcpio.conf"
+	PATH_DRACUT_CONF_D           = "/etc/dracut.conf.d"
+	PATH_DRACUT_VFIO_CONF        = "/etc/dracut.conf.d/vfio.conf"
+	PATH_INITRAMFS_TOOLS_MODULES = "/etc/initramfs-tools/modules"
+
+	InitramfsMkinitcpio = "mkinitcpio"
+	InitramfsDracut     = "dracut"
+	InitramfsTools      = "initramfs-tools"
+)
+
+// vfioModules must be in the initramfs, ahead of host drivers, for vfio-pci to claim devices first
+var vfioModules = []string{"vfio_pci", "vfio", "vfio_iommu_type1"}
+
+var mkinitcpioModulesRegex = regexp.MustCompile(`^(\s*MODULES=\()([^)]*)(\).*)$`)
+
+// initramfsBackend persists ids in modprobe.d and adds the vfio modules to the initramfs module list
+type initramfsBackend struct {
+	modprobeBackend
+	name string
+	// addModules adds the missing modules to the module list of the initramfs generator
+	addModules func(modules []string) error
+	regenerate string
+}
+
+// newInitramfsBackend returns the backend of the initramfs generator with the given name
+func newInitramfsBackend(name, root string) (*initramfsBackend, error) {
+	b := &initramfsBackend{modprobeBackend: modprobeBackend{root: root}, name: name}
+	switch name {
+	case InitramfsMkinitcpio:
+		b.addModules = func(modules []string) error {
+			return addMkinitcpioModules(filepath.Join(root, PATH_MKINITCPIO_CONF), modules)
+		}
+		b.regenerate = "mkinitcpio -P"
+	case InitramfsDracut:
+		b.addModules = func(modules []string) error {
+			return writeFileAtomic(filepath.Join(root, PATH_DRACUT_VFIO_CONF),
+				[]byte(`force_drivers+=" `+strings.Join(modules, " ")+` "`+"\n"), 0644)
+		}
+		b.regenerate = "dracut -f --regenerate-all"
+	case InitramfsTools:
+		b.addModules = func(modules []string) error {
+			return addInitramfsToolsModules(filepath.Join(root, PATH_INITRAMFS_TOOLS_MODULES), modules)
+		}
+		b.regenerate = "update-initramfs -u -k all"
+	default:
+		return nil, fmt.Errorf("unsupported initramfs generator %q", name)
+	}
+	return b, nil
+}
+
+func (b *initramfsBackend) Name() string {
+	return b.name
+}
+
+func (b *initramfsBackend) Persist(log *zerolog.Logger, devices []persistedDevice) error {
+	if err := b.modprobeBackend.Persist(log, devices); err != nil {
+		return err
+	}
+	if err := b.addModules(vfioModules); err != nil {
+		return fmt.Errorf("failed to add vfio modules to the %s configuration: %w", b.name, err)
+	}
+	return nil
+}
+
+func (b *initramfsBackend) RegenerateCommand() string {
+	return b.regenerate
+}
+
+// addMkinitcpioModules prepends the missing modules to MODULES=() in mkinitcpio.conf
+func addMkinitcpioModules(conf string, modules []string) error {
+	content, err := os.ReadFile(conf)
+	if err != nil {
+		return err
+	}
+	lines := strings.Split(strings.TrimSuffix(string(content), "\n"), "\n")
+	found := false
+	for i, line := range lines {
+		m := mkinitcpioModulesRegex.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		existing := strings.Fields(m[2])
+		missing := []string{}
+		for _, module := range modules {
+			if !slices.ContainsFunc(existing, func(e string) bool { return normalizeModuleName(e) == module }) {
+				missing = append(missing, module)
+			}
+		}
+		if len(missing) == 0 {
+			return nil
+		}
+		lines[i] = m[1] + strings.Join(append(missing, existing...), " ") + m[3]
+		found = true
+		break
+	}
+	if !found {
+		lines = append(lines, "MODULES=("+strings.Join(modules, " ")+")")
+	}
+	return writeFileAtomic(conf, []byte(strings.Join(lines, "\n")+"\n"), 0644)
+}
+
+// addInitramfsToolsModules appends the missing modules to /etc/initramfs-tools/modules
+func addInitramfsToolsModules(conf string, modules []string) error {
+	content, err := os.ReadFile(conf)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	existing := []string{}
+	for _, line := range strings.Split(string(content), "\n") {
+		if fields := strings.Fields(line); len(fields) > 0 && !strings.HasPrefix(fields[0], "#") {
+			existing = append(existing, normalizeModuleName(fields[0]))
+		}
+	}
+	result := string(content)
+	if result != "" && !strings.HasSuffix(result, "\n") {
+		result += "\n"
+	}
+	changed := false
+	for _, module := range modules {
+		if !slices.Contains(existing, module) {
+			result += module + "\n"
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	return writeFileAtomic(conf, []byte(result), 0644)
+}
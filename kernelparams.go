@@ -0,0 +1,213 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"text/tabwriter"
+)
+
+const (
+	PATH_PROC_CPUINFO = "/proc/cpuinfo"
+
+	BootloaderAuto = "auto"
+)
+
+// kernelParamKeys are the IOMMU and passthrough related kernel parameters that kernel-params manages
+var kernelParamKeys = []string{"intel_iommu", "amd_iommu", "iommu", "vfio-pci.ids", "video=efifb", "pcie_acs_override"}
+
+type _kernelParams struct {
+	Add           []string `short:"a" sep:"none" help:"Parameters to add or replace, repeatable or comma separated before each key=. Example: iommu=pt,vfio-pci.ids=10de:2882,10de:22be" placeholder:"key=value"`
+	Remove        []string `short:"r" help:"Comma separated list of parameter keys to remove. Example: pcie_acs_override" placeholder:"key"`
+	Iommu         bool     `short:"i" help:"Enable the IOMMU of the CPU vendor (intel_iommu=on or amd_iommu=on) in passthrough mode (iommu=pt)"`
+	Bootloader    string   `short:"b" help:"Bootloader to edit. One of: ${enum}" enum:"auto, grub, systemd-boot, grubby, kernelstub" default:"auto"`
+	DryRun        bool     `short:"n" help:"Only show the changes"`
+	snapshotFlags `embed:""`
+}
+
+type KernelParamsCmd struct {
+	KernelParams _kernelParams `cmd:"" name:"kernel-params" aliases:"k" help:"Show and edit the IOMMU related kernel command line parameters"`
+}
+
+// cpuIommuParam returns the parameter that enables the IOMMU of the CPU vendor below root
+func cpuIommuParam(root string) (string, error) {
+	cpuinfo, err := os.ReadFile(filepath.Join(root, PATH_PROC_CPUINFO))
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s: %w", PATH_PROC_CPUINFO, err)
+	}
+	switch {
+	case strings.Contains(string(cpuinfo), "GenuineIntel"):
+		return "intel_iommu=on", nil
+	case strings.Contains(string(cpuinfo), "AuthenticAMD"):
+		return "amd_iommu=on", nil
+	}
+	return "", errors.New("unknown CPU vendor, add intel_iommu=on or amd_iommu=on explicitly")
+}
+
+// diffCmdline returns the arguments removed from and added to a kernel command line
+func diffCmdline(before, after []string) (removed, added []string) {
+	for _, arg := range before {
+		if !slices.Contains(after, arg) {
+			removed = append(removed, arg)
+		}
+	}
+	for _, arg := range after {
+		if !slices.Contains(before, arg) {
+			added = append(added, arg)
+		}
+	}
+	return removed, added
+}
+
+// splitParams splits values on the commas that start a new key=value, so that values such as
+// vfio-pci.ids=10de:2882,10de:22be keep their own commas
+func splitParams(values []string) []string {
+	params := []string{}
+	for _, value := range values {
+		for i, part := range strings.Split(value, ",") {
+			if i > 0 && !strings.Contains(part, "=") {
+				params[len(params)-1] += "," + part
+				continue
+			}
+			params = append(params, part)
+		}
+	}
+	return params
+}
+
+// Run executes the command
+func (cmd *_kernelParams) Run(globals *Globals) error {
+	log := globals.config.Logger()
+
+	edit := len(cmd.Add) > 0 || len(cmd.Remove) > 0 || cmd.Iommu
+	if edit && !cmd.DryRun {
+		if cmd.FromSnapshot != "" {
+			return fmt.Errorf("--from-snapshot only shows the parameters, or the changes with --dry-run")
+		}
+		// Re-run elevated before printing anything, the elevated run prints the changes
+		if err := reRunElevated(); err != nil {
+			return err
+		}
+	}
+	root, cleanup, err := cmd.root(log)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	b, args, err := cmd.readBootloader(root)
+	if err != nil && (edit || cmd.Bootloader != BootloaderAuto) {
+		return err
+	}
+	if !edit {
+		if err != nil {
+			log.Warn().Err(err).Msg("Showing the running kernel command line only")
+		}
+		return cmd.show(root, b, args)
+	}
+
+	set := splitParams(cmd.Add)
+	if cmd.Iommu {
+		param, err := cpuIommuParam(root)
+		if err != nil {
+			return err
+		}
+		set = append(set, param, "iommu=pt")
+	}
+	for _, arg := range append(slices.Clone(set), cmd.Remove...) {
+		if !slices.Contains(kernelParamKeys, cmdlineKey(arg)) {
+			return fmt.Errorf("unsupported parameter %q. Supported: %s", arg, strings.Join(kernelParamKeys, ", "))
+		}
+	}
+
+	updated := updateCmdline(args, set, cmd.Remove)
+	removed, added := diffCmdline(args, updated)
+	if len(removed) == 0 && len(added) == 0 {
+		log.Info().Msgf("Kernel command line in %s is already up to date", b.Location())
+		return nil
+	}
+	fmt.Printf("--- %s\n+++ %s\n", b.Location(), b.Location())
+	for _, arg := range removed {
+		fmt.Printf("-%s\n", arg)
+	}
+	for _, arg := range added {
+		fmt.Printf("+%s\n", arg)
+	}
+	if cmd.DryRun {
+		return nil
+	}
+
+	if err := b.Update(set, cmd.Remove); err != nil {
+		return fmt.Errorf("failed to update %s: %w", b.Location(), err)
+	}
+	log.Info().Msgf("Updated %s", b.Location())
+	if b.RegenerateCommand() != "" {
+		log.Warn().Msgf("Run %q for the change to apply at next boot", b.RegenerateCommand())
+	}
+	return nil
+}
+
+// readBootloader returns the selected bootloader below root and its kernel command line arguments
+func (cmd *_kernelParams) readBootloader(root string) (bootloader, []string, error) {
+	name := cmd.Bootloader
+	if name == BootloaderAuto {
+		var err error
+		if name, err = detectBootloader(root); err != nil {
+			return nil, nil, err
+		}
+	}
+	b, err := newBootloader(name, root)
+	if err != nil {
+		return nil, nil, err
+	}
+	args, err := b.Args()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read kernel command line from %s: %w", b.Location(), err)
+	}
+	return b, args, nil
+}
+
+// show prints the managed parameters of the running kernel below root and of the bootloader, if any
+func (cmd *_kernelParams) show(root string, b bootloader, args []string) error {
+	running := []string{}
+	if cmdline, err := os.ReadFile(filepath.Join(root, PATH_PROC_CMDLINE)); err == nil {
+		running = splitCmdline(string(cmdline))
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	if b == nil {
+		fmt.Fprintf(w, "PARAMETER\t%s\n", PATH_PROC_CMDLINE)
+		for _, key := range kernelParamKeys {
+			fmt.Fprintf(w, "%s\t%s\n", key, paramValue(running, key))
+		}
+		return w.Flush()
+	}
+
+	fmt.Fprintf(w, "PARAMETER\t%s\t%s\n", PATH_PROC_CMDLINE, b.Location())
+	for _, key := range kernelParamKeys {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", key, paramValue(running, key), paramValue(args, key))
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	regenerate := b.RegenerateCommand()
+	if regenerate == "" {
+		regenerate = "none"
+	}
+	fmt.Printf("\nBootloader: %s. Regeneration command: %s\n", b.Name(), regenerate)
+	return nil
+}
+
+// paramValue returns the argument with the key for display, or - when it is not set
+func paramValue(args []string, key string) string {
+	for _, arg := range args {
+		if cmdlineKey(arg) == key {
+			return arg
+		}
+	}
+	return "-"
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/alecthomas/kong"
+	"github.com/rs/zerolog"
+)
+
+// captureStdout returns what run prints to stdout
+func captureStdout(t *testing.T, run func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+	output := make(chan string)
+	go func() {
+		content, _ := io.ReadAll(r)
+		output <- string(content)
+	}()
+	run()
+	w.Close()
+	return <-output
+}
+
+// stubElevation makes reRunElevated return err, as the unprivileged process does once the elevated one ran
+func stubElevation(t *testing.T, err error) {
+	t.Helper()
+	previous := reRunElevated
+	reRunElevated = func() error { return err }
+	t.Cleanup(func() { reRunElevated = previous })
+}
+
+// writeFakeGrubby puts a grubby on PATH that reads the default kernel args and logs the arguments of edits
+func writeFakeGrubby(t *testing.T, args string) (log string) {
+	t.Helper()
+	dir := t.TempDir()
+	log = filepath.Join(dir, "grubby.log")
+	script := "#!/bin/sh\n" +
+		"case \"$1\" in\n" +
+		"--info=DEFAULT) echo 'args=\"" + args + "\"' ;;\n" +
+		"*) printf '%s\\n' \"$@\" > \"$GRUBBY_LOG\" ;;\n" +
+		"esac\n"
+	if err := os.WriteFile(filepath.Join(dir, "grubby"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	t.Setenv("GRUBBY_LOG", log)
+	return log
+}
+
+// TestKernelParamsElevatesFirst tests that an edit prints nothing before re-running elevated, so the changes show once
+func TestKernelParamsElevatesFirst(t *testing.T) {
+	elevated := errors.New("elevated run done")
+	stubElevation(t, elevated)
+	log := writeFakeGrubby(t, "ro quiet")
+	globals := &Globals{config: &Config{logger: zerolog.Nop()}}
+
+	var err error
+	cmd := &_kernelParams{Add: []string{"iommu=pt"}, Bootloader: BootloaderGrubby}
+	if output := captureStdout(t, func() { err = cmd.Run(globals) }); output != "" {
+		t.Errorf("Run() printed before re-running elevated: %q", output)
+	}
+	if !errors.Is(err, elevated) {
+		t.Errorf("Run() error = %v, expected the elevation result", err)
+	}
+	if _, err := os.Stat(log); err == nil {
+		t.Errorf("Run() edited the kernel args without elevation")
+	}
+
+	// A dry run needs no privileges and prints the changes
+	stubElevation(t, errors.New("unexpected elevation"))
+	cmd.DryRun = true
+	output := captureStdout(t, func() { err = cmd.Run(globals) })
+	if err != nil || output != "--- grubby --info=DEFAULT\n+++ grubby --info=DEFAULT\n+iommu=pt\n" {
+		t.Errorf("Run() of a dry run got = %q, %v", output, err)
+	}
+}
+
+// TestGrubbyUpdate tests that grubby is given the current values of the removed arguments
+func TestGrubbyUpdate(t *testing.T) {
+	log := writeFakeGrubby(t, "ro quiet video=efifb:off iommu=soft")
+	b := &grubbyBootloader{}
+	if err := b.Update([]string{"iommu=pt"}, []string{"video=efifb"}); err != nil {
+		t.Fatalf("Update() error = %v", err)
+	}
+	content, err := os.ReadFile(log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"--update-kernel=ALL", "--args=iommu=pt", "--remove-args=video=efifb:off iommu=soft"}
+	if actual := strings.Split(strings.TrimSpace(string(content)), "\n"); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("Update() ran grubby with %q, expected %q", actual, expected)
+	}
+}
+
+// TestKernelParamsCommas tests parameters whose values hold commas, given through the command line
+func TestKernelParamsCommas(t *testing.T) {
+	writeFakeGrubby(t, "ro quiet pcie_acs_override=downstream")
+	globals := &Globals{config: &Config{logger: zerolog.Nop()}}
+	var cli KernelParamsCmd
+	parser, err := kong.New(&cli)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = parser.Parse([]string{"kernel-params", "-n", "-b", "grubby",
+		"-a", "vfio-pci.ids=10de:2882,10de:22be", "-a", "iommu=pt,pcie_acs_override=downstream,multifunction"})
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+	expected := []string{"vfio-pci.ids=10de:2882,10de:22be", "iommu=pt", "pcie_acs_override=downstream,multifunction"}
+	if actual := splitParams(cli.KernelParams.Add); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("splitParams() got = %q, expected %q", actual, expected)
+	}
+
+	output := captureStdout(t, func() { err = cli.KernelParams.Run(globals) })
+	diff := "--- grubby --info=DEFAULT\n+++ grubby --info=DEFAULT\n-pcie_acs_override=downstream\n" +
+		"+pcie_acs_override=downstream,multifunction\n+vfio-pci.ids=10de:2882,10de:22be\n+iommu=pt\n"
+	if err != nil || output != diff {
+		t.Errorf("Run() got = %q, %v, expected %q", output, err, diff)
+	}
+}
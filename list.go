@@ -4,14 +4,25 @@ import (
 	"container/list"
 	"encoding/json"
 	"fmt"
+	"os"
 	"slices"
+	"time"
 	"unicode"
 )
 
 type _list struct {
-	Tree         bool   `short:"t" help:"Hierarchical output"`
-	OutputFormat string `short:"o" help:"Output format. One of: ${enum}" enum:"json, yaml, xml, toml, props, shell, csv, tsv," default:""`
-	YQ           string `short:"y" help:"YQ expression to apply to the output. Ignored if output format is not specified"`
+	Tree          bool     `short:"t" help:"Hierarchical output" xor:"columns,sort"`
+	OutputFormat  string   `short:"o" help:"Output format. One of: ${enum}" enum:"json, yaml, xml, toml, props, shell, csv, tsv," default:""`
+	YQ            string   `short:"y" help:"YQ expression to apply to the output. Ignored if output format is not specified"`
+	Columns       []string `help:"Comma separated list of device fields to print as a flat table, or to keep in the output format. Any of: ${list_columns}" placeholder:"column" xor:"columns"`
+	Sort          []string `help:"Comma separated list of columns to sort the flat table or output by, in natural order. Suffix with :desc to sort descending, e.g. numanode:desc" placeholder:"column" xor:"sort"`
+	Lspci         string   `help:"Print like lspci with these options, a combination of n, nn, k, mm and v with mm. Examples: nn, nnk, mm, vmmk" placeholder:"options" xor:"columns,sort"`
+	Template      string   `help:"Go text/template to print the devices with, inline or @file. See README for the data and the join, pad, upper and hex helpers" placeholder:"template" xor:"columns"`
+	Watch         bool     `short:"w" help:"Print again whenever PCI devices are added, removed, bound or unbound"`
+	Color         string   `help:"Colour the table rows of devices bound to vfio-pci (green) and to host drivers (yellow). One of: ${enum}" enum:"auto,always,never" default:"auto"`
+	Compat        bool     `help:"With an output format, print the unversioned shape of earlier versions instead of the document of 'schema': devices by IOMMU group, or a flat list for csv and tsv"`
+	listFilters   `embed:""`
+	snapshotFlags `embed:""`
 }
 
 type ListCmd struct {
@@ -20,10 +31,134 @@ type ListCmd struct {
 
 // Run executes the command
 func (cmd *_list) Run(globals *Globals) error {
-	pciDevices, err := ParsePciDevices()
+	if cmd.Watch {
+		if cmd.FromSnapshot != "" {
+			return fmt.Errorf("--watch and --from-snapshot can't be used together")
+		}
+		return cmd.watch(globals)
+	}
+	root, cleanup, err := cmd.root(globals.config.Logger())
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	return cmd.print(globals, root)
+}
+
+// watch prints the devices, then again after each burst of uevents changing them
+func (cmd *_list) watch(globals *Globals) error {
+	log := globals.config.Logger()
+
+	db, err := loadedPciIds()
+	if err != nil {
+		return err
+	}
+	uevents, err := newNetlinkUevents()
+	if err != nil {
+		return err
+	}
+	defer uevents.Close()
+
+	events := make(chan WatchEvent)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- watchEvents(uevents, db, func(e WatchEvent) error {
+			events <- e
+			return nil
+		})
+	}()
+
+	clearScreen := isTerminal(os.Stdout)
+	for {
+		if clearScreen {
+			fmt.Print("\033[H\033[2J")
+		}
+		if err := cmd.print(globals, "/"); err != nil {
+			log.Error().Err(err).Msg("Failed to list the devices")
+		}
+		select {
+		case e := <-events:
+			if e.Action == WatchResync {
+				log.Warn().Msg("Kernel uevents were lost, listing the devices again")
+			}
+			log.Debug().Str("action", e.Action).Str("bus", e.Bus).Msg("PCI device changed")
+		case err := <-errs:
+			return err
+		}
+		// Wait for the other functions of the device and the following bind
+		for settled := false; !settled; {
+			select {
+			case <-events:
+			case <-time.After(watchSettleDelay):
+				settled = true
+			case err := <-errs:
+				return err
+			}
+		}
+		if !clearScreen {
+			fmt.Println()
+		}
+	}
+}
+
+// print prints the devices below root once, in the chosen format
+func (cmd *_list) print(globals *Globals, root string) error {
+	pciDevices, err := parsePciDevices(root)
 	if err != nil {
 		return err
 	}
+	db, err := pciIdsAt(root)
+	if err != nil {
+		return err
+	}
+	isolated := isolatedGroups(pciDevices)
+	pciDevices, err = cmd.filter(db, pciDevices)
+	if err != nil {
+		return err
+	}
+
+	if cmd.Lspci != "" {
+		if len(cmd.OutputFormat) > 0 {
+			return fmt.Errorf("--output-format and --lspci can't be used together")
+		}
+		options, err := parseLspciOptions(cmd.Lspci)
+		if err != nil {
+			return err
+		}
+		return printLspci(os.Stdout, db, pciDevices, options)
+	}
+
+	if cmd.Template != "" {
+		if len(cmd.OutputFormat) > 0 {
+			return fmt.Errorf("--output-format and --template can't be used together")
+		}
+		tmpl, err := parseListTemplate(cmd.Template)
+		if err != nil {
+			return err
+		}
+		if err := sortDevices(pciDevices, cmd.Sort); err != nil {
+			return err
+		}
+		return printTemplate(os.Stdout, tmpl, pciDevices)
+	}
+
+	// Flat table, or flat list of the columns in the output format
+	if len(cmd.Columns) > 0 || len(cmd.Sort) > 0 {
+		return cmd.printColumns(globals, pciDevices)
+	}
+
+	// Versioned document, or the default columns for the flat csv and tsv
+	if len(cmd.OutputFormat) > 0 && !cmd.Compat {
+		if slices.Contains([]string{"csv", "tsv"}, cmd.OutputFormat) {
+			return cmd.printColumns(globals, pciDevices)
+		}
+		out, err := yqOutput(globals, newInventory(root, pciDevices, isolated), cmd.YQ, cmd.OutputFormat)
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(out))
+		return nil
+	}
 
 	groups := map[string][]PciDevice{}
 	for _, dev := range pciDevices {
@@ -47,7 +182,7 @@ func (cmd *_list) Run(globals *Globals) error {
 		return fmt.Errorf("error applying YQ expression: %w", err)
 	}
 	if len(cmd.OutputFormat) > 0 {
-		out, err := yqEncode(yqResult, cmd.OutputFormat, true)
+		out, err := yqEncode(yqResult, cmd.OutputFormat, useColor(ColorAuto, os.Stdout))
 		if err != nil {
 			return fmt.Errorf("error encoding output: %w", err)
 		}
@@ -64,6 +199,30 @@ func (cmd *_list) Run(globals *Globals) error {
 	return nil
 }
 
+// printColumns prints the sorted devices with only the chosen columns
+func (cmd *_list) printColumns(globals *Globals, pciDevices []PciDevice) error {
+	columns := defaultListColumns
+	if len(cmd.Columns) > 0 {
+		var err error
+		if columns, err = resolveColumns(cmd.Columns); err != nil {
+			return err
+		}
+	}
+	if err := sortDevices(pciDevices, cmd.Sort); err != nil {
+		return err
+	}
+
+	if len(cmd.OutputFormat) > 0 {
+		out, err := yqOutput(globals, projectDevices(pciDevices, columns), cmd.YQ, cmd.OutputFormat)
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(out))
+		return nil
+	}
+	return printDeviceTable(os.Stdout, pciDevices, columns, useColor(cmd.Color, os.Stdout))
+}
+
 // NaturalCompare performs natural string comparison.
 // Returns:
 //   - negative if a < b
@@ -160,9 +319,21 @@ func prettyPrintDevices(yqResult *list.List, cmd *_list) error {
 			if class != "" {
 				prevClass = class
 			}
+			modules := ""
+			if dev.KernelModule != "" {
+				modules = fmt.Sprintf(" modules: %s", dev.KernelModule)
+			}
+			power := ""
+			if dev.PowerState != "" {
+				power = fmt.Sprintf(" power: %s (%s, control=%s, d3cold_allowed=%s)", dev.PowerState, dev.RuntimeStatus, dev.PowerControl, dev.D3ColdAllowed)
+			}
+			numa := ""
+			if dev.NumaNode != "" && dev.NumaNode != "-1" {
+				numa = fmt.Sprintf(" numa: %s (cpus %s)", dev.NumaNode, dev.LocalCpuList)
+			}
 			fmt.Printf(
-				"%s%s%s %s %s [%s:%s] (rev %s) driver: %s\n",
-				class, spacer, dev.Bus, dev.VendorName, dev.DeviceName, dev.VendorID, dev.DeviceID, dev.Revision, dev.KernelDriver,
+				"%s%s%s %s %s [%s:%s] (rev %s) driver: %s%s%s%s\n",
+				class, spacer, dev.Bus, dev.VendorName, dev.DeviceName, dev.VendorID, dev.DeviceID, dev.Revision, dev.KernelDriver, modules, power, numa,
 			)
 		}
 	}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// lspciOptions are the lspci options reproduced by list --lspci
+type lspciOptions struct {
+	// Numeric is 1 for -n (numbers only) and 2 for -nn (names and numbers)
+	Numeric int
+	// Kernel is -k, the driver in use and the kernel modules
+	Kernel bool
+	// Machine is 2 for -mm
+	Machine int
+	// Verbose is -v, only supported with -mm
+	Verbose bool
+}
+
+// parseLspciOptions parses lspci options like -nnk or vmm
+func parseLspciOptions(options string) (lspciOptions, error) {
+	o := lspciOptions{}
+	for _, c := range strings.TrimPrefix(options, "-") {
+		switch c {
+		case 'n':
+			o.Numeric++
+		case 'k':
+			o.Kernel = true
+		case 'm':
+			o.Machine++
+		case 'v':
+			o.Verbose = true
+		default:
+			return o, fmt.Errorf("unsupported lspci option %q in %q. Supported: n, nn, k, mm, v with mm", c, options)
+		}
+	}
+	switch {
+	case o.Numeric > 2:
+		return o, fmt.Errorf("unsupported lspci options %q: at most -nn", options)
+	case o.Machine != 0 && o.Machine != 2:
+		return o, fmt.Errorf("unsupported lspci options %q: only the -mm machine readable format is supported", options)
+	case o.Verbose && o.Machine == 0:
+		return o, fmt.Errorf("unsupported lspci options %q: -v is only supported with -mm", options)
+	}
+	return o, nil
+}
+
+// lspciNames formats names like pci_lookup_name of pciutils, for a Numeric level
+type lspciNames struct {
+	db      *pciIdsDatabase
+	numeric int
+}
+
+// format formats a single name, falling back to "<unknown> <num>"
+func (n lspciNames) format(name string, found bool, num, unknown string) string {
+	switch {
+	case n.numeric == 1:
+		return num
+	case !found && n.numeric == 2:
+		return fmt.Sprintf("%s [%s]", unknown, num)
+	case !found:
+		return unknown + " " + num
+	case n.numeric == 2:
+		return fmt.Sprintf("%s [%s]", name, num)
+	}
+	return name
+}
+
+// formatPair formats a vendor and device name pair, falling back to "Device <num>"
+func (n lspciNames) formatPair(vendor string, vendorFound bool, device string, deviceFound bool, num string) string {
+	_, deviceNum, _ := strings.Cut(num, ":")
+	switch {
+	case n.numeric == 1:
+		return num
+	case n.numeric == 2 && !vendorFound:
+		return fmt.Sprintf("Device [%s]", num)
+	case n.numeric == 2 && !deviceFound:
+		return fmt.Sprintf("%s Device [%s]", vendor, num)
+	case n.numeric == 2:
+		return fmt.Sprintf("%s %s [%s]", vendor, device, num)
+	case !vendorFound:
+		return "Device " + num
+	case !deviceFound:
+		return fmt.Sprintf("%s Device %s", vendor, deviceNum)
+	}
+	return vendor + " " + device
+}
+
+// lspciIds returns the numeric ids of the device, 0 if not parsable
+func lspciIds(dev PciDevice) (vendor, device, subVendor, subDevice uint16, class, subclass uint8) {
+	value := func(s string, bitSize int) uint64 {
+		v, _ := parseHexId(s, bitSize)
+		return v
+	}
+	vendor, device = uint16(value(dev.VendorID, 16)), uint16(value(dev.DeviceID, 16))
+	subVendor, subDevice = uint16(value(dev.SubsysVendor, 16)), uint16(value(dev.SubsysDevice, 16))
+	if len(dev.Class) == 4 {
+		class, subclass = uint8(value(dev.Class[:2], 8)), uint8(value(dev.Class[2:], 8))
+	}
+	return
+}
+
+// class formats the class. An unknown subclass of a known class always gets its number
+func (n lspciNames) class(dev PciDevice) string {
+	_, _, _, _, class, subclass := lspciIds(dev)
+	num := fmt.Sprintf("%02x%02x", class, subclass)
+	if name, ok := n.db.Subclass(class, subclass); ok {
+		return n.format(name, true, num, "Class")
+	}
+	name, ok := n.db.Class(class)
+	if ok && n.numeric == 0 {
+		return lspciNames{n.db, 2}.format(name, true, num, "Class")
+	}
+	return n.format(name, ok, num, "Class")
+}
+
+// vendorDevice formats the vendor and device, as the terse format does
+func (n lspciNames) vendorDevice(dev PciDevice) string {
+	vendor, device, _, _, _, _ := lspciIds(dev)
+	vendorName, vendorFound := n.db.Vendor(vendor)
+	deviceName, deviceFound := n.db.Device(vendor, device)
+	return n.formatPair(vendorName, vendorFound, deviceName, deviceFound, fmt.Sprintf("%04x:%04x", vendor, device))
+}
+
+// vendor formats the vendor alone, as the machine readable format does
+func (n lspciNames) vendor(dev PciDevice) string {
+	vendor, _, _, _, _, _ := lspciIds(dev)
+	name, found := n.db.Vendor(vendor)
+	return n.format(name, found, fmt.Sprintf("%04x", vendor), "Vendor")
+}
+
+// device formats the device alone, as the machine readable format does
+func (n lspciNames) device(dev PciDevice) string {
+	vendor, device, _, _, _, _ := lspciIds(dev)
+	name, found := n.db.Device(vendor, device)
+	return n.format(name, found, fmt.Sprintf("%04x", device), "Device")
+}
+
+// hasSubsystem tells whether lspci shows the subsystem of the device
+func hasSubsystem(dev PciDevice) bool {
+	_, _, subVendor, _, _, _ := lspciIds(dev)
+	return subVendor != 0 && subVendor != 0xffff
+}
+
+// subsystem formats the subvendor and subdevice pair, as the Subsystem: line does
+func (n lspciNames) subsystem(dev PciDevice) string {
+	vendor, device, subVendor, subDevice, _, _ := lspciIds(dev)
+	vendorName, vendorFound := n.db.Vendor(subVendor)
+	deviceName, deviceFound := n.db.SubsystemName(vendor, device, subVendor, subDevice)
+	return n.formatPair(vendorName, vendorFound, deviceName, deviceFound, fmt.Sprintf("%04x:%04x", subVendor, subDevice))
+}
+
+// subVendor formats the subvendor alone, as the machine readable format does
+func (n lspciNames) subVendor(dev PciDevice) string {
+	_, _, subVendor, _, _, _ := lspciIds(dev)
+	name, found := n.db.Vendor(subVendor)
+	return n.format(name, found, fmt.Sprintf("%04x", subVendor), "Unknown vendor")
+}
+
+// subDevice formats the subdevice alone, as the machine readable format does
+func (n lspciNames) subDevice(dev PciDevice) string {
+	vendor, device, subVendor, subDevice, _, _ := lspciIds(dev)
+	name, found := n.db.SubsystemName(vendor, device, subVendor, subDevice)
+	return n.format(name, found, fmt.Sprintf("%04x", subDevice), "Device")
+}
+
+// lspciSlot returns the slot name, without the domain unless a device is outside domain 0000
+func lspciSlot(dev PciDevice, domains bool) string {
+	if domains {
+		return dev.Bus
+	}
+	_, slot, _ := strings.Cut(dev.Bus, ":")
+	return slot
+}
+
+// nonZeroHex returns the hex byte, or "" if it is 00 or empty, as lspci omits those
+func nonZeroHex(value string) string {
+	if v, ok := parseHexId(value, 8); ok && v != 0 {
+		return fmt.Sprintf("%02x", v)
+	}
+	return ""
+}
+
+// shellEscaped quotes a machine readable field, escaping quotes and backslashes as lspci does
+func shellEscaped(field string) string {
+	return `"` + strings.NewReplacer(`"`, `\"`, `\`, `\\`).Replace(field) + `"`
+}
+
+// printLspci prints the devices like lspci with the options
+func printLspci(w io.Writer, db *pciIdsDatabase, devices []PciDevice, o lspciOptions) error {
+	n := lspciNames{db: db, numeric: o.Numeric}
+	domains := false
+	for _, dev := range devices {
+		domains = domains || !strings.HasPrefix(dev.Bus, "0000:")
+	}
+
+	var b strings.Builder
+	for _, dev := range devices {
+		slot := lspciSlot(dev, domains)
+		rev, progIf := nonZeroHex(dev.Revision), nonZeroHex(dev.ProgIf)
+		switch {
+		case o.Machine == 2 && o.Verbose:
+			fmt.Fprintf(&b, "Slot:\t%s\n", slot)
+			fmt.Fprintf(&b, "Class:\t%s\n", n.class(dev))
+			fmt.Fprintf(&b, "Vendor:\t%s\n", n.vendor(dev))
+			fmt.Fprintf(&b, "Device:\t%s\n", n.device(dev))
+			if hasSubsystem(dev) {
+				fmt.Fprintf(&b, "SVendor:\t%s\n", n.subVendor(dev))
+				fmt.Fprintf(&b, "SDevice:\t%s\n", n.subDevice(dev))
+			}
+			if rev != "" {
+				fmt.Fprintf(&b, "Rev:\t%s\n", rev)
+			}
+			if progIf != "" {
+				fmt.Fprintf(&b, "ProgIf:\t%s\n", progIf)
+			}
+			if o.Kernel {
+				if dev.KernelDriver != "" {
+					fmt.Fprintf(&b, "Driver:\t%s\n", dev.KernelDriver)
+				}
+				for _, module := range dev.KernelModules {
+					fmt.Fprintf(&b, "Module:\t%s\n", module.Name)
+				}
+			}
+			if dev.NumaNode != "" && dev.NumaNode != "-1" {
+				fmt.Fprintf(&b, "NUMANode:\t%s\n", dev.NumaNode)
+			}
+			if dev.IommuGroup != "" {
+				fmt.Fprintf(&b, "IOMMUGroup:\t%s\n", dev.IommuGroup)
+			}
+			b.WriteString("\n")
+		case o.Machine == 2:
+			fmt.Fprintf(&b, "%s %s %s %s", slot, shellEscaped(n.class(dev)), shellEscaped(n.vendor(dev)), shellEscaped(n.device(dev)))
+			if rev != "" {
+				fmt.Fprintf(&b, " -r%s", rev)
+			}
+			if progIf != "" {
+				fmt.Fprintf(&b, " -p%s", progIf)
+			}
+			if hasSubsystem(dev) {
+				fmt.Fprintf(&b, " %s %s\n", shellEscaped(n.subVendor(dev)), shellEscaped(n.subDevice(dev)))
+			} else {
+				b.WriteString(` "" ""` + "\n")
+			}
+		default:
+			fmt.Fprintf(&b, "%s %s: %s", slot, n.class(dev), n.vendorDevice(dev))
+			if rev != "" {
+				fmt.Fprintf(&b, " (rev %s)", rev)
+			}
+			b.WriteString("\n")
+			if o.Kernel {
+				if hasSubsystem(dev) {
+					fmt.Fprintf(&b, "\tSubsystem: %s\n", n.subsystem(dev))
+				}
+				if dev.KernelDriver != "" {
+					fmt.Fprintf(&b, "\tKernel driver in use: %s\n", dev.KernelDriver)
+				}
+				if len(dev.KernelModules) > 0 {
+					fmt.Fprintf(&b, "\tKernel modules: %s\n", kernelModuleNames(dev.KernelModules))
+				}
+			}
+		}
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
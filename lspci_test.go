@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// lspciOutputs are the option sets with a golden file
+var lspciOutputs = []string{"nn", "k", "nnk", "mm", "nnmm", "vmm", "vmmk"}
+
+// checkLspci compares printLspci of the devices below root with the lspci-<options>.txt files of dir
+func checkLspci(t *testing.T, root, dir string) {
+	t.Helper()
+	devices, err := parsePciDevices(root)
+	if err != nil {
+		t.Fatalf("parsePciDevices() error = %v", err)
+	}
+	db, err := loadPciIds(root, "")
+	if err != nil {
+		t.Fatalf("loadPciIds() error = %v", err)
+	}
+	for _, options := range lspciOutputs {
+		t.Run(options, func(t *testing.T) {
+			expected, err := os.ReadFile(filepath.Join(dir, "lspci-"+options+".txt"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			o, err := parseLspciOptions(options)
+			if err != nil {
+				t.Fatalf("parseLspciOptions() error = %v", err)
+			}
+			var out bytes.Buffer
+			if err := printLspci(&out, db, devices, o); err != nil {
+				t.Fatalf("printLspci() error = %v", err)
+			}
+			if out.String() != string(expected) {
+				t.Errorf("printLspci(%s) got:\n%s\nexpected:\n%s", options, out.String(), expected)
+			}
+		})
+	}
+}
+
+// TestPrintLspci compares the lspci output modes of the hand made fixture host against expected outputs
+// written by hand after the lspci 3.x formats, see testdata/lspci/README.md
+func TestPrintLspci(t *testing.T) {
+	dir := filepath.Join("testdata", "lspci")
+	checkLspci(t, filepath.Join(dir, "host"), dir)
+}
+
+// TestLspciCaptures compares the lspci output modes with real lspci captures: each directory of testdata/lspci/captures
+// holds a snapshot.tar.gz of a host and the lspci outputs recorded on it at the same time
+func TestLspciCaptures(t *testing.T) {
+	snapshots, err := filepath.Glob(filepath.Join("testdata", "lspci", "captures", "*", "snapshot.tar.gz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snapshots) == 0 {
+		t.Fatal("no lspci capture in testdata/lspci/captures, see testdata/lspci/README.md")
+	}
+	for _, snapshot := range snapshots {
+		dir := filepath.Dir(snapshot)
+		t.Run(filepath.Base(dir), func(t *testing.T) {
+			root := t.TempDir()
+			if _, err := extractSnapshot(snapshot, root); err != nil {
+				t.Fatalf("extractSnapshot() error = %v", err)
+			}
+			checkLspci(t, root, dir)
+		})
+	}
+}
+
+// TestParseLspciOptions tests the supported lspci option combinations
+func TestParseLspciOptions(t *testing.T) {
+	testCases := []struct {
+		options  string
+		expected lspciOptions
+		wantErr  bool
+	}{
+		{"-nnk", lspciOptions{Numeric: 2, Kernel: true}, false},
+		{"vmm", lspciOptions{Machine: 2, Verbose: true}, false},
+		{"nnn", lspciOptions{}, true},
+		{"m", lspciOptions{}, true},
+		{"v", lspciOptions{}, true},
+		{"t", lspciOptions{}, true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.options, func(t *testing.T) {
+			o, err := parseLspciOptions(tc.options)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("parseLspciOptions() error = %v, wantErr %v", err, tc.wantErr)
+			}
+			if !tc.wantErr && o != tc.expected {
+				t.Errorf("parseLspciOptions() got = %+v, expected %+v", o, tc.expected)
+			}
+		})
+	}
+	if got := shellEscaped(`Quoted "name" \ slash`); got != `"Quoted \"name\" \\ slash"` {
+		t.Errorf("shellEscaped() got = %s", got)
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"os"
 	"path/filepath"
 	"strings"
@@ -15,6 +16,22 @@ func main() {
 		Plugins: kong.Plugins{
 			&ListCmd{},
 			&RebindCmd{},
+			&UnpersistCmd{},
+			&StatusCmd{},
+			&BindCmd{},
+			&DeviceCmd{},
+			&BusCmd{},
+			&PowerCmd{},
+			&ApplyCmd{},
+			&KernelParamsCmd{},
+			&BlacklistCmd{},
+			&IdsCmd{},
+			&SnapshotCmd{},
+			&DiffCmd{},
+			&SchemaCmd{},
+			&CpusCmd{},
+			&WatchCmd{},
+			&ServiceCmd{},
 			&VersionCmd{},
 		},
 	}
@@ -31,6 +48,13 @@ func main() {
 			"supported_formats": strings.Join(supportedConfigFormats, ", "),
 			"log_levels":        strings.Join(LogLevels, ", "),
 			"default_log_level": DefaultLogLevel.String(),
+			"driver_none":       DriverNone,
+			"persist_backends":  strings.Join(persistBackendNames, ", "),
+			"bindings_file":     PATH_BINDINGS,
+			"blacklist_conf":    PATH_BLACKLIST_CONF,
+			"pci_ids_paths":     strings.Join(PATHS_PCI_IDS, ", "),
+			"list_columns":      strings.Join(pciDeviceColumns(), ", "),
+			"inventory_live":    InventoryLive,
 		},
 	}
 
@@ -50,6 +74,7 @@ func main() {
 	}
 
 	ctx := kong.Parse(&cli, options...)
+	pciIdsFile = cli.PciIds
 
 	var err error
 	cli.config, err = NewConfig(
@@ -59,8 +84,17 @@ func main() {
 		cli.config.Logger().Fatal().Err(err).
 			Msg("Failed to create config")
 	}
+	pciIdsLog = cli.config.Logger()
 
 	err = ctx.Run(&cli.Globals)
+	var exitErr *ExitCodeError
+	if errors.As(err, &exitErr) {
+		if exitErr.Err != nil {
+			cli.config.Logger().Error().Err(exitErr.Err).
+				Msgf("Command %q finished with exit code %d", ctx.Command(), exitErr.Code)
+		}
+		os.Exit(exitErr.Code)
+	}
 	if err != nil {
 		cli.config.Logger().Fatal().Err(err).
 			Msgf("Failed to run command %q", ctx.Command())
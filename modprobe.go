@@ -0,0 +1,288 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// softdepMarker is the comment line preceding the softdep lines written by auto-vfio
+const softdepMarker = "# Managed by auto-vfio"
+
+// modprobeLine is a logical line of a modprobe.d file. Unmodified lines are written back as read
+type modprobeLine struct {
+	raw string
+	// Command is the first word, e.g. options, softdep, blacklist. Empty for comments and blank lines
+	Command string
+	// Args are the words after the command
+	Args     []string
+	modified bool
+}
+
+// String returns the line as it is written to the file
+func (l *modprobeLine) String() string {
+	if !l.modified {
+		return l.raw
+	}
+	return strings.Join(append([]string{l.Command}, l.Args...), " ")
+}
+
+// module returns the normalized module name the line applies to
+func (l *modprobeLine) module() string {
+	if len(l.Args) == 0 {
+		return ""
+	}
+	return normalizeModuleName(l.Args[0])
+}
+
+// modprobeConf is a modprobe.d file that round-trips comments, ordering and untouched lines
+type modprobeConf struct {
+	Lines []*modprobeLine
+}
+
+// parseModprobeConf parses the content of a modprobe.d file. Lines continued with a backslash form one logical line
+func parseModprobeConf(content string) *modprobeConf {
+	conf := &modprobeConf{}
+	raw := strings.Split(strings.TrimSuffix(content, "\n"), "\n")
+	if content == "" {
+		raw = nil
+	}
+	for i := 0; i < len(raw); i++ {
+		text := raw[i]
+		logical := strings.TrimSuffix(text, "\\")
+		for strings.HasSuffix(raw[i], "\\") && i+1 < len(raw) {
+			i++
+			text += "\n" + raw[i]
+			logical += " " + strings.TrimSuffix(raw[i], "\\")
+		}
+		line := &modprobeLine{raw: text}
+		if fields := strings.Fields(logical); len(fields) > 0 && !strings.HasPrefix(fields[0], "#") {
+			line.Command = fields[0]
+			line.Args = fields[1:]
+		}
+		conf.Lines = append(conf.Lines, line)
+	}
+	return conf
+}
+
+// String returns the content of the file
+func (c *modprobeConf) String() string {
+	if len(c.Lines) == 0 {
+		return ""
+	}
+	lines := make([]string, 0, len(c.Lines))
+	for _, line := range c.Lines {
+		lines = append(lines, line.String())
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// find returns the lines with the command for the module
+func (c *modprobeConf) find(command, module string) []*modprobeLine {
+	module = normalizeModuleName(module)
+	return slices.DeleteFunc(slices.Clone(c.Lines), func(l *modprobeLine) bool {
+		return l.Command != command || l.module() != module
+	})
+}
+
+// Option returns the value of the last option with the key for the module, like modprobe does
+func (c *modprobeConf) Option(module, key string) (string, bool) {
+	value, found := "", false
+	for _, line := range c.find("options", module) {
+		for _, arg := range line.Args[1:] {
+			if k, v, _ := strings.Cut(arg, "="); k == key {
+				value, found = v, true
+			}
+		}
+	}
+	return value, found
+}
+
+// SetOption sets the option in place on the first line that has it, and removes it from the other lines.
+// The option is appended to the first options line of the module, or to a new one, when no line has it
+func (c *modprobeConf) SetOption(module, key, value string) {
+	option := key + "=" + value
+	set := false
+	lines := c.find("options", module)
+	for _, line := range lines {
+		args := line.Args[:1]
+		for _, arg := range line.Args[1:] {
+			if k, _, _ := strings.Cut(arg, "="); k == key {
+				if set {
+					line.modified = true
+					continue
+				}
+				set = true
+				if arg != option {
+					arg = option
+					line.modified = true
+				}
+			}
+			args = append(args, arg)
+		}
+		line.Args = args
+	}
+
+	switch {
+	case set:
+		c.dropEmptyOptions()
+	case len(lines) > 0:
+		lines[0].Args = append(lines[0].Args, option)
+		lines[0].modified = true
+	default:
+		c.Lines = append(c.Lines, &modprobeLine{Command: "options", Args: []string{module, option}, modified: true})
+	}
+}
+
+// RemoveOption removes the option from all options lines of the module
+func (c *modprobeConf) RemoveOption(module, key string) {
+	for _, line := range c.find("options", module) {
+		args := slices.DeleteFunc(slices.Clone(line.Args[1:]), func(arg string) bool {
+			k, _, _ := strings.Cut(arg, "=")
+			return k == key
+		})
+		if len(args) != len(line.Args)-1 {
+			line.Args = append(line.Args[:1], args...)
+			line.modified = true
+		}
+	}
+	c.dropEmptyOptions()
+}
+
+// dropEmptyOptions removes modified options lines left without options
+func (c *modprobeConf) dropEmptyOptions() {
+	c.Lines = slices.DeleteFunc(c.Lines, func(l *modprobeLine) bool {
+		return l.modified && l.Command == "options" && len(l.Args) < 2
+	})
+}
+
+// VfioIds returns the deduplicated ids of all options vfio-pci ids= lines
+func (c *modprobeConf) VfioIds() []string {
+	ids := []string{}
+	for _, line := range c.find("options", "vfio-pci") {
+		for _, arg := range line.Args[1:] {
+			if value, ok := strings.CutPrefix(arg, "ids="); ok && value != "" {
+				ids = mergeIds(ids, strings.Split(value, ",")...)
+			}
+		}
+	}
+	return ids
+}
+
+// SetVfioIds sets options vfio-pci ids=, removing it when there are no ids
+func (c *modprobeConf) SetVfioIds(ids []string) {
+	if len(ids) == 0 {
+		c.RemoveOption("vfio-pci", "ids")
+		return
+	}
+	c.SetOption("vfio-pci", "ids", strings.Join(ids, ","))
+}
+
+// Blacklisted returns the modules of the blacklist lines
+func (c *modprobeConf) Blacklisted() []string {
+	modules := []string{}
+	for _, line := range c.Lines {
+		if line.Command == "blacklist" && len(line.Args) > 0 {
+			modules = mergeIds(modules, normalizeModuleName(line.Args[0]))
+		}
+	}
+	return modules
+}
+
+// SetBlacklisted makes the blacklist lines exactly match the modules, keeping existing lines in place
+func (c *modprobeConf) SetBlacklisted(modules []string) {
+	present := []string{}
+	c.Lines = slices.DeleteFunc(c.Lines, func(l *modprobeLine) bool {
+		if l.Command != "blacklist" || len(l.Args) == 0 {
+			return false
+		}
+		module := normalizeModuleName(l.Args[0])
+		if !slices.Contains(modules, module) || slices.Contains(present, module) {
+			return true
+		}
+		present = append(present, module)
+		return false
+	})
+	for _, module := range modules {
+		if !slices.Contains(present, module) {
+			c.Lines = append(c.Lines, &modprobeLine{Command: "blacklist", Args: []string{module}, modified: true})
+		}
+	}
+}
+
+// PreSoftdeps returns the modules with a softdep <module> pre: <pre> line
+func (c *modprobeConf) PreSoftdeps(pre string) []string {
+	modules := []string{}
+	for _, line := range c.Lines {
+		if isPreSoftdep(line, pre) {
+			modules = mergeIds(modules, line.Args[0])
+		}
+	}
+	return modules
+}
+
+// SetPreSoftdeps makes the managed softdep <module> pre: <pre> lines exactly match the modules, keeping existing lines in place.
+// Lines not preceded by softdepMarker were written by the user and are kept
+func (c *modprobeConf) SetPreSoftdeps(pre string, modules []string) {
+	present := []string{}
+	lines := make([]*modprobeLine, 0, len(c.Lines))
+	for i, l := range c.Lines {
+		if !isPreSoftdep(l, pre) {
+			lines = append(lines, l)
+			continue
+		}
+		managed := i > 0 && strings.TrimSpace(c.Lines[i-1].raw) == softdepMarker
+		if managed && (!slices.Contains(modules, l.Args[0]) || slices.Contains(present, l.Args[0])) {
+			// Drop the marker with the line
+			lines = lines[:len(lines)-1]
+			continue
+		}
+		present = append(present, l.Args[0])
+		lines = append(lines, l)
+	}
+	c.Lines = lines
+	for _, module := range modules {
+		if !slices.Contains(present, module) {
+			c.Lines = append(c.Lines,
+				&modprobeLine{raw: softdepMarker},
+				&modprobeLine{Command: "softdep", Args: []string{module, "pre:", pre}, modified: true})
+		}
+	}
+}
+
+// isPreSoftdep reports whether the line is exactly softdep <module> pre: <pre>
+func isPreSoftdep(l *modprobeLine, pre string) bool {
+	return l.Command == "softdep" && len(l.Args) == 3 && l.Args[1] == "pre:" && normalizeModuleName(l.Args[2]) == normalizeModuleName(pre)
+}
+
+// readModprobeConf reads and parses a modprobe.d file. A missing file is empty
+func readModprobeConf(file string) (*modprobeConf, error) {
+	content, err := os.ReadFile(file)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	return parseModprobeConf(string(content)), nil
+}
+
+// writeModprobeConf atomically writes the modprobe.d file when its content changed, keeping a timestamped backup of the previous content.
+// The backup does not end in .conf, so modprobe ignores it
+func writeModprobeConf(file string, conf *modprobeConf) error {
+	content := conf.String()
+	previous, err := os.ReadFile(file)
+	switch {
+	case err == nil:
+		if string(previous) == content {
+			return nil
+		}
+		backup := file + "." + time.Now().Format("20060102-150405") + ".bak"
+		if err := os.WriteFile(backup, previous, 0644); err != nil {
+			return fmt.Errorf("failed to back up %q: %w", file, err)
+		}
+	case !errors.Is(err, os.ErrNotExist):
+		return err
+	}
+	return writeFileAtomic(file, []byte(content), 0644)
+}
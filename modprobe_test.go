@@ -0,0 +1,116 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// TestModprobeConfRoundTrip tests that parsing and writing back keeps the file unchanged
+func TestModprobeConfRoundTrip(t *testing.T) {
+	content := "# vfio\n\noptions vfio-pci disable_vga=1 \\\n\tids=10de:2882\nblacklist nouveau\nsoftdep nvidia pre: vfio-pci\n"
+	conf := parseModprobeConf(content)
+	if actual := conf.String(); actual != content {
+		t.Errorf("String() got = %q, expected %q", actual, content)
+	}
+	if ids := conf.VfioIds(); !reflect.DeepEqual(ids, []string{"10de:2882"}) {
+		t.Errorf("VfioIds() got = %v", ids)
+	}
+}
+
+// TestModprobeConfEdit tests editing options while keeping comments, ordering and other options
+func TestModprobeConfEdit(t *testing.T) {
+	testCases := []struct {
+		name     string
+		content  string
+		edit     func(conf *modprobeConf)
+		expected string
+	}{
+		{
+			"AddIdKeepsOtherOptions",
+			"# GPU\noptions vfio-pci disable_vga=1 ids=10de:2882\n",
+			func(c *modprobeConf) { c.SetVfioIds(mergeIds(c.VfioIds(), "10de:22be")) },
+			"# GPU\noptions vfio-pci disable_vga=1 ids=10de:2882,10de:22be\n",
+		},
+		{
+			"DedupeAcrossLines",
+			"options vfio_pci ids=10de:2882,10de:2882\noptions vfio-pci disable_vga=1 ids=1002:73bf\n",
+			func(c *modprobeConf) { c.SetVfioIds(c.VfioIds()) },
+			"options vfio_pci ids=10de:2882,1002:73bf\noptions vfio-pci disable_vga=1\n",
+		},
+		{
+			"AppendToOptionsLine",
+			"options vfio-pci disable_vga=1\n",
+			func(c *modprobeConf) { c.SetVfioIds([]string{"10de:2882"}) },
+			"options vfio-pci disable_vga=1 ids=10de:2882\n",
+		},
+		{
+			"NewFile",
+			"",
+			func(c *modprobeConf) { c.SetVfioIds([]string{"10de:2882"}) },
+			"options vfio-pci ids=10de:2882\n",
+		},
+		{
+			"RemoveLastId",
+			"# GPU\noptions vfio-pci ids=10de:2882\noptions vfio-pci disable_vga=1\n",
+			func(c *modprobeConf) { c.SetVfioIds(nil) },
+			"# GPU\noptions vfio-pci disable_vga=1\n",
+		},
+		{
+			"Softdeps",
+			"# Managed by auto-vfio\nsoftdep nouveau pre: vfio-pci\n# Managed by auto-vfio\nsoftdep amdgpu pre: vfio-pci\n" +
+				"# Managed by auto-vfio\nsoftdep nouveau pre: vfio-pci\n",
+			func(c *modprobeConf) { c.SetPreSoftdeps("vfio-pci", []string{"nouveau", "snd_hda_intel"}) },
+			"# Managed by auto-vfio\nsoftdep nouveau pre: vfio-pci\n# Managed by auto-vfio\nsoftdep snd_hda_intel pre: vfio-pci\n",
+		},
+		{
+			"SoftdepsKeepUserLines",
+			"# mine\nsoftdep amdgpu pre: vfio-pci\nsoftdep nouveau pre: vfio-pci\n",
+			func(c *modprobeConf) { c.SetPreSoftdeps("vfio-pci", []string{"nouveau", "snd_hda_intel"}) },
+			"# mine\nsoftdep amdgpu pre: vfio-pci\nsoftdep nouveau pre: vfio-pci\n# Managed by auto-vfio\nsoftdep snd_hda_intel pre: vfio-pci\n",
+		},
+		{
+			"Blacklist",
+			"# host\nblacklist nouveau\nblacklist radeon\nblacklist nouveau\n",
+			func(c *modprobeConf) { c.SetBlacklisted([]string{"nouveau", "snd_hda_intel"}) },
+			"# host\nblacklist nouveau\nblacklist snd_hda_intel\n",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			conf := parseModprobeConf(tc.content)
+			tc.edit(conf)
+			if actual := conf.String(); actual != tc.expected {
+				t.Errorf("got = %q, expected %q", actual, tc.expected)
+			}
+		})
+	}
+}
+
+// TestWriteModprobeConf tests the backup of the previous content
+func TestWriteModprobeConf(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "vfio.conf")
+	if err := os.WriteFile(file, []byte("options vfio-pci ids=10de:2882\n"), 0644); err != nil {
+		t.Fatalf("error writing file: %v", err)
+	}
+	conf, err := readModprobeConf(file)
+	if err != nil {
+		t.Fatalf("readModprobeConf() error = %v", err)
+	}
+	conf.SetVfioIds([]string{"10de:22be"})
+	if err := writeModprobeConf(file, conf); err != nil {
+		t.Fatalf("writeModprobeConf() error = %v", err)
+	}
+
+	backups, _ := filepath.Glob(file + ".*.bak")
+	if len(backups) != 1 {
+		t.Fatalf("expected 1 backup, got %v", backups)
+	}
+	if content, _ := os.ReadFile(backups[0]); string(content) != "options vfio-pci ids=10de:2882\n" {
+		t.Errorf("backup got = %q", content)
+	}
+	if content, _ := os.ReadFile(file); string(content) != "options vfio-pci ids=10de:22be\n" {
+		t.Errorf("file got = %q", content)
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// moduleAlias is a pci alias line of modules.alias
+type moduleAlias struct {
+	// Pattern is a glob matched against the device modalias, e.g. pci:v000010DEd*sv*sd*bc03sc00i00*
+	Pattern string
+	Module  string
+}
+
+// KernelModule is a module that can drive a device
+type KernelModule struct {
+	Name    string
+	Builtin bool
+}
+
+// String returns the module name
+func (m KernelModule) String() string {
+	return m.Name
+}
+
+// readModulesAlias reads the pci aliases from modules.alias of the kernel release below root,
+// followed by the aliases of the built in modules from modules.builtin.modinfo
+func readModulesAlias(root, release string) ([]moduleAlias, error) {
+	file, err := os.Open(filepath.Join(root, PATH_LIB_MODULES, release, "modules.alias"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open modules.alias: %w", err)
+	}
+	defer file.Close()
+
+	aliases := []moduleAlias{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 3 || fields[0] != "alias" || !strings.HasPrefix(fields[1], "pci:") {
+			continue
+		}
+		aliases = append(aliases, moduleAlias{Pattern: fields[1], Module: fields[2]})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read modules.alias: %w", err)
+	}
+	return append(aliases, readBuiltinAliases(root, release)...), nil
+}
+
+// readBuiltinAliases reads the pci aliases of the built in modules from modules.builtin.modinfo,
+// made of NUL separated <module>.alias=<pattern> entries. Older kernels lack the file
+func readBuiltinAliases(root, release string) []moduleAlias {
+	content, err := os.ReadFile(filepath.Join(root, PATH_LIB_MODULES, release, "modules.builtin.modinfo"))
+	if err != nil {
+		return nil
+	}
+	aliases := []moduleAlias{}
+	for _, entry := range strings.Split(string(content), "\x00") {
+		module, pattern, found := strings.Cut(entry, ".alias=")
+		if !found || !strings.HasPrefix(pattern, "pci:") {
+			continue
+		}
+		aliases = append(aliases, moduleAlias{Pattern: pattern, Module: module})
+	}
+	return aliases
+}
+
+// readBuiltinModules returns the normalized names of the modules built into the kernel release below root
+func readBuiltinModules(root, release string) []string {
+	content, err := os.ReadFile(filepath.Join(root, PATH_LIB_MODULES, release, "modules.builtin"))
+	if err != nil {
+		return nil
+	}
+	modules := []string{}
+	for _, line := range strings.Fields(string(content)) {
+		modules = append(modules, normalizeModuleName(line))
+	}
+	return modules
+}
+
+// kernelModules returns the modules that can drive the device with the modalias, marking the built in ones
+func kernelModules(aliases []moduleAlias, builtin []string, modalias string) []KernelModule {
+	modules := []KernelModule{}
+	for _, name := range matchModules(aliases, modalias) {
+		modules = append(modules, KernelModule{Name: name, Builtin: slices.Contains(builtin, normalizeModuleName(name))})
+	}
+	return modules
+}
+
+// kernelModuleNames returns the names of the modules, the way lspci -k shows them
+func kernelModuleNames(modules []KernelModule) string {
+	names := make([]string, 0, len(modules))
+	for _, module := range modules {
+		names = append(names, module.Name)
+	}
+	return strings.Join(names, ", ")
+}
+
+// matchModules returns the modules whose alias matches the modalias, in modules.alias order
+func matchModules(aliases []moduleAlias, modalias string) []string {
+	modules := []string{}
+	for _, alias := range aliases {
+		if matched, _ := path.Match(alias.Pattern, modalias); matched && !slices.Contains(modules, alias.Module) {
+			modules = append(modules, alias.Module)
+		}
+	}
+	return modules
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// TestMatchModules tests matching a modalias against modules.alias globs
+func TestMatchModules(t *testing.T) {
+	aliases := []moduleAlias{
+		{"pci:v000010DEd*sv*sd*bc03sc00i00*", "nouveau"},
+		{"pci:v000010DEd*sv*sd*bc03sc00i00*", "nvidia"},
+		{"pci:v*d*sv*sd*bc04sc03i00*", "snd_hda_intel"},
+		{"pci:v000010DEd00002882sv*sd*bc*sc*i*", "nouveau"},
+		{"pci:v00001002d*sv*sd*bc03sc0[0-2]i00*", "amdgpu"},
+	}
+	testCases := []struct {
+		name     string
+		modalias string
+		expected []string
+	}{
+		{"NvidiaVga", "pci:v000010DEd00002882sv00001458sd00004110bc03sc00i00", []string{"nouveau", "nvidia"}},
+		{"NvidiaAudio", "pci:v000010DEd000022BEsv00001458sd00004110bc04sc03i00", []string{"snd_hda_intel"}},
+		{"AmdDisplay", "pci:v00001002d000073BFsv00001458sd00002322bc03sc02i00", []string{"amdgpu"}},
+		{"NoMatch", "pci:v00001AF4d00001041sv00001AF4sd00001041bc02sc00i00", []string{}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if actual := matchModules(aliases, tc.modalias); !reflect.DeepEqual(actual, tc.expected) {
+				t.Errorf("matchModules() got = %v, expected %v", actual, tc.expected)
+			}
+		})
+	}
+}
+
+// TestKernelModules tests resolving modules from modules.alias and modules.builtin.modinfo, marking built in ones
+func TestKernelModules(t *testing.T) {
+	root := t.TempDir()
+	dir := filepath.Join(PATH_LIB_MODULES, "6.6.0")
+	writeTestFile(t, root, filepath.Join(dir, "modules.alias"),
+		"# Aliases extracted from modules themselves.\n"+
+			"alias pci:v000010DEd*sv*sd*bc03sc00i00* nouveau\n"+
+			"alias usb:v*p*d*dc*dsc*dp*ic09isc*ip*in* hub\n"+
+			"alias pci:v000010DEd*sv*sd*bc03sc00i00* nvidia\n")
+	writeTestFile(t, root, filepath.Join(dir, "modules.builtin.modinfo"),
+		"vfio_pci.alias=vfio_pci:v*d*sv*sd*bc*sc*i*\x00vfio_pci.license=GPL v2\x00efifb.alias=pci:v*d*sv*sd*bc03sc00i*\x00")
+	writeTestFile(t, root, filepath.Join(dir, "modules.builtin"), "kernel/drivers/video/fbdev/efifb.ko\nkernel/drivers/vfio/pci/vfio-pci.ko\n")
+
+	aliases, err := readModulesAlias(root, "6.6.0")
+	if err != nil {
+		t.Fatalf("readModulesAlias() error = %v", err)
+	}
+	modules := kernelModules(aliases, readBuiltinModules(root, "6.6.0"), "pci:v000010DEd00002882sv00001458sd00004110bc03sc00i00")
+	expected := []KernelModule{{Name: "nouveau"}, {Name: "nvidia"}, {Name: "efifb", Builtin: true}}
+	if !reflect.DeepEqual(modules, expected) {
+		t.Errorf("kernelModules() got = %v, expected %v", modules, expected)
+	}
+	if names := kernelModuleNames(modules); names != "nouveau, nvidia, efifb" {
+		t.Errorf("kernelModuleNames() got = %q", names)
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/rs/zerolog"
+)
+
+const (
+	PATH_UDEV_VFIO_RULES = "/etc/udev/rules.d/90-auto-vfio.rules"
+	PATH_DRIVERCTL_D     = "/etc/driverctl.d"
+
+	PersistBackendUdev      = "udev"
+	PersistBackendDriverctl = "driverctl"
+)
+
+var udevKernelsRegex = regexp.MustCompile(`KERNELS=="([^"]+)"`)
+
+// sharesIdWithHostDevice reports whether a present device outside the given ones, not bound to vfio-pci,
+// has the vendor:device id of one of them. Such a device would also be claimed by an id based binding
+func sharesIdWithHostDevice(root string, devices []persistedDevice) bool {
+	devicesPath := filepath.Join(root, PATH_SYS_BUS_PCI_DEVICES)
+	entries, err := os.ReadDir(devicesPath)
+	if err != nil {
+		return false
+	}
+	for _, entry := range entries {
+		if slices.ContainsFunc(devices, func(dev persistedDevice) bool { return dev.Bus == entry.Name() }) {
+			continue
+		}
+		id, err := readVendorDeviceIdFrom(devicesPath, entry.Name())
+		if err != nil || !slices.ContainsFunc(devices, func(dev persistedDevice) bool { return dev.ID == id }) {
+			continue
+		}
+		driver, _ := os.Readlink(filepath.Join(devicesPath, entry.Name(), "driver"))
+		if filepath.Base(driver) != "vfio-pci" {
+			return true
+		}
+	}
+	return false
+}
+
+// detectAddressBackend prefers driverctl when it is installed on the live system
+func detectAddressBackend(root string) string {
+	if _, err := exec.LookPath("driverctl"); err == nil && root == "/" {
+		return PersistBackendDriverctl
+	}
+	return PersistBackendUdev
+}
+
+// overridesFor returns the bus addresses of the devices, and of the present devices matching their ids when they have no bus address
+func overridesFor(root string, devices []persistedDevice, persisted []string) []string {
+	buses := []string{}
+	devicesPath := filepath.Join(root, PATH_SYS_BUS_PCI_DEVICES)
+	for _, dev := range devices {
+		if dev.Bus != "" {
+			buses = mergeIds(buses, dev.Bus)
+			continue
+		}
+		for _, bus := range persisted {
+			if id, err := readVendorDeviceIdFrom(devicesPath, bus); err == nil && id == dev.ID {
+				buses = mergeIds(buses, bus)
+			}
+		}
+	}
+	return buses
+}
+
+// udevBackend pins devices by bus address with udev rules setting driver_override
+type udevBackend struct {
+	root string
+}
+
+func (b *udevBackend) Name() string {
+	return PersistBackendUdev
+}
+
+func (b *udevBackend) path() string {
+	return filepath.Join(b.root, PATH_UDEV_VFIO_RULES)
+}
+
+// buses returns the bus addresses that have a rule
+func (b *udevBackend) buses() ([]string, error) {
+	content, err := os.ReadFile(b.path())
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	buses := []string{}
+	for _, m := range udevKernelsRegex.FindAllStringSubmatch(string(content), -1) {
+		buses = mergeIds(buses, m[1])
+	}
+	return buses, nil
+}
+
+// write replaces the managed rules file with rules for the buses, removing it when there are none
+func (b *udevBackend) write(buses []string) error {
+	if len(buses) == 0 {
+		if err := os.Remove(b.path()); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+	slices.SortFunc(buses, NaturalCompare)
+	var content strings.Builder
+	content.WriteString("# Managed by auto-vfio. Binds devices to vfio-pci by bus address\n")
+	for _, bus := range buses {
+		fmt.Fprintf(&content, "ACTION==\"add\", SUBSYSTEM==\"pci\", KERNELS==\"%s\", ATTR{driver_override}=\"vfio-pci\"\n", bus)
+	}
+	return writeFileAtomic(b.path(), []byte(content.String()), 0644)
+}
+
+func (b *udevBackend) Persist(log *zerolog.Logger, devices []persistedDevice) error {
+	buses, err := b.buses()
+	if err != nil {
+		return err
+	}
+	updated := slices.Clone(buses)
+	for _, dev := range devices {
+		if dev.Bus == "" {
+			return fmt.Errorf("the %s backend needs the bus address of %s", b.Name(), dev.ID)
+		}
+		updated = mergeIds(updated, dev.Bus)
+	}
+	if len(updated) == len(buses) {
+		return nil
+	}
+	return b.write(updated)
+}
+
+func (b *udevBackend) Unpersist(log *zerolog.Logger, devices []persistedDevice) error {
+	buses, err := b.buses()
+	if err != nil {
+		return err
+	}
+	remove := overridesFor(b.root, devices, buses)
+	updated := slices.DeleteFunc(slices.Clone(buses), func(bus string) bool { return slices.Contains(remove, bus) })
+	if len(updated) == len(buses) {
+		return nil
+	}
+	return b.write(updated)
+}
+
+func (b *udevBackend) RegenerateCommand() string {
+	return "udevadm control --reload"
+}
+
+// driverctlBackend pins devices by bus address with driverctl compatible overrides in /etc/driverctl.d
+type driverctlBackend struct {
+	root string
+}
+
+func (b *driverctlBackend) Name() string {
+	return PersistBackendDriverctl
+}
+
+// path returns the override file of the device, named like driverctl does
+func (b *driverctlBackend) path(bus string) string {
+	return filepath.Join(b.root, PATH_DRIVERCTL_D, "pci-"+bus)
+}
+
+// buses returns the bus addresses overridden to vfio-pci
+func (b *driverctlBackend) buses() ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(b.root, PATH_DRIVERCTL_D, "pci-*"))
+	if err != nil {
+		return nil, err
+	}
+	buses := []string{}
+	for _, file := range files {
+		driver, err := os.ReadFile(file)
+		if err == nil && strings.TrimSpace(string(driver)) == "vfio-pci" {
+			buses = append(buses, strings.TrimPrefix(filepath.Base(file), "pci-"))
+		}
+	}
+	return buses, nil
+}
+
+func (b *driverctlBackend) Persist(log *zerolog.Logger, devices []persistedDevice) error {
+	for _, dev := range devices {
+		if dev.Bus == "" {
+			return fmt.Errorf("the %s backend needs the bus address of %s", b.Name(), dev.ID)
+		}
+		if err := writeFileAtomic(b.path(dev.Bus), []byte("vfio-pci\n"), 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *driverctlBackend) Unpersist(log *zerolog.Logger, devices []persistedDevice) error {
+	buses, err := b.buses()
+	if err != nil {
+		return err
+	}
+	for _, bus := range overridesFor(b.root, devices, buses) {
+		if !slices.Contains(buses, bus) {
+			continue
+		}
+		if err := os.Remove(b.path(bus)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *driverctlBackend) RegenerateCommand() string {
+	return ""
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rs/zerolog"
+)
+
+// writeTestDevice writes the vendor and device ids of a device below root
+func writeTestDevice(t *testing.T, root, bus, vendor, device string) {
+	t.Helper()
+	writeTestFile(t, root, filepath.Join(PATH_SYS_BUS_PCI_DEVICES, bus, "vendor"), "0x"+vendor+"\n")
+	writeTestFile(t, root, filepath.Join(PATH_SYS_BUS_PCI_DEVICES, bus, "device"), "0x"+device+"\n")
+}
+
+// TestSharesIdWithHostDevice tests detecting identical devices that stay on the host
+func TestSharesIdWithHostDevice(t *testing.T) {
+	root := t.TempDir()
+	writeTestDevice(t, root, "0000:07:00.0", "10de", "2882")
+	writeTestDevice(t, root, "0000:08:00.0", "10de", "2882")
+	writeTestDevice(t, root, "0000:09:00.0", "1002", "73bf")
+
+	if !sharesIdWithHostDevice(root, []persistedDevice{{Bus: "0000:07:00.0", ID: "10de:2882"}}) {
+		t.Errorf("expected 0000:08:00.0 to share the id of 0000:07:00.0")
+	}
+	if sharesIdWithHostDevice(root, []persistedDevice{{Bus: "0000:07:00.0", ID: "10de:2882"}, {Bus: "0000:08:00.0", ID: "10de:2882"}}) {
+		t.Errorf("expected no host device to share the id when both identical devices are persisted")
+	}
+	if sharesIdWithHostDevice(root, []persistedDevice{{Bus: "0000:09:00.0", ID: "1002:73bf"}}) {
+		t.Errorf("expected no host device to share the id of 0000:09:00.0")
+	}
+}
+
+// TestAddressBackends tests persisting and unpersisting by bus address
+func TestAddressBackends(t *testing.T) {
+	testCases := []struct {
+		name     string
+		file     string
+		expected string
+	}{
+		{PersistBackendUdev, PATH_UDEV_VFIO_RULES, "# Managed by auto-vfio. Binds devices to vfio-pci by bus address\n" +
+			"ACTION==\"add\", SUBSYSTEM==\"pci\", KERNELS==\"0000:07:00.0\", ATTR{driver_override}=\"vfio-pci\"\n" +
+			"ACTION==\"add\", SUBSYSTEM==\"pci\", KERNELS==\"0000:07:00.1\", ATTR{driver_override}=\"vfio-pci\"\n"},
+		{PersistBackendDriverctl, filepath.Join(PATH_DRIVERCTL_D, "pci-0000:07:00.0"), "vfio-pci\n"},
+	}
+	log := zerolog.Nop()
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			root := t.TempDir()
+			writeTestDevice(t, root, "0000:07:00.0", "10de", "2882")
+			writeTestDevice(t, root, "0000:07:00.1", "10de", "22be")
+			backend, err := newPersistBackend(tc.name, root, nil)
+			if err != nil {
+				t.Fatalf("newPersistBackend() error = %v", err)
+			}
+
+			devices := []persistedDevice{{Bus: "0000:07:00.1", ID: "10de:22be"}, {Bus: "0000:07:00.0", ID: "10de:2882"}}
+			if err := backend.Persist(&log, devices); err != nil {
+				t.Fatalf("Persist() error = %v", err)
+			}
+			if actual := readTestFile(t, root, tc.file); actual != tc.expected {
+				t.Errorf("Persist() got = %q, expected %q", actual, tc.expected)
+			}
+
+			// Unpersist by id resolves the bus address from the present devices
+			if err := backend.Unpersist(&log, []persistedDevice{{ID: "10de:2882"}, {Bus: "0000:07:00.1"}}); err != nil {
+				t.Fatalf("Unpersist() error = %v", err)
+			}
+			if _, err := os.Stat(filepath.Join(root, tc.file)); !os.IsNotExist(err) {
+				t.Errorf("expected %s to be removed, got %v", tc.file, err)
+			}
+		})
+	}
+}
@@ -5,6 +5,7 @@ package main
 import (
 	"bufio"
 	"embed"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"os"
@@ -16,6 +17,9 @@ import (
 const (
 	PATH_SYS_BUS_PCI_DEVICES = "/sys/bus/pci/devices"
 	PATH_SYS_DEVICES_PCI     = "/sys/devices/pci"
+
+	// pciExtCapIdDsn is the id of the Device Serial Number extended capability
+	pciExtCapIdDsn = 0x0003
 )
 
 //go:embed pci.ids
@@ -24,22 +28,43 @@ var pciIDs embed.FS
 var nonWhitespaceRegex = regexp.MustCompile(`[\S]+`)
 
 type PciDevice struct {
-	Bus               string
-	VendorID          string
-	DeviceID          string
-	Class             string
-	SubsysVendor      string
-	SubsysDevice      string
-	Irq               string
-	Revision          string
-	VendorName        string
-	DeviceName        string
-	DeviceClass       string
-	Subsystem         string
+	Bus          string
+	VendorID     string
+	DeviceID     string
+	Class        string
+	ProgIf       string
+	SubsysVendor string
+	SubsysDevice string
+	Irq          string
+	Revision     string
+	VendorName   string
+	DeviceName   string
+	DeviceClass  string
+	Subsystem    string
+	// KernelModule lists the modules that can drive the device, like the Kernel modules: line of lspci -k
 	KernelModule      string
+	KernelModules     []KernelModule
 	KernelModuleAlias string
 	KernelDriver      string
 	IommuGroup        string
+	PowerState        string
+	RuntimeStatus     string
+	PowerControl      string
+	D3ColdAllowed     string
+	// NumaNode is the NUMA node of the device, -1 without NUMA
+	NumaNode string
+	// LocalCpuList and LocalCpus are the CPUs local to the device, as a list like 0-7,16-23 and as a mask
+	LocalCpuList string
+	LocalCpus    string
+	// LinkSpeed and LinkWidth are the negotiated PCIe link, e.g. 16.0 GT/s PCIe and 16
+	LinkSpeed    string
+	LinkWidth    string
+	MaxLinkSpeed string
+	MaxLinkWidth string
+	// ResetMethod lists the reset methods the kernel will try, e.g. flr bus
+	ResetMethod string
+	// SerialNumber is the PCIe Device Serial Number, like lspci -vv. Only root can read it
+	SerialNumber string
 }
 
 func readFromFile(f string, w, start, end int) (string, error) {
@@ -80,15 +105,30 @@ func readFromFile(f string, w, start, end int) (string, error) {
 }
 
 func ParsePciDevices() (pciDevices []PciDevice, err error) {
+	return parsePciDevices("/")
+}
+
+// parsePciDevices parses the devices of the sysfs, kernel modules and pci.ids below root
+func parsePciDevices(root string) (pciDevices []PciDevice, err error) {
 	var devices []string
 	var path string
+	devicesPath := filepath.Join(root, PATH_SYS_BUS_PCI_DEVICES)
 
 	read := func(bus, filename string, start, end int) (string, error) {
-		return readFromFile(filepath.Join(PATH_SYS_BUS_PCI_DEVICES, bus, filename), 1, start, end)
+		return readFromFile(filepath.Join(devicesPath, bus, filename), 1, start, end)
+	}
+
+	// readOptional returns the trimmed content of an attribute that older kernels or some devices lack
+	readOptional := func(bus, filename string) string {
+		value, err := os.ReadFile(filepath.Join(devicesPath, bus, filename))
+		if err != nil {
+			return ""
+		}
+		return strings.TrimSpace(string(value))
 	}
 
 	lookupKernelDriver := func(bus string) (string, error) {
-		path = filepath.Join(PATH_SYS_BUS_PCI_DEVICES, bus, "uevent")
+		path = filepath.Join(devicesPath, bus, "uevent")
 		read, err := readFromFile(path, 1, 0, 0)
 		if err != nil {
 			return "", err
@@ -101,7 +141,7 @@ func ParsePciDevices() (pciDevices []PciDevice, err error) {
 
 	// Find all devices in /sys/bus/pci/devices/ and append each device to devices[]
 	if err = filepath.Walk(
-		PATH_SYS_BUS_PCI_DEVICES,
+		devicesPath,
 		func(path string, info os.FileInfo, err error) error {
 			if !info.IsDir() {
 				devices = append(devices, info.Name())
@@ -109,10 +149,20 @@ func ParsePciDevices() (pciDevices []PciDevice, err error) {
 			return nil
 		}); err != nil {
 
-		err = fmt.Errorf("failed to walk %s: %w", PATH_SYS_BUS_PCI_DEVICES, err)
+		err = fmt.Errorf("failed to walk %s: %w", devicesPath, err)
 		return pciDevices, err
 	}
 
+	db, err := pciIdsAt(root)
+	if err != nil {
+		return pciDevices, fmt.Errorf("failed to load pci.ids: %w", err)
+	}
+
+	// Modules are resolved from modalias only when the module indexes of the running kernel are present
+	release := kernelRelease(root)
+	aliases, _ := readModulesAlias(root, release)
+	builtin := readBuiltinModules(root, release)
+
 	var errs []error
 	// Iterate over each bus and parse & append values to PciDevices[]
 	for _, bus := range devices {
@@ -174,15 +224,20 @@ func ParsePciDevices() (pciDevices []PciDevice, err error) {
 			continue
 		}
 
-		venName, _ = Lookup("vendor", ven, "", "", "")
-		devName, _ = Lookup("device", ven, dev, "", "")
-		devClass, _ = Lookup("class", "", "", class, "")
+		names := db.Names(ven, dev, class, subVen, subDev)
+		venName, devName, devClass, subSys = names.Vendor, names.Device, names.Class, names.Subsystem
 
-		if subVen != "0000" {
-			subSys, _ = Lookup("subsystem", ven, "", "", subDev)
+		modules := kernelModules(aliases, builtin, mod)
+
+		progIf := ""
+		if classCode := strings.TrimPrefix(readOptional(bus, "class"), "0x"); len(classCode) == 6 {
+			progIf = classCode[4:]
 		}
 
-		ln, _ := os.Readlink(filepath.Join(PATH_SYS_BUS_PCI_DEVICES, bus, "iommu_group"))
+		// Unprivileged reads stop at the first 64 bytes of the config space
+		config, _ := os.ReadFile(filepath.Join(devicesPath, bus, "config"))
+
+		ln, _ := os.Readlink(filepath.Join(devicesPath, bus, "iommu_group"))
 		if len(ln) > 0 {
 			g := strings.Split(ln, "/")
 			iommuGroup = g[len(g)-1]
@@ -190,9 +245,37 @@ func ParsePciDevices() (pciDevices []PciDevice, err error) {
 
 		pciDevices = append(pciDevices,
 			PciDevice{
-				bus, ven, dev, class, subVen, subDev, irq, rev,
-				venName, devName, devClass, subSys, "", mod, kernelDriver,
-				iommuGroup,
+				Bus:               bus,
+				VendorID:          ven,
+				DeviceID:          dev,
+				Class:             class,
+				ProgIf:            progIf,
+				SubsysVendor:      subVen,
+				SubsysDevice:      subDev,
+				Irq:               irq,
+				Revision:          rev,
+				VendorName:        venName,
+				DeviceName:        devName,
+				DeviceClass:       devClass,
+				Subsystem:         subSys,
+				KernelModule:      kernelModuleNames(modules),
+				KernelModules:     modules,
+				KernelModuleAlias: mod,
+				KernelDriver:      kernelDriver,
+				IommuGroup:        iommuGroup,
+				PowerState:        readOptional(bus, "power_state"),
+				RuntimeStatus:     readOptional(bus, "power/runtime_status"),
+				PowerControl:      readOptional(bus, "power/control"),
+				D3ColdAllowed:     readOptional(bus, "d3cold_allowed"),
+				NumaNode:          readOptional(bus, "numa_node"),
+				LocalCpuList:      readOptional(bus, "local_cpulist"),
+				LocalCpus:         readOptional(bus, "local_cpus"),
+				LinkSpeed:         readOptional(bus, "current_link_speed"),
+				LinkWidth:         readOptional(bus, "current_link_width"),
+				MaxLinkSpeed:      readOptional(bus, "max_link_speed"),
+				MaxLinkWidth:      readOptional(bus, "max_link_width"),
+				ResetMethod:       readOptional(bus, "reset_method"),
+				SerialNumber:      deviceSerialNumber(config),
 			},
 		)
 	}
@@ -204,46 +287,43 @@ func ParsePciDevices() (pciDevices []PciDevice, err error) {
 	return pciDevices, err
 }
 
-func Lookup(searchType, ven, dev, class, subclass string) (string, error) {
-	var found bool = false
-
-	// Open pci.ids
-	f, _ := pciIDs.Open("pci.ids")
-	// close pci.ids file when done
-	defer f.Close()
-
-	scanner := bufio.NewScanner(f)
-	for scanner.Scan() {
-		switch searchType {
-		case "vendor": // Return first occurrence of ven that does not have a \t prefix.
-			if strings.Contains(scanner.Text(), ven) && !strings.HasPrefix(scanner.Text(), "\t") {
-				return strings.TrimLeft(scanner.Text(), ven+"  "), nil
-			}
-
-		case "device": // Return first occurrence of dev after vendor is found
-			if strings.Contains(scanner.Text(), ven) && !strings.HasPrefix(scanner.Text(), "\t") {
-				found = true
-			}
-			if strings.HasPrefix(scanner.Text(), "\t"+dev) && found {
-				return strings.TrimLeft(scanner.Text(), "\t\t"+dev+"  "), nil
-			}
-
-		case "class": // Split class (eg: 0600), search for "C 06" and return first occurrence of "\t\t00" thereafter.
-			if strings.Contains(scanner.Text(), "C"+" "+class[0:2]) && !strings.HasPrefix(scanner.Text(), "\t") {
-				found = true
-			}
-			if strings.HasPrefix(scanner.Text(), "\t"+class[2:4]) && found {
-				return strings.TrimLeft(scanner.Text(), "\t\t"+class+"  "), nil
-
-			}
-		case "subsystem": // Match and return line "\t\t vendor subsystem_device"
-			if strings.Contains(scanner.Text(), ven+" "+subclass) {
-				return strings.TrimLeft(scanner.Text(), "\t\t"+ven+" "+subclass), nil
-			}
+// deviceSerialNumber returns the Device Serial Number extended capability of a config space, formatted like lspci
+func deviceSerialNumber(config []byte) string {
+	// Extended capabilities start at 0x100, each header linking to the next one
+	for offset, hops := 0x100, 0; offset >= 0x100 && offset+12 <= len(config) && hops < 480; hops++ {
+		header := binary.LittleEndian.Uint32(config[offset:])
+		if header == 0 || header == 0xffffffff {
+			break
+		}
+		if header&0xffff == pciExtCapIdDsn {
+			serial := config[offset+4 : offset+12]
+			return fmt.Sprintf("%02x-%02x-%02x-%02x-%02x-%02x-%02x-%02x",
+				serial[7], serial[6], serial[5], serial[4], serial[3], serial[2], serial[1], serial[0])
 		}
+		offset = int(header >> 20)
 	}
-	if err := scanner.Err(); err != nil {
+	return ""
+}
+
+// Lookup returns a name from the embedded pci.ids. searchType is one of vendor (ven), device (ven, dev),
+// class (class as <class><subclass>) or subsystem (ven, dev and subclass as "<subvendor> <subdevice>")
+func Lookup(searchType, ven, dev, class, subclass string) (string, error) {
+	db, err := embeddedPciIds()
+	if err != nil {
 		return "", err
 	}
+	switch searchType {
+	case "vendor":
+		return db.Names(ven, "", "", "", "").Vendor, nil
+	case "device":
+		return db.Names(ven, dev, "", "", "").Device, nil
+	case "class":
+		return db.Names("", "", class, "", "").Class, nil
+	case "subsystem":
+		subVen, subDev, _ := strings.Cut(subclass, " ")
+		if name := db.Names(ven, dev, "", subVen, subDev).Subsystem; name != "" {
+			return name, nil
+		}
+	}
 	return "Unknown " + searchType, nil
 }
@@ -8,7 +8,15 @@ import (
 	"testing"
 )
 
-const mockBasePath = "mock/sys/bus/pci/devices"
+// extractTestSnapshot extracts a snapshot of testdata/snapshots and returns the root to read it from
+func extractTestSnapshot(t *testing.T, name string) string {
+	t.Helper()
+	root := t.TempDir()
+	if _, err := extractSnapshot(filepath.Join("testdata", "snapshots", name), root); err != nil {
+		t.Fatalf("extractSnapshot() error = %v", err)
+	}
+	return root
+}
 
 // TestReadFromFile tests the readFromFile function
 func TestReadFromFile(t *testing.T) {
@@ -19,12 +27,13 @@ func TestReadFromFile(t *testing.T) {
 		expected  string
 		expectErr bool
 	}{
-		{"ValidVendorFile", "0000:02:00.4", "vendor", "0x10ec", false},
-		{"ValidDeviceFile", "0000:02:00.4", "device", "0x816d", false},
+		{"ValidVendorFile", "0000:00:06.0", "vendor", "0x1af4", false},
+		{"ValidDeviceFile", "0000:00:06.0", "device", "0x1044", false},
 	}
+	devicesPath := filepath.Join(extractTestSnapshot(t, "virtio-vm.tar.gz"), PATH_SYS_BUS_PCI_DEVICES)
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
-			path := filepath.Join(mockBasePath, tc.device, tc.file)
+			path := filepath.Join(devicesPath, tc.device, tc.file)
 			content, err := os.ReadFile(path)
 			if err != nil {
 				if !tc.expectErr {
@@ -39,22 +48,22 @@ func TestReadFromFile(t *testing.T) {
 	}
 }
 
-// TestParsePciDevices tests the ParsePciDevices function
+// TestParsePciDevices tests the parsePciDevices function on the snapshot of a virtual machine
 func TestParsePciDevices(t *testing.T) {
-	devices, err := ParsePciDevices()
+	devices, err := parsePciDevices(extractTestSnapshot(t, "virtio-vm.tar.gz"))
 	if err != nil {
-		t.Fatalf("ParsePciDevices() error = %v", err)
+		t.Fatalf("parsePciDevices() error = %v", err)
 	}
 
-	expectedNumberOfDevices := 29 // Example value for current mock data, adjust accordingly when this breaks :)
+	expectedNumberOfDevices := 7
 	if len(devices) != expectedNumberOfDevices {
 		t.Errorf("Expected %d devices, got %d", expectedNumberOfDevices, len(devices))
 	}
 
 	// Detailed test for a specific device
 	for _, device := range devices {
-		if device.Bus == "0000:02:00.4" {
-			if device.VendorID != "10ec" || device.DeviceID != "816d" {
+		if device.Bus == "0000:00:06.0" {
+			if device.VendorID != "1af4" || device.DeviceID != "1044" || device.KernelDriver != "virtio-pci" {
 				t.Errorf("Incorrect Vendor or Device ID for %s", device.Bus)
 			}
 		}
@@ -75,7 +84,13 @@ func TestLookup(t *testing.T) {
 	}{
 		{"VendorLookup", "vendor", "1022", "", "", "", "Advanced Micro Devices, Inc. [AMD]", false},
 		{"DeviceLookup", "device", "1022", "1630", "", "", "Renoir/Cezanne Root Complex", false},
-		// TODO: add more
+		{"ClassLookup", "class", "", "", "0300", "", "VGA compatible controller", false},
+		{"ClassFallback", "class", "", "", "03ff", "", "Display controller", false},
+		{"SubsystemLookup", "subsystem", "10de", "0041", "", "1458 310f", "Geforce 6800 GV-N6812", false},
+		{"SubsystemFallback", "subsystem", "10de", "2882", "", "1458 4116", "Gigabyte Technology Co., Ltd Device 4116", false},
+		{"VendorNameStartingWithId", "vendor", "10b7", "", "", "", "3Com Corporation", false},
+		{"UnknownVendor", "vendor", "0bad", "", "", "", "Unknown vendor", false},
+		{"DeviceOfOtherVendor", "device", "1af4", "1630", "", "", "Unknown device", false},
 	}
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
@@ -93,7 +108,7 @@ func TestLookup(t *testing.T) {
 
 // TestErrorHandling tests error handling in readFromFile
 func TestErrorHandling(t *testing.T) {
-	_, err := os.ReadFile(filepath.Join(mockBasePath, "invalid", "vendor"))
+	_, err := os.ReadFile(filepath.Join(extractTestSnapshot(t, "virtio-vm.tar.gz"), PATH_SYS_BUS_PCI_DEVICES, "invalid", "vendor"))
 	if !errors.Is(err, os.ErrNotExist) {
 		t.Errorf("Expected os.ErrNotExist, got %v", err)
 	}
@@ -0,0 +1,443 @@
+package main
+
+import (
+	"bufio"
+	"cmp"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/rs/zerolog"
+)
+
+const (
+	// PATH_PCI_IDS_LOCAL holds custom names, e.g. of in-house hardware, overriding the database ones
+	PATH_PCI_IDS_LOCAL = "/etc/auto-vfio/pci.ids"
+
+	pciIdsEmbedded = "embedded"
+)
+
+// PATHS_PCI_IDS are the pci.ids of the distribution, as installed by hwdata or pciutils
+var PATHS_PCI_IDS = []string{"/usr/share/hwdata/pci.ids", "/usr/share/misc/pci.ids"}
+
+// pciIdsFile is the pci.ids given with --pci-ids
+var pciIdsFile string
+
+// pciIdsLog logs the problems of the pci.ids files that do not prevent loading a database
+var pciIdsLog = func() *zerolog.Logger {
+	log := zerolog.Nop()
+	return &log
+}()
+
+type pciDeviceKey struct {
+	Vendor, Device uint16
+}
+
+type pciSubsystemKey struct {
+	Vendor, Device, SubVendor, SubDevice uint16
+}
+
+type pciSubclassKey struct {
+	Class, Subclass uint8
+}
+
+type pciProgIfKey struct {
+	Class, Subclass, ProgIf uint8
+}
+
+// pciIdsDatabase is the parsed pci.ids, indexed by vendor → device → subvendor:subdevice and class → subclass → prog-if
+type pciIdsDatabase struct {
+	// Version is the Version: of the header comment
+	Version string
+	// Source is the file the database was read from, or embedded
+	Source string
+	// Override is the local override file merged into the database, if any
+	Override string
+	// InvalidLines counts the malformed lines skipped while parsing
+	InvalidLines int
+
+	vendors    map[uint16]string
+	devices    map[pciDeviceKey]string
+	subsystems map[pciSubsystemKey]string
+	classes    map[uint8]string
+	subclasses map[pciSubclassKey]string
+	progIfs    map[pciProgIfKey]string
+}
+
+// embeddedPciIds parses the embedded pci.ids once
+var embeddedPciIds = sync.OnceValues(func() (*pciIdsDatabase, error) {
+	f, err := pciIDs.Open("pci.ids")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	db, err := parsePciIds(f)
+	if err == nil {
+		db.Source = pciIdsEmbedded
+	}
+	return db, err
+})
+
+// loadedPciIds loads the newest database once, see loadPciIds
+var loadedPciIds = sync.OnceValues(func() (*pciIdsDatabase, error) {
+	return loadPciIds("/", pciIdsFile)
+})
+
+// loadPciIds loads the newest by Version: of the given file, the system pci.ids below root and the embedded one,
+// then merges the local override file into it
+func loadPciIds(root, file string) (*pciIdsDatabase, error) {
+	type candidate struct {
+		file, version string
+	}
+	candidates := []candidate{}
+	files := []string{}
+	if file != "" {
+		files = append(files, file)
+	}
+	for _, path := range PATHS_PCI_IDS {
+		files = append(files, filepath.Join(root, path))
+	}
+	for _, file := range files {
+		f, err := os.Open(file)
+		if err != nil {
+			continue
+		}
+		candidates = append(candidates, candidate{file, readPciIdsVersion(f)})
+		f.Close()
+	}
+	if embedded, err := pciIDs.Open("pci.ids"); err == nil {
+		candidates = append(candidates, candidate{pciIdsEmbedded, readPciIdsVersion(embedded)})
+		embedded.Close()
+	}
+	// Newest first, keeping the given file first among equal versions
+	slices.SortStableFunc(candidates, func(a, b candidate) int {
+		return cmp.Compare(b.version, a.version)
+	})
+
+	var db *pciIdsDatabase
+	var errs []error
+	for _, c := range candidates {
+		var err error
+		if c.file == pciIdsEmbedded {
+			db, err = embeddedPciIds()
+		} else {
+			db, err = parsePciIdsFile(c.file)
+		}
+		if err == nil {
+			break
+		}
+		db = nil
+		errs = append(errs, fmt.Errorf("failed to parse %s: %w", c.file, err))
+	}
+	if db == nil {
+		return nil, errors.Join(errs...)
+	}
+
+	override := filepath.Join(root, PATH_PCI_IDS_LOCAL)
+	if _, err := os.Stat(override); err != nil {
+		return db, nil
+	}
+	custom, err := parsePciIdsFile(override)
+	if err != nil {
+		pciIdsLog.Warn().Err(err).Msgf("Ignoring the custom names of %s", override)
+		return db, nil
+	}
+	return db.merge(custom, override), nil
+}
+
+// pciIdsAt returns the database of this host for root "/", else the newest below root, e.g. in a snapshot
+func pciIdsAt(root string) (*pciIdsDatabase, error) {
+	if root == "/" {
+		return loadedPciIds()
+	}
+	return loadPciIds(root, pciIdsFile)
+}
+
+// parsePciIdsFile parses a pci.ids file
+func parsePciIdsFile(file string) (*pciIdsDatabase, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	db, err := parsePciIds(f)
+	if err == nil {
+		db.Source = file
+	}
+	return db, err
+}
+
+// readPciIdsVersion returns the Version: of the header comment, e.g. 2024.09.20
+func readPciIdsVersion(r io.Reader) string {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			break
+		}
+		if version, found := pciIdsVersionComment(line); found {
+			return version
+		}
+	}
+	return ""
+}
+
+// pciIdsVersionComment returns the version of a "#\tVersion: 2024.09.20" comment line
+func pciIdsVersionComment(line string) (string, bool) {
+	version, found := strings.CutPrefix(strings.TrimSpace(strings.TrimPrefix(line, "#")), "Version:")
+	return strings.TrimSpace(version), found
+}
+
+// String describes the database, e.g. 2024.09.20 (/usr/share/hwdata/pci.ids, override /etc/auto-vfio/pci.ids)
+func (db *pciIdsDatabase) String() string {
+	details := []string{db.Source}
+	if db.Override != "" {
+		details = append(details, "override "+db.Override)
+	}
+	if db.InvalidLines > 0 {
+		details = append(details, fmt.Sprintf("%d invalid lines skipped", db.InvalidLines))
+	}
+	return fmt.Sprintf("%s (%s)", cmp.Or(db.Version, "unknown version"), strings.Join(details, ", "))
+}
+
+// merge returns a copy of the database with the names of the override database replacing or adding to its own
+func (db *pciIdsDatabase) merge(override *pciIdsDatabase, file string) *pciIdsDatabase {
+	merged := &pciIdsDatabase{
+		Version:      db.Version,
+		Source:       db.Source,
+		Override:     file,
+		InvalidLines: db.InvalidLines + override.InvalidLines,
+		vendors:      maps.Clone(db.vendors),
+		devices:      maps.Clone(db.devices),
+		subsystems:   maps.Clone(db.subsystems),
+		classes:      maps.Clone(db.classes),
+		subclasses:   maps.Clone(db.subclasses),
+		progIfs:      maps.Clone(db.progIfs),
+	}
+	maps.Copy(merged.vendors, override.vendors)
+	maps.Copy(merged.devices, override.devices)
+	maps.Copy(merged.subsystems, override.subsystems)
+	maps.Copy(merged.classes, override.classes)
+	maps.Copy(merged.subclasses, override.subclasses)
+	maps.Copy(merged.progIfs, override.progIfs)
+	return merged
+}
+
+// parsePciIds parses a database in the pci.ids format
+func parsePciIds(r io.Reader) (*pciIdsDatabase, error) {
+	db := &pciIdsDatabase{
+		vendors:    map[uint16]string{},
+		devices:    map[pciDeviceKey]string{},
+		subsystems: map[pciSubsystemKey]string{},
+		classes:    map[uint8]string{},
+		subclasses: map[pciSubclassKey]string{},
+		progIfs:    map[pciProgIfKey]string{},
+	}
+
+	var (
+		inClass                           bool
+		vendor, device                    uint16
+		class, subclass                   uint8
+		hasParent, hasDevice, hasSubclass bool
+		lineNumber                        int
+	)
+	// invalid skips a malformed line. The lines nested below it are skipped as well, rather than given to its parent
+	invalid := func(depth int) {
+		db.InvalidLines++
+		switch depth {
+		case 0:
+			hasParent = false
+		case 1:
+			hasDevice, hasSubclass = false, false
+		}
+	}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		lineNumber++
+		line := scanner.Text()
+		if trimmed := strings.TrimSpace(line); trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			if version, found := pciIdsVersionComment(trimmed); found && db.Version == "" {
+				db.Version = version
+			}
+			continue
+		}
+		depth := len(line) - len(strings.TrimLeft(line, "\t"))
+		id, name, found := strings.Cut(line[depth:], "  ")
+		if !found {
+			invalid(depth)
+			continue
+		}
+
+		switch {
+		case depth == 0 && strings.HasPrefix(id, "C "):
+			value, err := strconv.ParseUint(id[2:], 16, 8)
+			if err != nil {
+				invalid(depth)
+				continue
+			}
+			inClass, hasParent, hasSubclass = true, true, false
+			class = uint8(value)
+			db.classes[class] = name
+		case depth == 0 && len(id) == 4:
+			value, err := strconv.ParseUint(id, 16, 16)
+			if err != nil {
+				invalid(depth)
+				continue
+			}
+			inClass, hasParent, hasDevice = false, true, false
+			vendor = uint16(value)
+			db.vendors[vendor] = name
+		case depth == 0:
+			// Other lists (e.g. "X" for device classes of other buses) are ignored
+			inClass, hasParent = false, false
+		case !hasParent:
+			continue
+		case inClass && depth == 1:
+			value, err := strconv.ParseUint(id, 16, 8)
+			if err != nil {
+				invalid(depth)
+				continue
+			}
+			hasSubclass = true
+			subclass = uint8(value)
+			db.subclasses[pciSubclassKey{class, subclass}] = name
+		case inClass && depth == 2 && hasSubclass:
+			value, err := strconv.ParseUint(id, 16, 8)
+			if err != nil {
+				invalid(depth)
+				continue
+			}
+			db.progIfs[pciProgIfKey{class, subclass, uint8(value)}] = name
+		case !inClass && depth == 1:
+			value, err := strconv.ParseUint(id, 16, 16)
+			if err != nil {
+				invalid(depth)
+				continue
+			}
+			hasDevice = true
+			device = uint16(value)
+			db.devices[pciDeviceKey{vendor, device}] = name
+		case !inClass && depth == 2 && hasDevice:
+			subVendor, subDevice, found := strings.Cut(id, " ")
+			subVendorValue, err1 := strconv.ParseUint(subVendor, 16, 16)
+			subDeviceValue, err2 := strconv.ParseUint(subDevice, 16, 16)
+			if !found || err1 != nil || err2 != nil {
+				invalid(depth)
+				continue
+			}
+			db.subsystems[pciSubsystemKey{vendor, device, uint16(subVendorValue), uint16(subDeviceValue)}] = name
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if db.InvalidLines > 0 && len(db.vendors) == 0 && len(db.classes) == 0 {
+		return nil, fmt.Errorf("no valid pci.ids lines, %d invalid of %d", db.InvalidLines, lineNumber)
+	}
+	return db, nil
+}
+
+// parseHexId parses a hex id like 10de or 0x10de
+func parseHexId(id string, bitSize int) (uint64, bool) {
+	value, err := strconv.ParseUint(strings.TrimPrefix(id, "0x"), 16, bitSize)
+	return value, err == nil
+}
+
+// Vendor returns the name of the vendor
+func (db *pciIdsDatabase) Vendor(vendor uint16) (string, bool) {
+	name, ok := db.vendors[vendor]
+	return name, ok
+}
+
+// Device returns the name of the device of the vendor
+func (db *pciIdsDatabase) Device(vendor, device uint16) (string, bool) {
+	name, ok := db.devices[pciDeviceKey{vendor, device}]
+	return name, ok
+}
+
+// Subsystem returns the name of the subvendor:subdevice of the device
+func (db *pciIdsDatabase) Subsystem(vendor, device, subVendor, subDevice uint16) (string, bool) {
+	name, ok := db.subsystems[pciSubsystemKey{vendor, device, subVendor, subDevice}]
+	return name, ok
+}
+
+// SubsystemName returns the name of the subsystem the way lspci does, a subsystem with the ids of its device
+// being named after the device
+func (db *pciIdsDatabase) SubsystemName(vendor, device, subVendor, subDevice uint16) (string, bool) {
+	if name, ok := db.Subsystem(vendor, device, subVendor, subDevice); ok {
+		return name, true
+	}
+	if vendor == subVendor && device == subDevice {
+		return db.Device(vendor, device)
+	}
+	return "", false
+}
+
+// Class returns the name of the class
+func (db *pciIdsDatabase) Class(class uint8) (string, bool) {
+	name, ok := db.classes[class]
+	return name, ok
+}
+
+// Subclass returns the name of the subclass of the class
+func (db *pciIdsDatabase) Subclass(class, subclass uint8) (string, bool) {
+	name, ok := db.subclasses[pciSubclassKey{class, subclass}]
+	return name, ok
+}
+
+// ProgIf returns the name of the programming interface of the subclass
+func (db *pciIdsDatabase) ProgIf(class, subclass, progIf uint8) (string, bool) {
+	name, ok := db.progIfs[pciProgIfKey{class, subclass, progIf}]
+	return name, ok
+}
+
+// pciNames are the names of a device, in the hex string form of sysfs without 0x
+type pciNames struct {
+	Vendor, Device, Class, Subsystem string
+}
+
+// Names resolves the names of a device the way lspci does: an unknown subclass falls back to its class
+// and an unknown subsystem to its subvendor
+func (db *pciIdsDatabase) Names(vendor, device, class, subVendor, subDevice string) pciNames {
+	names := pciNames{Vendor: "Unknown vendor", Device: "Unknown device", Class: "Unknown class"}
+	ven, venOk := parseHexId(vendor, 16)
+	dev, devOk := parseHexId(device, 16)
+	if venOk {
+		if name, ok := db.Vendor(uint16(ven)); ok {
+			names.Vendor = name
+		}
+		if name, ok := db.Device(uint16(ven), uint16(dev)); devOk && ok {
+			names.Device = name
+		}
+	}
+	// class is <class><subclass>, optionally followed by <prog-if>
+	if cls, ok := parseHexId(class[:min(len(class), 2)], 8); ok && len(class) >= 2 {
+		if name, ok := db.Class(uint8(cls)); ok {
+			names.Class = name
+		}
+		if sub, ok := parseHexId(class[2:min(len(class), 4)], 8); ok && len(class) >= 4 {
+			if name, ok := db.Subclass(uint8(cls), uint8(sub)); ok {
+				names.Class = name
+			}
+		}
+	}
+	subVen, subVenOk := parseHexId(subVendor, 16)
+	subDev, subDevOk := parseHexId(subDevice, 16)
+	if venOk && devOk && subVenOk && subDevOk && subVen != 0 {
+		if name, ok := db.SubsystemName(uint16(ven), uint16(dev), uint16(subVen), uint16(subDev)); ok {
+			names.Subsystem = name
+		} else if name, ok := db.Vendor(uint16(subVen)); ok {
+			names.Subsystem = fmt.Sprintf("%s Device %04x", name, subDev)
+		} else {
+			names.Subsystem = "Unknown subsystem"
+		}
+	}
+	return names
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/rs/zerolog"
+)
+
+const testPciIds = `#	Version: 2024.09.20
+# 10de in a comment
+1002  0xide Devices
+	1002  device with the vendor id
+10de  NVIDIA Corporation
+	2882  AD107 [GeForce RTX 4060]
+		1458 4116  GV-N4060WF2OC-8GD
+	22be  AD107 High Definition Audio Controller
+1458  Gigabyte Technology Co., Ltd
+C 03  Display controller
+	00  VGA compatible controller
+		00  VGA controller
+		01  8514 controller
+	02  3D controller
+C 04  Multimedia controller
+	03  Audio device
+`
+
+// TestParsePciIds tests the indexes and the cases the line scanning got wrong
+func TestParsePciIds(t *testing.T) {
+	db, err := parsePciIds(strings.NewReader(testPciIds))
+	if err != nil {
+		t.Fatalf("parsePciIds() error = %v", err)
+	}
+	testCases := []struct {
+		name     string
+		actual   pciNames
+		expected pciNames
+	}{
+		{
+			"Full",
+			db.Names("10de", "2882", "030000", "1458", "4116"),
+			pciNames{"NVIDIA Corporation", "AD107 [GeForce RTX 4060]", "VGA compatible controller", "GV-N4060WF2OC-8GD"},
+		},
+		{
+			"NameStartingWithIdCharacters",
+			db.Names("1002", "1002", "0302", "0000", "0000"),
+			pciNames{"0xide Devices", "device with the vendor id", "3D controller", ""},
+		},
+		{
+			"DeviceOfOtherVendor",
+			db.Names("1002", "2882", "0380", "1458", "5000"),
+			pciNames{"0xide Devices", "Unknown device", "Display controller", "Gigabyte Technology Co., Ltd Device 5000"},
+		},
+		{
+			"Unknown",
+			db.Names("0x1234", "0x5678", "ff00", "0xabcd", "0x0001"),
+			pciNames{"Unknown vendor", "Unknown device", "Unknown class", "Unknown subsystem"},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.actual != tc.expected {
+				t.Errorf("Names() got = %+v, expected %+v", tc.actual, tc.expected)
+			}
+		})
+	}
+	if name, _ := db.ProgIf(0x03, 0x00, 0x01); name != "8514 controller" {
+		t.Errorf("ProgIf() got = %q", name)
+	}
+	if _, err := parsePciIds(strings.NewReader("10de NVIDIA\n")); err == nil {
+		t.Errorf("parsePciIds() expected an error for a file without a valid line")
+	}
+}
+
+// TestParsePciIdsInvalidLines tests that malformed lines are skipped and counted, along with the lines nested below them
+func TestParsePciIdsInvalidLines(t *testing.T) {
+	db, err := parsePciIds(strings.NewReader("10de  NVIDIA Corporation\n" +
+		"\t2882  AD107 [GeForce RTX 4060]\n" +
+		"\tzzzz  Not an id\n" +
+		"\t\t1458 4116  Below the invalid device\n" +
+		"\t22be AD107 High Definition Audio Controller\n" +
+		"1458  Gigabyte Technology Co., Ltd\n"))
+	if err != nil {
+		t.Fatalf("parsePciIds() error = %v", err)
+	}
+	if db.InvalidLines != 2 {
+		t.Errorf("parsePciIds() counted %d invalid lines, expected 2", db.InvalidLines)
+	}
+	expected := pciNames{"NVIDIA Corporation", "AD107 [GeForce RTX 4060]", "Unknown class", "Gigabyte Technology Co., Ltd Device 4116"}
+	if actual := db.Names("10de", "2882", "", "1458", "4116"); actual != expected {
+		t.Errorf("Names() got = %+v, expected %+v", actual, expected)
+	}
+	if db.Source = "test.ids"; db.String() != "unknown version (test.ids, 2 invalid lines skipped)" {
+		t.Errorf("String() got = %q", db.String())
+	}
+}
+
+// benchmarkDevices are the ids of a 100-device host, as vendor, device, class, subvendor, subdevice
+var benchmarkDevices = func() [][5]string {
+	devices := [][5]string{
+		{"1022", "1630", "0600", "1022", "1630"}, {"10de", "2882", "0300", "1458", "4116"},
+		{"10de", "22be", "0403", "1458", "4116"}, {"8086", "a7a0", "0300", "1043", "8882"},
+		{"1002", "73bf", "0300", "1002", "0e3a"}, {"10ec", "8168", "0200", "1043", "8677"},
+		{"144d", "a808", "0108", "144d", "a801"}, {"8086", "7a70", "0c03", "1043", "8882"},
+		{"1af4", "1041", "0200", "1af4", "1100"}, {"1022", "149c", "0c03", "1022", "149c"},
+	}
+	for len(devices) < 100 {
+		devices = append(devices, devices[len(devices)%10])
+	}
+	return devices
+}()
+
+// BenchmarkParsePciIds measures the one time cost of indexing the embedded pci.ids
+func BenchmarkParsePciIds(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		f, err := pciIDs.Open("pci.ids")
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, err := parsePciIds(f); err != nil {
+			b.Fatal(err)
+		}
+		f.Close()
+	}
+}
+
+// BenchmarkNames measures resolving the names of all devices of a 100-device host, as list does
+func BenchmarkNames(b *testing.B) {
+	db, err := embeddedPciIds()
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, d := range benchmarkDevices {
+			db.Names(d[0], d[1], d[2], d[3], d[4])
+		}
+	}
+}
+
+// TestLoadPciIds tests choosing the newest database and merging the local override file
+func TestLoadPciIds(t *testing.T) {
+	root := t.TempDir()
+	writeTestFile(t, root, PATHS_PCI_IDS[0], "#\tVersion: 2099.01.01\n10de  NVIDIA Corporation\n\t2882  AD107 [GeForce RTX 4060]\n")
+	writeTestFile(t, root, "old.ids", "#\tVersion: 2020.01.01\n10de  Old NVIDIA\n")
+	writeTestFile(t, root, "broken.ids", "#\tVersion: 2100.01.01\n10de NVIDIA\n")
+	writeTestFile(t, root, "partly.ids", "#\tVersion: 2100.01.01\n10de  Partly NVIDIA\n\tzzzz  Not an id\n")
+
+	testCases := []struct {
+		name     string
+		file     string
+		expected string
+		vendor   string
+	}{
+		{"SystemNewerThanGiven", filepath.Join(root, "old.ids"), "2099.01.01 (" + filepath.Join(root, PATHS_PCI_IDS[0]) + ")", "NVIDIA Corporation"},
+		{"BrokenFallsBack", filepath.Join(root, "broken.ids"), "2099.01.01 (" + filepath.Join(root, PATHS_PCI_IDS[0]) + ")", "NVIDIA Corporation"},
+		{"PartlyBroken", filepath.Join(root, "partly.ids"), "2100.01.01 (" + filepath.Join(root, "partly.ids") + ", 1 invalid lines skipped)", "Partly NVIDIA"},
+		{"Missing", filepath.Join(root, "missing.ids"), "2099.01.01 (" + filepath.Join(root, PATHS_PCI_IDS[0]) + ")", "NVIDIA Corporation"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			db, err := loadPciIds(root, tc.file)
+			if err != nil {
+				t.Fatalf("loadPciIds() error = %v", err)
+			}
+			if actual := db.String(); actual != tc.expected {
+				t.Errorf("String() got = %q, expected %q", actual, tc.expected)
+			}
+			if actual, _ := db.Vendor(0x10de); actual != tc.vendor {
+				t.Errorf("Vendor() got = %q, expected %q", actual, tc.vendor)
+			}
+		})
+	}
+
+	// Without system databases the embedded one is used
+	db, err := loadPciIds(t.TempDir(), "")
+	if err != nil || db.Source != pciIdsEmbedded {
+		t.Fatalf("loadPciIds() got = %v, error = %v", db, err)
+	}
+
+	writeTestFile(t, root, PATH_PCI_IDS_LOCAL, "10de  NVIDIA Corporation\n\t2882  In-house RTX 4060\n1ced  In-house Labs\n\t0001  Capture card\n")
+	db, err = loadPciIds(root, "")
+	if err != nil {
+		t.Fatalf("loadPciIds() error = %v", err)
+	}
+	expected := pciNames{"In-house Labs", "Capture card", "Unknown class", ""}
+	if actual := db.Names("1ced", "0001", "", "", ""); actual != expected {
+		t.Errorf("Names() got = %+v, expected %+v", actual, expected)
+	}
+	if actual := db.Names("10de", "2882", "", "", "").Device; actual != "In-house RTX 4060" {
+		t.Errorf("Names() device got = %q", actual)
+	}
+	if db.Version != "2099.01.01" || db.Override != filepath.Join(root, PATH_PCI_IDS_LOCAL) {
+		t.Errorf("got version %q, override %q", db.Version, db.Override)
+	}
+
+	// A malformed override is ignored with a warning rather than breaking every name lookup
+	var logged bytes.Buffer
+	previous := pciIdsLog
+	log := zerolog.New(&logged)
+	pciIdsLog = &log
+	t.Cleanup(func() { pciIdsLog = previous })
+	writeTestFile(t, root, PATH_PCI_IDS_LOCAL, "1ced In-house Labs\n")
+	db, err = loadPciIds(root, "")
+	if err != nil {
+		t.Fatalf("loadPciIds() with a malformed override error = %v", err)
+	}
+	if db.Override != "" || db.Names("10de", "2882", "", "", "").Device != "AD107 [GeForce RTX 4060]" {
+		t.Errorf("loadPciIds() with a malformed override got = %v", db)
+	}
+	if !strings.Contains(logged.String(), `"level":"warn"`) || !strings.Contains(logged.String(), PATH_PCI_IDS_LOCAL) {
+		t.Errorf("loadPciIds() with a malformed override logged %q", logged.String())
+	}
+}
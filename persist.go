@@ -0,0 +1,300 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/rs/zerolog"
+)
+
+const (
+	PATH_OS_RELEASE       = "/etc/os-release"
+	PATH_KERNEL_OSRELEASE = "/proc/sys/kernel/osrelease"
+	PATH_LIB_MODULES      = "/lib/modules"
+	PATH_VFIO_CONF        = "/etc/modprobe.d/vfio.conf"
+
+	PersistBackendAuto     = "auto"
+	PersistBackendModprobe = "modprobe"
+)
+
+// persistBackendNames lists the backends that can be selected with --persist-backend
+var persistBackendNames = []string{
+	PersistBackendAuto, PersistBackendModprobe,
+	BootloaderGrub, BootloaderSystemdBoot, BootloaderGrubby, BootloaderKernelstub,
+	InitramfsMkinitcpio, InitramfsDracut, InitramfsTools,
+	PersistBackendUdev, PersistBackendDriverctl, PersistBackendService,
+}
+
+// persistFlags are the flags shared by the commands that change persisted bindings
+type persistFlags struct {
+	PersistBackend string `help:"Where to persist the binding. Auto detects it from the distribution. One of: ${enum}" enum:"${persist_backends}" default:"auto"`
+}
+
+// persistedDevice is a device whose vfio-pci binding is persisted
+type persistedDevice struct {
+	Bus string
+	// ID is the vendor:device id, e.g. 10de:2882
+	ID string
+}
+
+// persistBackend persists vfio-pci bindings across reboots
+type persistBackend interface {
+	Name() string
+	// Persist makes vfio-pci claim the devices at boot
+	Persist(log *zerolog.Logger, devices []persistedDevice) error
+	// Unpersist stops vfio-pci from claiming the devices at boot
+	Unpersist(log *zerolog.Logger, devices []persistedDevice) error
+	// RegenerateCommand returns the command that must be run for the change to apply at next boot, if any
+	RegenerateCommand() string
+}
+
+// newPersistBackend returns the backend with the given name, editing files below root. The auto backend is detected,
+// pinning by bus address when an id based binding would also claim a device that stays on the host
+func newPersistBackend(name, root string, devices []persistedDevice) (persistBackend, error) {
+	if name == PersistBackendAuto {
+		name = detectPersistBackend(root)
+		if sharesIdWithHostDevice(root, devices) {
+			name = detectAddressBackend(root)
+		}
+	}
+	switch name {
+	case PersistBackendModprobe:
+		return &modprobeBackend{root: root}, nil
+	case PersistBackendUdev:
+		return &udevBackend{root: root}, nil
+	case PersistBackendDriverctl:
+		return &driverctlBackend{root: root}, nil
+	case PersistBackendService:
+		return &serviceBackend{root: root}, nil
+	case BootloaderGrub, BootloaderSystemdBoot, BootloaderGrubby, BootloaderKernelstub:
+		b, err := newBootloader(name, root)
+		if err != nil {
+			return nil, err
+		}
+		return &cmdlineBackend{bootloader: b}, nil
+	case InitramfsMkinitcpio, InitramfsDracut, InitramfsTools:
+		return newInitramfsBackend(name, root)
+	}
+	return nil, fmt.Errorf("unsupported persist backend %q", name)
+}
+
+// detectPersistBackend picks the backend that works for the kernel and distribution below root.
+// A built in vfio-pci ignores modprobe.d, so the kernel command line is used. Otherwise vfio-pci is
+// added to the initramfs of the distribution, so it loads before host drivers from the initramfs
+func detectPersistBackend(root string) string {
+	if isBuiltinModule(root, kernelRelease(root), "vfio-pci") {
+		if name, err := detectBootloader(root); err == nil {
+			return name
+		}
+	}
+
+	osRelease := readOsRelease(root)
+	ids := append([]string{osRelease["ID"]}, strings.Fields(osRelease["ID_LIKE"])...)
+	for _, id := range ids {
+		switch id {
+		case "arch":
+			return InitramfsMkinitcpio
+		case "fedora", "rhel", "centos", "suse", "opensuse":
+			return InitramfsDracut
+		case "debian", "ubuntu":
+			return InitramfsTools
+		}
+	}
+
+	// Unknown distribution, look for the initramfs generator configuration
+	for name, path := range map[string]string{
+		InitramfsMkinitcpio: PATH_MKINITCPIO_CONF,
+		InitramfsDracut:     PATH_DRACUT_CONF_D,
+		InitramfsTools:      PATH_INITRAMFS_TOOLS_MODULES,
+	} {
+		if _, err := os.Stat(filepath.Join(root, path)); err == nil {
+			return name
+		}
+	}
+	return PersistBackendModprobe
+}
+
+// readOsRelease parses os-release below root. Returns an empty map on error
+func readOsRelease(root string) map[string]string {
+	result := map[string]string{}
+	content, err := os.ReadFile(filepath.Join(root, PATH_OS_RELEASE))
+	if err != nil {
+		return result
+	}
+	for _, line := range strings.Split(string(content), "\n") {
+		key, value, ok := strings.Cut(strings.TrimSpace(line), "=")
+		if !ok || strings.HasPrefix(key, "#") {
+			continue
+		}
+		result[key] = strings.Trim(value, `"'`)
+	}
+	return result
+}
+
+// kernelRelease returns the release of the running kernel, like uname -r
+func kernelRelease(root string) string {
+	release, _ := os.ReadFile(filepath.Join(root, PATH_KERNEL_OSRELEASE))
+	return strings.TrimSpace(string(release))
+}
+
+// normalizeModuleName returns the module name the way the kernel reports it, with underscores
+func normalizeModuleName(name string) string {
+	return strings.ReplaceAll(strings.TrimSuffix(filepath.Base(name), ".ko"), "-", "_")
+}
+
+// isBuiltinModule reports whether the module is built into the kernel release below root
+func isBuiltinModule(root, release, module string) bool {
+	return slices.Contains(readBuiltinModules(root, release), normalizeModuleName(module))
+}
+
+// mergeIds appends the ids that are not in the list yet
+func mergeIds(ids []string, add ...string) []string {
+	for _, id := range add {
+		if !slices.Contains(ids, id) {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// modprobeBackend persists ids in options vfio-pci ids= of /etc/modprobe.d/vfio.conf
+type modprobeBackend struct {
+	root string
+}
+
+func (b *modprobeBackend) Name() string {
+	return PersistBackendModprobe
+}
+
+func (b *modprobeBackend) Persist(log *zerolog.Logger, devices []persistedDevice) error {
+	return b.update(log, func(conf *modprobeConf) {
+		ids := conf.VfioIds()
+		for _, dev := range devices {
+			ids = mergeIds(ids, dev.ID)
+		}
+		conf.SetVfioIds(ids)
+	})
+}
+
+func (b *modprobeBackend) Unpersist(log *zerolog.Logger, devices []persistedDevice) error {
+	return b.update(log, func(conf *modprobeConf) {
+		conf.SetVfioIds(slices.DeleteFunc(conf.VfioIds(), func(id string) bool {
+			return slices.ContainsFunc(devices, func(dev persistedDevice) bool { return dev.ID == id })
+		}))
+	})
+}
+
+func (b *modprobeBackend) RegenerateCommand() string {
+	return ""
+}
+
+// update edits vfio.conf and makes the softdeps follow the host drivers of the resulting ids
+func (b *modprobeBackend) update(log *zerolog.Logger, edit func(conf *modprobeConf)) error {
+	vfioConf := filepath.Join(b.root, PATH_VFIO_CONF)
+	conf, err := readModprobeConf(vfioConf)
+	if err != nil {
+		return err
+	}
+	edit(conf)
+
+	// A missing softdep only risks losing the probe race, the ids are still written
+	drivers, err := hostDrivers(b.root, conf.VfioIds())
+	if err != nil {
+		log.Warn().Err(err).Msgf("Failed to update softdeps in %q", vfioConf)
+	} else {
+		conf.SetPreSoftdeps("vfio-pci", drivers)
+	}
+
+	return writeModprobeConf(vfioConf, conf)
+}
+
+// hostDrivers returns the modules, other than vfio-pci, that can drive the present devices with the given ids
+func hostDrivers(root string, ids []string) ([]string, error) {
+	aliases, err := readModulesAlias(root, kernelRelease(root))
+	if err != nil {
+		return nil, err
+	}
+	devicesPath := filepath.Join(root, PATH_SYS_BUS_PCI_DEVICES)
+	entries, err := os.ReadDir(devicesPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", devicesPath, err)
+	}
+
+	drivers := []string{}
+	for _, entry := range entries {
+		read := func(filename string) string {
+			value, _ := os.ReadFile(filepath.Join(devicesPath, entry.Name(), filename))
+			return strings.TrimPrefix(strings.TrimSpace(string(value)), "0x")
+		}
+		if !slices.Contains(ids, read("vendor")+":"+read("device")) {
+			continue
+		}
+		for _, module := range matchModules(aliases, read("modalias")) {
+			if normalizeModuleName(module) != "vfio_pci" {
+				drivers = mergeIds(drivers, module)
+			}
+		}
+	}
+	slices.Sort(drivers)
+	return drivers, nil
+}
+
+// cmdlineBackend persists ids in vfio-pci.ids= on the kernel command line
+type cmdlineBackend struct {
+	bootloader bootloader
+}
+
+func (b *cmdlineBackend) Name() string {
+	return b.bootloader.Name()
+}
+
+func (b *cmdlineBackend) Persist(log *zerolog.Logger, devices []persistedDevice) error {
+	return b.update(log, func(ids []string) []string {
+		for _, dev := range devices {
+			ids = mergeIds(ids, dev.ID)
+		}
+		return ids
+	})
+}
+
+func (b *cmdlineBackend) Unpersist(log *zerolog.Logger, devices []persistedDevice) error {
+	return b.update(log, func(ids []string) []string {
+		return slices.DeleteFunc(ids, func(id string) bool {
+			return slices.ContainsFunc(devices, func(dev persistedDevice) bool { return dev.ID == id })
+		})
+	})
+}
+
+// update edits the ids of vfio-pci.ids=, removing the argument when there are no ids left
+func (b *cmdlineBackend) update(log *zerolog.Logger, edit func(ids []string) []string) error {
+	args, err := b.bootloader.Args()
+	if err != nil {
+		return fmt.Errorf("failed to read kernel command line from %s: %w", b.bootloader.Name(), err)
+	}
+	ids := []string{}
+	value, found := cmdlineValue(args, "vfio-pci.ids")
+	if value != "" {
+		ids = mergeIds(ids, strings.Split(value, ",")...)
+	}
+	updated := edit(slices.Clone(ids))
+	if slices.Equal(ids, updated) {
+		return nil
+	}
+
+	if len(updated) == 0 {
+		if !found {
+			return nil
+		}
+		log.Debug().Msgf("Removing vfio-pci.ids from %s", b.bootloader.Name())
+		return b.bootloader.Update(nil, []string{"vfio-pci.ids"})
+	}
+	log.Debug().Msgf("Setting vfio-pci.ids=%s in %s", strings.Join(updated, ","), b.bootloader.Name())
+	return b.bootloader.Update([]string{"vfio-pci.ids=" + strings.Join(updated, ",")}, nil)
+}
+
+func (b *cmdlineBackend) RegenerateCommand() string {
+	return b.bootloader.RegenerateCommand()
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/rs/zerolog"
+)
+
+// writeTestFile writes a file below root, creating its directories
+func writeTestFile(t *testing.T, root, path, content string) {
+	t.Helper()
+	file := filepath.Join(root, path)
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		t.Fatalf("error creating directory: %v", err)
+	}
+	if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+		t.Fatalf("error writing file: %v", err)
+	}
+}
+
+// readTestFile reads a file below root
+func readTestFile(t *testing.T, root, path string) string {
+	t.Helper()
+	content, err := os.ReadFile(filepath.Join(root, path))
+	if err != nil {
+		t.Fatalf("error reading file: %v", err)
+	}
+	return string(content)
+}
+
+// TestUpdateCmdline tests setting and removing kernel command line arguments
+func TestUpdateCmdline(t *testing.T) {
+	args := splitCmdline(`quiet vfio-pci.ids=10de:2882 root="UUID=a b" splash`)
+	expected := []string{"quiet", "vfio-pci.ids=10de:2882,10de:22be", `root="UUID=a b"`, "iommu=pt"}
+
+	actual := updateCmdline(args, []string{"vfio-pci.ids=10de:2882,10de:22be", "iommu=pt"}, []string{"splash"})
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("updateCmdline() got = %q, expected %q", actual, expected)
+	}
+}
+
+// TestDetectPersistBackend tests the auto detection of the persist backend
+func TestDetectPersistBackend(t *testing.T) {
+	testCases := []struct {
+		name     string
+		files    map[string]string
+		expected string
+	}{
+		{"Arch", map[string]string{PATH_OS_RELEASE: "ID=arch\n"}, InitramfsMkinitcpio},
+		{"Ubuntu", map[string]string{PATH_OS_RELEASE: "ID=ubuntu\nID_LIKE=debian\n"}, InitramfsTools},
+		{"Derivative", map[string]string{PATH_OS_RELEASE: "ID=nobara\nID_LIKE=\"rhel fedora\"\n"}, InitramfsDracut},
+		{"UnknownWithMkinitcpio", map[string]string{PATH_MKINITCPIO_CONF: "MODULES=()\n"}, InitramfsMkinitcpio},
+		{"Unknown", map[string]string{}, PersistBackendModprobe},
+		{"BuiltinVfioPci", map[string]string{
+			PATH_OS_RELEASE:       "ID=arch\n",
+			PATH_KERNEL_OSRELEASE: "6.6.0\n",
+			filepath.Join(PATH_LIB_MODULES, "6.6.0", "modules.builtin"): "kernel/drivers/vfio/pci/vfio-pci.ko\n",
+			PATH_DEFAULT_GRUB: "GRUB_CMDLINE_LINUX_DEFAULT=\"quiet\"\n",
+		}, BootloaderGrub},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			root := t.TempDir()
+			for path, content := range tc.files {
+				writeTestFile(t, root, path, content)
+			}
+			if actual := detectPersistBackend(root); actual != tc.expected {
+				t.Errorf("detectPersistBackend() got = %v, expected %v", actual, tc.expected)
+			}
+		})
+	}
+}
+
+// TestPersistBackends tests that each backend writes its configuration idempotently
+func TestPersistBackends(t *testing.T) {
+	testCases := []struct {
+		name     string
+		files    map[string]string
+		expected map[string]string
+	}{
+		{
+			"Grub",
+			map[string]string{PATH_DEFAULT_GRUB: "GRUB_TIMEOUT=5\nGRUB_CMDLINE_LINUX_DEFAULT=\"quiet vfio-pci.ids=1002:73bf\"\n"},
+			map[string]string{PATH_DEFAULT_GRUB: "GRUB_TIMEOUT=5\nGRUB_CMDLINE_LINUX_DEFAULT=\"quiet vfio-pci.ids=1002:73bf,10de:2882\"\n"},
+		},
+		{
+			"SystemdBoot",
+			map[string]string{"/boot/loader/entries/arch.conf": "title Arch\nlinux /vmlinuz-linux\noptions root=/dev/sda2 rw\n"},
+			map[string]string{"/boot/loader/entries/arch.conf": "title Arch\nlinux /vmlinuz-linux\noptions root=/dev/sda2 rw vfio-pci.ids=10de:2882\n"},
+		},
+		{
+			"Mkinitcpio",
+			map[string]string{PATH_MKINITCPIO_CONF: "# vim:set ft=sh\nMODULES=(amdgpu vfio)\nHOOKS=(base udev)\n"},
+			map[string]string{
+				PATH_MKINITCPIO_CONF: "# vim:set ft=sh\nMODULES=(vfio_pci vfio_iommu_type1 amdgpu vfio)\nHOOKS=(base udev)\n",
+				PATH_VFIO_CONF:       "options vfio-pci ids=10de:2882\n",
+			},
+		},
+		{
+			"Dracut",
+			map[string]string{},
+			map[string]string{
+				PATH_DRACUT_VFIO_CONF: "force_drivers+=\" vfio_pci vfio vfio_iommu_type1 \"\n",
+				PATH_VFIO_CONF:        "options vfio-pci ids=10de:2882\n",
+			},
+		},
+		{
+			"InitramfsTools",
+			map[string]string{PATH_INITRAMFS_TOOLS_MODULES: "# List of modules\nvfio\n"},
+			map[string]string{
+				PATH_INITRAMFS_TOOLS_MODULES: "# List of modules\nvfio\nvfio_pci\nvfio_iommu_type1\n",
+				PATH_VFIO_CONF:               "options vfio-pci ids=10de:2882\n",
+			},
+		},
+	}
+	names := map[string]string{
+		"Grub": BootloaderGrub, "SystemdBoot": BootloaderSystemdBoot, "Mkinitcpio": InitramfsMkinitcpio,
+		"Dracut": InitramfsDracut, "InitramfsTools": InitramfsTools,
+	}
+	log := zerolog.Nop()
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			root := t.TempDir()
+			for path, content := range tc.files {
+				writeTestFile(t, root, path, content)
+			}
+			backend, err := newPersistBackend(names[tc.name], root, nil)
+			if err != nil {
+				t.Fatalf("newPersistBackend() error = %v", err)
+			}
+			// Persisting twice must not change the result
+			for range 2 {
+				if err := backend.Persist(&log, []persistedDevice{{Bus: "0000:01:00.0", ID: "10de:2882"}}); err != nil {
+					t.Fatalf("Persist() error = %v", err)
+				}
+			}
+			for path, content := range tc.expected {
+				if actual := readTestFile(t, root, path); actual != content {
+					t.Errorf("%s got = %q, expected %q", path, actual, content)
+				}
+			}
+		})
+	}
+}
+
+// TestModprobeSoftdeps tests that softdeps follow the host drivers of the persisted devices
+func TestModprobeSoftdeps(t *testing.T) {
+	root := t.TempDir()
+	devices := map[string][3]string{
+		"0000:01:00.0": {"0x10de", "0x2882", "pci:v000010DEd00002882sv00001458sd00004110bc03sc00i00"},
+		"0000:01:00.1": {"0x10de", "0x22be", "pci:v000010DEd000022BEsv00001458sd00004110bc04sc03i00"},
+		"0000:02:00.0": {"0x1002", "0x73bf", "pci:v00001002d000073BFsv00001458sd00002322bc03sc00i00"},
+	}
+	for bus, attrs := range devices {
+		for i, name := range []string{"vendor", "device", "modalias"} {
+			writeTestFile(t, root, filepath.Join(PATH_SYS_BUS_PCI_DEVICES, bus, name), attrs[i]+"\n")
+		}
+	}
+	writeTestFile(t, root, filepath.Join(PATH_LIB_MODULES, kernelRelease(root), "modules.alias"),
+		"alias pci:v000010DEd*sv*sd*bc03sc00i00* nouveau\n"+
+			"alias pci:v*d*sv*sd*bc04sc03i00* snd_hda_intel\n"+
+			"alias pci:v00001002d*sv*sd*bc03sc00i00* amdgpu\n"+
+			"alias vfio_pci:v*d*sv*sd*bc*sc*i* vfio_pci\n")
+	writeTestFile(t, root, PATH_VFIO_CONF,
+		"# GPU\noptions vfio-pci ids=10de:2882\n# Managed by auto-vfio\nsoftdep amdgpu pre: vfio-pci\n# Managed by auto-vfio\nsoftdep nouveau pre: vfio-pci\n"+
+			"# Written by hand\nsoftdep i915 pre: vfio-pci\n")
+
+	log := zerolog.Nop()
+	backend := &modprobeBackend{root: root}
+	if err := backend.Persist(&log, []persistedDevice{{Bus: "0000:01:00.1", ID: "10de:22be"}}); err != nil {
+		t.Fatalf("Persist() error = %v", err)
+	}
+	expected := "# GPU\noptions vfio-pci ids=10de:2882,10de:22be\n# Managed by auto-vfio\nsoftdep nouveau pre: vfio-pci\n" +
+		"# Written by hand\nsoftdep i915 pre: vfio-pci\n# Managed by auto-vfio\nsoftdep snd_hda_intel pre: vfio-pci\n"
+	if actual := readTestFile(t, root, PATH_VFIO_CONF); actual != expected {
+		t.Errorf("Persist() got = %q, expected %q", actual, expected)
+	}
+
+	if err := backend.Unpersist(&log, []persistedDevice{{Bus: "0000:01:00.0", ID: "10de:2882"}}); err != nil {
+		t.Fatalf("Unpersist() error = %v", err)
+	}
+	expected = "# GPU\noptions vfio-pci ids=10de:22be\n# Written by hand\nsoftdep i915 pre: vfio-pci\n# Managed by auto-vfio\nsoftdep snd_hda_intel pre: vfio-pci\n"
+	if actual := readTestFile(t, root, PATH_VFIO_CONF); actual != expected {
+		t.Errorf("Unpersist() got = %q, expected %q", actual, expected)
+	}
+}
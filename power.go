@@ -0,0 +1,127 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+const (
+	PowerControlOn   = "on"
+	PowerControlAuto = "auto"
+
+	// wakeTimeout bounds how long to wait for a device to resume to D0
+	wakeTimeout = 5 * time.Second
+)
+
+type _powerOn struct {
+	Bus []string `short:"b" required:"" help:"Comma separated list of Bus addresses to pin to D0" placeholder:"bus-address1"`
+}
+
+type _powerAllowD3cold struct {
+	Bus []string `short:"b" required:"" help:"Comma separated list of Bus addresses allowed to enter D3cold" placeholder:"bus-address1"`
+}
+
+type _power struct {
+	On          _powerOn          `cmd:"" help:"Pin devices to D0 by disabling runtime power management (power/control=on)"`
+	AllowD3cold _powerAllowD3cold `cmd:"" name:"allow-d3cold" help:"Allow devices to runtime suspend down to D3cold (power/control=auto, d3cold_allowed=1)"`
+}
+
+type PowerCmd struct {
+	Power _power `cmd:"" help:"Control runtime power management of PCI devices"`
+}
+
+// Run executes the command
+func (cmd *_powerOn) Run(globals *Globals) error {
+	if err := reRunElevated(); err != nil {
+		return err
+	}
+	log := globals.config.Logger()
+
+	var errs []error
+	for _, dev := range cmd.Bus {
+		errs = append(errs, logPowerChange(log, dev, wakeDevice(log, "/", dev)))
+	}
+	return errors.Join(errs...)
+}
+
+// Run executes the command
+func (cmd *_powerAllowD3cold) Run(globals *Globals) error {
+	if err := reRunElevated(); err != nil {
+		return err
+	}
+	log := globals.config.Logger()
+
+	var errs []error
+	for _, dev := range cmd.Bus {
+		errs = append(errs, logPowerChange(log, dev, allowD3cold("/", dev)))
+	}
+	return errors.Join(errs...)
+}
+
+// allowD3cold lets the device below root runtime suspend down to D3cold
+func allowD3cold(root, dev string) error {
+	devPath := filepath.Join(root, PATH_SYS_BUS_PCI_DEVICES, dev)
+	if err := writeSysfsFileWithTimeout(filepath.Join(devPath, "d3cold_allowed"), "1"); err != nil {
+		return fmt.Errorf("failed to allow D3cold for device %q: %w", dev, err)
+	}
+	if err := writeSysfsFileWithTimeout(filepath.Join(devPath, "power", "control"), PowerControlAuto); err != nil {
+		return fmt.Errorf("failed to enable runtime power management of device %q: %w", dev, err)
+	}
+	return nil
+}
+
+// logPowerChange logs the outcome of a power change and passes the error through
+func logPowerChange(log *zerolog.Logger, dev string, err error) error {
+	if err != nil {
+		log.Error().Err(err).Msgf("Failed to change power management of device %q", dev)
+		return err
+	}
+	log.Info().Msgf("Device %q power: %s", dev, readPowerStatus("/", dev))
+	return nil
+}
+
+// readPowerStatus returns a short description of the power state of the device below root
+func readPowerStatus(root, dev string) string {
+	read := func(filename string) string {
+		value, _ := os.ReadFile(filepath.Join(root, PATH_SYS_BUS_PCI_DEVICES, dev, filename))
+		return strings.TrimSpace(string(value))
+	}
+	return fmt.Sprintf("%s (%s, control=%s, d3cold_allowed=%s)",
+		read("power_state"), read("power/runtime_status"), read("power/control"), read("d3cold_allowed"))
+}
+
+// wakeDevice pins the device below root to D0 and waits until it is runtime active
+func wakeDevice(log *zerolog.Logger, root, dev string) error {
+	return wakeDeviceTimeout(log, root, dev, wakeTimeout)
+}
+
+// wakeDeviceTimeout pins the device to D0 and waits up to timeout until it is runtime active
+func wakeDeviceTimeout(log *zerolog.Logger, root, dev string, timeout time.Duration) error {
+	powerPath := filepath.Join(root, PATH_SYS_BUS_PCI_DEVICES, dev, "power")
+	log.Info().Msgf("Waking device %q", dev)
+	if err := writeSysfsFileWithTimeout(filepath.Join(powerPath, "control"), PowerControlOn); err != nil {
+		return fmt.Errorf("failed to disable runtime power management of device %q: %w", dev, err)
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		status, err := os.ReadFile(filepath.Join(powerPath, "runtime_status"))
+		if err != nil {
+			return fmt.Errorf("failed to read runtime status of device %q: %w", dev, err)
+		}
+		switch strings.TrimSpace(string(status)) {
+		case "active", "unsupported":
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("device %q did not wake up within %s, runtime status %q", dev, timeout, strings.TrimSpace(string(status)))
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
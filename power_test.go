@@ -0,0 +1,133 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// writeTestPowerDevice writes the power files of a device below root
+func writeTestPowerDevice(t *testing.T, root, dev, state, runtimeStatus string) {
+	t.Helper()
+	devPath := filepath.Join(PATH_SYS_BUS_PCI_DEVICES, dev)
+	writeTestFile(t, root, filepath.Join(devPath, "power_state"), state+"\n")
+	writeTestFile(t, root, filepath.Join(devPath, "power", "runtime_status"), runtimeStatus+"\n")
+	writeTestFile(t, root, filepath.Join(devPath, "power", "control"), PowerControlAuto+"\n")
+	writeTestFile(t, root, filepath.Join(devPath, "d3cold_allowed"), "1\n")
+}
+
+// TestWakeDevice tests waking a device from D3cold and the failures to do so
+func TestWakeDevice(t *testing.T) {
+	const dev = "0000:01:00.0"
+	devPath := filepath.Join(PATH_SYS_BUS_PCI_DEVICES, dev)
+	log := zerolog.Nop()
+
+	t.Run("D3cold", func(t *testing.T) {
+		root := t.TempDir()
+		writeTestPowerDevice(t, root, dev, "D3cold", "suspended")
+		// The kernel resumes the device some time after power/control is set
+		resumed := make(chan struct{})
+		go func() {
+			defer close(resumed)
+			time.Sleep(100 * time.Millisecond)
+			_ = os.WriteFile(filepath.Join(root, devPath, "power_state"), []byte("D0\n"), 0644)
+			_ = os.WriteFile(filepath.Join(root, devPath, "power", "runtime_status"), []byte("active\n"), 0644)
+		}()
+		err := wakeDeviceTimeout(&log, root, dev, 2*time.Second)
+		<-resumed
+		if err != nil {
+			t.Fatalf("wakeDeviceTimeout() error = %v", err)
+		}
+		if control := readTestFile(t, root, filepath.Join(devPath, "power", "control")); control != PowerControlOn+"\n" {
+			t.Errorf("wakeDeviceTimeout() left power/control = %q", control)
+		}
+		if status := readPowerStatus(root, dev); status != "D0 (active, control=on, d3cold_allowed=1)" {
+			t.Errorf("readPowerStatus() got = %q", status)
+		}
+	})
+
+	t.Run("Unsupported", func(t *testing.T) {
+		root := t.TempDir()
+		writeTestPowerDevice(t, root, dev, "D0", "unsupported")
+		if err := wakeDeviceTimeout(&log, root, dev, time.Second); err != nil {
+			t.Errorf("wakeDeviceTimeout() of a device without runtime PM error = %v", err)
+		}
+	})
+
+	t.Run("Timeout", func(t *testing.T) {
+		root := t.TempDir()
+		writeTestPowerDevice(t, root, dev, "D3cold", "suspended")
+		err := wakeDeviceTimeout(&log, root, dev, 100*time.Millisecond)
+		if err == nil || !strings.Contains(err.Error(), `runtime status "suspended"`) {
+			t.Errorf("wakeDeviceTimeout() of a device staying suspended error = %v", err)
+		}
+	})
+
+	t.Run("MissingDevice", func(t *testing.T) {
+		if err := wakeDeviceTimeout(&log, t.TempDir(), dev, time.Second); err == nil {
+			t.Errorf("wakeDeviceTimeout() of a missing device expected an error")
+		}
+	})
+}
+
+// TestAllowD3cold tests handing a device back to runtime power management
+func TestAllowD3cold(t *testing.T) {
+	const dev = "0000:01:00.0"
+	devPath := filepath.Join(PATH_SYS_BUS_PCI_DEVICES, dev)
+	root := t.TempDir()
+	writeTestPowerDevice(t, root, dev, "D0", "active")
+	writeTestFile(t, root, filepath.Join(devPath, "power", "control"), PowerControlOn+"\n")
+	writeTestFile(t, root, filepath.Join(devPath, "d3cold_allowed"), "0\n")
+
+	if err := allowD3cold(root, dev); err != nil {
+		t.Fatalf("allowD3cold() error = %v", err)
+	}
+	if status := readPowerStatus(root, dev); status != "D0 (active, control=auto, d3cold_allowed=1)" {
+		t.Errorf("allowD3cold() got = %q", status)
+	}
+	if err := allowD3cold(t.TempDir(), dev); err == nil {
+		t.Errorf("allowD3cold() of a missing device expected an error")
+	}
+}
+
+// TestWakeHook tests that --wake wakes devices before bindDevice touches their driver
+func TestWakeHook(t *testing.T) {
+	const dev = "0000:01:00.0"
+	devPath := filepath.Join(PATH_SYS_BUS_PCI_DEVICES, dev)
+	log := zerolog.Nop()
+
+	if hooks := (&bindFlags{}).beforeBindHooks(&log, "/"); len(hooks) != 0 {
+		t.Errorf("beforeBindHooks() without --wake got %d hooks", len(hooks))
+	}
+	flags := bindFlags{Wake: true}
+
+	root := t.TempDir()
+	writeTestBindSysfs(t, root, dev, "nvme")
+	writeTestPowerDevice(t, root, dev, "D0", "active")
+	kernel := func(string) error {
+		setTestDriver(t, root, dev, "vfio-pci")
+		return nil
+	}
+	result := bindDevice(&log, root, dev, "vfio-pci", append(flags.beforeBindHooks(&log, root), kernel))
+	if result.Action != BindActionBound {
+		t.Errorf("bindDevice() with --wake got = %+v", result)
+	}
+	if control := readTestFile(t, root, filepath.Join(devPath, "power", "control")); control != PowerControlOn+"\n" {
+		t.Errorf("bindDevice() with --wake left power/control = %q", control)
+	}
+
+	// A device that cannot be woken keeps its driver and gets no driver_override
+	root = t.TempDir()
+	writeTestBindSysfs(t, root, dev, "nvme")
+	result = bindDevice(&log, root, dev, "vfio-pci", flags.beforeBindHooks(&log, root))
+	if result.Action != BindActionFailed || !strings.Contains(result.Error, "Failed to prepare device") {
+		t.Errorf("bindDevice() of a device failing to wake got = %+v", result)
+	}
+	if override := readTestFile(t, root, filepath.Join(devPath, "driver_override")); override != "\n" {
+		t.Errorf("bindDevice() of a device failing to wake set driver_override = %q", override)
+	}
+}
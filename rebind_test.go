@@ -0,0 +1,39 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+// TestRebindExitError tests the exit code mapping of rebind results
+func TestRebindExitError(t *testing.T) {
+	testCases := []struct {
+		name     string
+		actions  []string
+		expected int
+	}{
+		{"AllBound", []string{BindActionBound, BindActionBound}, 0},
+		{"AllFailed", []string{BindActionFailed, BindActionFailed}, ExitCodeTotalFailure},
+		{"PartialFailure", []string{BindActionBound, BindActionFailed}, ExitCodePartialFailure},
+		{"NoopAndFailed", []string{BindActionNoop, BindActionFailed}, ExitCodePartialFailure},
+		{"AllNoop", []string{BindActionNoop}, ExitCodeNoop},
+		{"NoopAndBound", []string{BindActionNoop, BindActionBound}, 0},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			results := []BindResult{}
+			for _, a := range tc.actions {
+				results = append(results, BindResult{Action: a})
+			}
+			err := bindExitError(results)
+			code := 0
+			var exitErr *ExitCodeError
+			if errors.As(err, &exitErr) {
+				code = exitErr.Code
+			}
+			if code != tc.expected {
+				t.Errorf("bindExitError() code = %d, expected %d", code, tc.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// inventorySchemaVersion is the version of the document of list, increased on incompatible changes only.
+	// Adding optional fields is compatible
+	inventorySchemaVersion = 1
+)
+
+//go:embed inventory.schema.json
+var inventorySchema []byte
+
+var pciAddressRegex = regexp.MustCompile(`^[0-9a-f]{4}:[0-9a-f]{2}:[0-9a-f]{2}\.[0-7]$`)
+
+type _schema struct{}
+
+type SchemaCmd struct {
+	Schema _schema `cmd:"" help:"Print the JSON Schema of the versioned document of 'list -o json'"`
+}
+
+// Inventory is the versioned document of list in the output formats. Its field names are part of the schema,
+// independent of PciDevice
+type Inventory struct {
+	SchemaVersion int `json:"schemaVersion"`
+	// Generator is the auto-vfio version that wrote the document
+	Generator string            `json:"generator"`
+	Host      InventoryHost     `json:"host"`
+	Groups    []InventoryGroup  `json:"groups"`
+	Devices   []InventoryDevice `json:"devices"`
+}
+
+// InventoryHost describes the host the devices were read on
+type InventoryHost struct {
+	Hostname      string `json:"hostname"`
+	OS            string `json:"os,omitempty"`
+	KernelRelease string `json:"kernelRelease,omitempty"`
+	Cmdline       string `json:"cmdline,omitempty"`
+	PciIds        string `json:"pciIds,omitempty"`
+	// SnapshotCreated is set when the devices were read from a snapshot
+	SnapshotCreated *time.Time `json:"snapshotCreated,omitempty"`
+}
+
+// InventoryGroup is an IOMMU group and the addresses of its devices
+type InventoryGroup struct {
+	ID       string   `json:"id"`
+	Isolated bool     `json:"isolated"`
+	Devices  []string `json:"devices"`
+}
+
+// InventoryDevice is a PCI device, related to its upstream bridge and its IOMMU group by address and id
+type InventoryDevice struct {
+	Address string `json:"address"`
+	// Parent is the address of the upstream bridge, empty for devices of a root bus
+	Parent       string             `json:"parent,omitempty"`
+	IommuGroup   string             `json:"iommuGroup,omitempty"`
+	Vendor       InventoryName      `json:"vendor"`
+	Device       InventoryName      `json:"device"`
+	Subsystem    InventorySubsystem `json:"subsystem"`
+	Class        InventoryClass     `json:"class"`
+	Revision     string             `json:"revision"`
+	Irq          string             `json:"irq,omitempty"`
+	SerialNumber string             `json:"serialNumber,omitempty"`
+	Driver       string             `json:"driver,omitempty"`
+	Modules      []InventoryModule  `json:"modules"`
+	Modalias     string             `json:"modalias"`
+	// NumaNode is -1 without NUMA
+	NumaNode *int `json:"numaNode,omitempty"`
+	// LocalCpus is a cpu list like 0-7,16-23
+	LocalCpus    string          `json:"localCpus,omitempty"`
+	Power        *InventoryPower `json:"power,omitempty"`
+	Link         *InventoryLink  `json:"link,omitempty"`
+	ResetMethods []string        `json:"resetMethods,omitempty"`
+}
+
+// InventoryName is a hex id and its pci.ids name
+type InventoryName struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+type InventorySubsystem struct {
+	VendorID string `json:"vendorId"`
+	DeviceID string `json:"deviceId"`
+	Name     string `json:"name"`
+}
+
+// InventoryClass is the class and subclass code, e.g. 0300, and the programming interface
+type InventoryClass struct {
+	Code   string `json:"code"`
+	ProgIf string `json:"progIf,omitempty"`
+	Name   string `json:"name"`
+}
+
+type InventoryModule struct {
+	Name    string `json:"name"`
+	Builtin bool   `json:"builtin"`
+}
+
+type InventoryPower struct {
+	State         string `json:"state,omitempty"`
+	RuntimeStatus string `json:"runtimeStatus,omitempty"`
+	Control       string `json:"control,omitempty"`
+	D3ColdAllowed *bool  `json:"d3coldAllowed,omitempty"`
+}
+
+// InventoryLink is the negotiated and maximum PCIe link, e.g. 16.0 GT/s PCIe and 16 lanes
+type InventoryLink struct {
+	Speed    string `json:"speed,omitempty"`
+	Width    int    `json:"width,omitempty"`
+	MaxSpeed string `json:"maxSpeed,omitempty"`
+	MaxWidth int    `json:"maxWidth,omitempty"`
+}
+
+// newInventoryHost describes the host below root, as recorded in the snapshot metadata for a snapshot
+func newInventoryHost(root string) InventoryHost {
+	meta := newSnapshotMetadata(root, time.Time{})
+	if content, err := os.ReadFile(filepath.Join(root, PATH_SNAPSHOT_METADATA)); err == nil {
+		_ = json.Unmarshal(content, &meta)
+	}
+	host := InventoryHost{
+		Hostname:      meta.Hostname,
+		OS:            meta.OS,
+		KernelRelease: meta.KernelRelease,
+		Cmdline:       meta.Cmdline,
+		PciIds:        meta.PciIds,
+	}
+	if !meta.Created.IsZero() {
+		host.SnapshotCreated = &meta.Created
+	}
+	return host
+}
+
+// parentBridge returns the address of the bridge a device is behind, from its sysfs path below root
+func parentBridge(root, bus string) string {
+	target, err := os.Readlink(filepath.Join(root, PATH_SYS_BUS_PCI_DEVICES, bus))
+	if err != nil {
+		return ""
+	}
+	if parent := filepath.Base(filepath.Dir(target)); pciAddressRegex.MatchString(parent) {
+		return parent
+	}
+	return ""
+}
+
+// newInventoryDevice maps a device to the document
+func newInventoryDevice(dev PciDevice, parent string) InventoryDevice {
+	d := InventoryDevice{
+		Address:      dev.Bus,
+		Parent:       parent,
+		IommuGroup:   dev.IommuGroup,
+		Vendor:       InventoryName{ID: dev.VendorID, Name: dev.VendorName},
+		Device:       InventoryName{ID: dev.DeviceID, Name: dev.DeviceName},
+		Subsystem:    InventorySubsystem{VendorID: dev.SubsysVendor, DeviceID: dev.SubsysDevice, Name: dev.Subsystem},
+		Class:        InventoryClass{Code: dev.Class, ProgIf: dev.ProgIf, Name: dev.DeviceClass},
+		Revision:     dev.Revision,
+		Irq:          dev.Irq,
+		SerialNumber: dev.SerialNumber,
+		Driver:       dev.KernelDriver,
+		Modules:      make([]InventoryModule, 0, len(dev.KernelModules)),
+		Modalias:     dev.KernelModuleAlias,
+		LocalCpus:    dev.LocalCpuList,
+		ResetMethods: strings.Fields(dev.ResetMethod),
+	}
+	for _, module := range dev.KernelModules {
+		d.Modules = append(d.Modules, InventoryModule{Name: module.Name, Builtin: module.Builtin})
+	}
+	if node, err := strconv.Atoi(dev.NumaNode); err == nil {
+		d.NumaNode = &node
+	}
+	power := InventoryPower{State: dev.PowerState, RuntimeStatus: dev.RuntimeStatus, Control: dev.PowerControl}
+	if allowed, err := strconv.ParseBool(dev.D3ColdAllowed); err == nil {
+		power.D3ColdAllowed = &allowed
+	}
+	if power != (InventoryPower{}) {
+		d.Power = &power
+	}
+	width, _ := strconv.Atoi(dev.LinkWidth)
+	maxWidth, _ := strconv.Atoi(dev.MaxLinkWidth)
+	link := InventoryLink{Speed: dev.LinkSpeed, Width: width, MaxSpeed: dev.MaxLinkSpeed, MaxWidth: maxWidth}
+	if link != (InventoryLink{}) {
+		d.Link = &link
+	}
+	return d
+}
+
+// pciDevice maps a device of the document back, for diff
+func (d InventoryDevice) pciDevice() PciDevice {
+	dev := PciDevice{
+		Bus:               d.Address,
+		VendorID:          d.Vendor.ID,
+		DeviceID:          d.Device.ID,
+		Class:             d.Class.Code,
+		ProgIf:            d.Class.ProgIf,
+		SubsysVendor:      d.Subsystem.VendorID,
+		SubsysDevice:      d.Subsystem.DeviceID,
+		Irq:               d.Irq,
+		Revision:          d.Revision,
+		VendorName:        d.Vendor.Name,
+		DeviceName:        d.Device.Name,
+		DeviceClass:       d.Class.Name,
+		Subsystem:         d.Subsystem.Name,
+		KernelModuleAlias: d.Modalias,
+		KernelDriver:      d.Driver,
+		IommuGroup:        d.IommuGroup,
+		LocalCpuList:      d.LocalCpus,
+		ResetMethod:       strings.Join(d.ResetMethods, " "),
+		SerialNumber:      d.SerialNumber,
+	}
+	for _, module := range d.Modules {
+		dev.KernelModules = append(dev.KernelModules, KernelModule{Name: module.Name, Builtin: module.Builtin})
+	}
+	dev.KernelModule = kernelModuleNames(dev.KernelModules)
+	if d.NumaNode != nil {
+		dev.NumaNode = strconv.Itoa(*d.NumaNode)
+	}
+	if d.Power != nil {
+		dev.PowerState, dev.RuntimeStatus, dev.PowerControl = d.Power.State, d.Power.RuntimeStatus, d.Power.Control
+		if d.Power.D3ColdAllowed != nil {
+			dev.D3ColdAllowed = "0"
+			if *d.Power.D3ColdAllowed {
+				dev.D3ColdAllowed = "1"
+			}
+		}
+	}
+	if d.Link != nil {
+		dev.LinkSpeed, dev.MaxLinkSpeed = d.Link.Speed, d.Link.MaxSpeed
+		if d.Link.Width > 0 {
+			dev.LinkWidth = strconv.Itoa(d.Link.Width)
+		}
+		if d.Link.MaxWidth > 0 {
+			dev.MaxLinkWidth = strconv.Itoa(d.Link.MaxWidth)
+		}
+	}
+	return dev
+}
+
+// newInventory returns the document of the devices below root, in address order.
+// isolated are the isolated IOMMU groups among all devices, whatever the filters
+func newInventory(root string, devices []PciDevice, isolated map[string]bool) Inventory {
+	inventory := Inventory{
+		SchemaVersion: inventorySchemaVersion,
+		Generator:     "auto-vfio " + version,
+		Host:          newInventoryHost(root),
+		Groups:        []InventoryGroup{},
+		Devices:       make([]InventoryDevice, 0, len(devices)),
+	}
+	sorted := slices.Clone(devices)
+	slices.SortFunc(sorted, func(a, b PciDevice) int { return NaturalCompare(a.Bus, b.Bus) })
+	for _, dev := range sorted {
+		inventory.Devices = append(inventory.Devices, newInventoryDevice(dev, parentBridge(root, dev.Bus)))
+		if dev.IommuGroup == "" {
+			continue
+		}
+		i := slices.IndexFunc(inventory.Groups, func(g InventoryGroup) bool { return g.ID == dev.IommuGroup })
+		if i < 0 {
+			inventory.Groups = append(inventory.Groups, InventoryGroup{ID: dev.IommuGroup, Isolated: isolated[dev.IommuGroup]})
+			i = len(inventory.Groups) - 1
+		}
+		inventory.Groups[i].Devices = append(inventory.Groups[i].Devices, dev.Bus)
+	}
+	slices.SortFunc(inventory.Groups, func(a, b InventoryGroup) int { return NaturalCompare(a.ID, b.ID) })
+	return inventory
+}
+
+// parseInventory parses a document of list, false if content is not one
+func parseInventory(content []byte) ([]PciDevice, bool, error) {
+	var inventory Inventory
+	if err := json.Unmarshal(content, &inventory); err != nil || inventory.SchemaVersion == 0 {
+		return nil, false, nil
+	}
+	if inventory.SchemaVersion > inventorySchemaVersion {
+		return nil, true, fmt.Errorf("schema version %d, this version of auto-vfio reads up to %d", inventory.SchemaVersion, inventorySchemaVersion)
+	}
+	devices := make([]PciDevice, 0, len(inventory.Devices))
+	for _, d := range inventory.Devices {
+		devices = append(devices, d.pciDevice())
+	}
+	return devices, true, nil
+}
+
+// Run executes the command
+func (cmd *_schema) Run(globals *Globals) error {
+	_, err := os.Stdout.Write(inventorySchema)
+	return err
+}
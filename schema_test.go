@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// schemaNode is the part of a JSON Schema describing objects and arrays
+type schemaNode struct {
+	Ref        string                `json:"$ref"`
+	Required   []string              `json:"required"`
+	Properties map[string]schemaNode `json:"properties"`
+	Items      *schemaNode           `json:"items"`
+	Defs       map[string]schemaNode `json:"$defs"`
+}
+
+// checkSchema checks that the properties of the schema node, and the required ones, are the JSON fields of typ
+func checkSchema(t *testing.T, defs map[string]schemaNode, node schemaNode, typ reflect.Type, path string) {
+	if name, ok := strings.CutPrefix(node.Ref, "#/$defs/"); ok {
+		node = defs[name]
+	}
+	for typ.Kind() == reflect.Pointer {
+		typ = typ.Elem()
+	}
+	switch {
+	case typ.Kind() == reflect.Slice:
+		if node.Items == nil {
+			t.Errorf("%s: array without items in the schema", path)
+			return
+		}
+		checkSchema(t, defs, *node.Items, typ.Elem(), path+"[]")
+	case typ.Kind() == reflect.Struct && typ != reflect.TypeOf(time.Time{}):
+		fields, required := []string{}, []string{}
+		for i := range typ.NumField() {
+			name, options, _ := strings.Cut(typ.Field(i).Tag.Get("json"), ",")
+			fields = append(fields, name)
+			if options != "omitempty" {
+				required = append(required, name)
+			}
+			property, ok := node.Properties[name]
+			if !ok {
+				t.Errorf("%s.%s: missing in the schema", path, name)
+				continue
+			}
+			checkSchema(t, defs, property, typ.Field(i).Type, path+"."+name)
+		}
+		for name := range node.Properties {
+			if !slices.Contains(fields, name) {
+				t.Errorf("%s.%s: not a field of %s", path, name, typ.Name())
+			}
+		}
+		slices.Sort(required)
+		slices.Sort(node.Required)
+		if !slices.Equal(required, node.Required) {
+			t.Errorf("%s: required got = %v, expected %v", path, node.Required, required)
+		}
+	}
+}
+
+// TestInventorySchema tests that the published schema describes the fields of the document
+func TestInventorySchema(t *testing.T) {
+	var schema schemaNode
+	if err := json.Unmarshal(inventorySchema, &schema); err != nil {
+		t.Fatalf("invalid schema: %v", err)
+	}
+	checkSchema(t, schema.Defs, schema, reflect.TypeOf(Inventory{}), "$")
+}
+
+// TestNewInventory tests the document of the lspci fixture, and reading it back as diff does
+func TestNewInventory(t *testing.T) {
+	root := filepath.Join("testdata", "lspci", "host")
+	devices, err := parsePciDevices(root)
+	if err != nil {
+		t.Fatalf("parsePciDevices() error = %v", err)
+	}
+	inventory := newInventory(root, devices, isolatedGroups(devices))
+	if inventory.SchemaVersion != inventorySchemaVersion || inventory.Host.KernelRelease != "6.6.0-fixture" || len(inventory.Devices) != len(devices) {
+		t.Errorf("newInventory() got = %+v", inventory)
+	}
+	for _, group := range inventory.Groups {
+		for _, address := range group.Devices {
+			i := slices.IndexFunc(inventory.Devices, func(d InventoryDevice) bool { return d.Address == address })
+			if i < 0 || inventory.Devices[i].IommuGroup != group.ID {
+				t.Errorf("newInventory() group %s lists %s, not in the group", group.ID, address)
+			}
+		}
+	}
+
+	content, err := json.Marshal(inventory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := parseListJSON(content)
+	if err != nil {
+		t.Fatalf("parseListJSON() error = %v", err)
+	}
+	if changes := diffInventories(devices, parsed); len(changes) != 0 {
+		t.Errorf("parseListJSON() of the document differs: %+v", changes)
+	}
+
+	newer := strings.Replace(string(content), `"schemaVersion":1`, `"schemaVersion":2`, 1)
+	if _, err := parseListJSON([]byte(newer)); err == nil {
+		t.Errorf("parseListJSON() of a newer schema version expected an error")
+	}
+}
+
+// TestParentBridge tests finding the upstream bridge from the sysfs device path
+func TestParentBridge(t *testing.T) {
+	root := t.TempDir()
+	devicesPath := filepath.Join(root, PATH_SYS_BUS_PCI_DEVICES)
+	if err := os.MkdirAll(devicesPath, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for bus, target := range map[string]string{
+		"0000:00:01.1": "../../../devices/pci0000:00/0000:00:01.1",
+		"0000:01:00.0": "../../../devices/pci0000:00/0000:00:01.1/0000:01:00.0",
+	} {
+		if err := os.Symlink(target, filepath.Join(devicesPath, bus)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if parent := parentBridge(root, "0000:00:01.1"); parent != "" {
+		t.Errorf("parentBridge() of a root bus device got = %q", parent)
+	}
+	if parent := parentBridge(root, "0000:01:00.0"); parent != "0000:00:01.1" {
+		t.Errorf("parentBridge() got = %q, expected 0000:00:01.1", parent)
+	}
+}
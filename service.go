@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+const (
+	PATH_SYSTEMD_SYSTEM = "/etc/systemd/system"
+
+	SystemdUnitName = "auto-vfio.service"
+)
+
+var systemdUnitTemplate = template.Must(template.New("unit").Funcs(template.FuncMap{
+	"execArg":    systemdExecArg,
+	"specifiers": systemdEscapeSpecifiers,
+}).Parse(`# Managed by auto-vfio
+[Unit]
+Description=Apply auto-vfio device bindings
+DefaultDependencies=no
+After=systemd-modules-load.service local-fs.target
+Wants=systemd-modules-load.service
+Before=sysinit.target display-manager.service shutdown.target
+Conflicts=shutdown.target
+ConditionPathExists={{ specifiers .BindingsFile }}
+
+[Service]
+Type=oneshot
+RemainAfterExit=yes
+# apply exits with {{ .NoopExitCode }} when every device is already bound
+SuccessExitStatus={{ .NoopExitCode }}
+ExecStart={{ execArg .Executable }} apply {{ execArg (print "--bindings-file=" .BindingsFile) }}
+
+[Install]
+WantedBy=sysinit.target
+`))
+
+type _installService struct {
+	Executable   string `short:"e" help:"auto-vfio executable run by the service. The current one if empty" type:"path"`
+	BindingsFile string `short:"f" help:"File with the saved bindings" default:"${bindings_file}"`
+	Root         string `help:"Root directory to install the unit in" default:"/" type:"path"`
+}
+
+type _uninstallService struct {
+	Root string `help:"Root directory to remove the unit from" default:"/" type:"path"`
+}
+
+type ServiceCmd struct {
+	InstallService   _installService   `cmd:"" help:"Install and enable a systemd unit that applies the saved bindings at boot, before the display manager"`
+	UninstallService _uninstallService `cmd:"" help:"Disable and remove the systemd unit from 'install-service'"`
+}
+
+// systemdEscapeSpecifiers escapes the % of a unit setting value, which systemd would expand as specifiers
+func systemdEscapeSpecifiers(value string) string {
+	return strings.ReplaceAll(value, "%", "%%")
+}
+
+// systemdExecArg quotes an argument of an Exec line, so that systemd does not split it on whitespace
+// nor expand its specifiers and variables
+func systemdExecArg(arg string) string {
+	arg = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "$", "$$").Replace(systemdEscapeSpecifiers(arg))
+	return `"` + arg + `"`
+}
+
+// generateSystemdUnit returns the content of the unit that runs the executable to apply the bindings file
+func generateSystemdUnit(executable, bindingsFile string) ([]byte, error) {
+	for _, path := range []string{executable, bindingsFile} {
+		if strings.ContainsAny(path, "\n\r") {
+			return nil, fmt.Errorf("path %q cannot be written in a unit: it has a line break", path)
+		}
+	}
+	var unit bytes.Buffer
+	err := systemdUnitTemplate.Execute(&unit, struct {
+		Executable   string
+		BindingsFile string
+		NoopExitCode int
+	}{executable, bindingsFile, ExitCodeNoop})
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate unit: %w", err)
+	}
+	return unit.Bytes(), nil
+}
+
+// installSystemdUnit writes the unit below root and returns its path
+func installSystemdUnit(root, executable, bindingsFile string) (string, error) {
+	unit, err := generateSystemdUnit(executable, bindingsFile)
+	if err != nil {
+		return "", err
+	}
+	unitPath := filepath.Join(root, PATH_SYSTEMD_SYSTEM, SystemdUnitName)
+	return unitPath, writeFileAtomic(unitPath, unit, 0644)
+}
+
+// systemctl runs systemctl against the root. Offline roots only get their symlinks changed
+func systemctl(root string, args ...string) error {
+	if root != "/" {
+		args = append([]string{"--root=" + root}, args...)
+	}
+	if out, err := exec.Command("systemctl", args...).CombinedOutput(); err != nil { //nolint:gosec
+		return fmt.Errorf("systemctl %v failed: %w: %s", args, err, out)
+	}
+	return nil
+}
+
+// Run executes the command
+func (cmd *_installService) Run(globals *Globals) error {
+	log := globals.config.Logger()
+
+	// Re-run elevated
+	if err := reRunElevated(); err != nil {
+		return err
+	}
+
+	executable := cmd.Executable
+	if executable == "" {
+		var err error
+		if executable, err = os.Executable(); err != nil {
+			return fmt.Errorf("failed to get executable path: %w", err)
+		}
+		if executable, err = filepath.EvalSymlinks(executable); err != nil {
+			return fmt.Errorf("failed to resolve executable path: %w", err)
+		}
+	}
+
+	unitPath, err := installSystemdUnit(cmd.Root, executable, cmd.BindingsFile)
+	if err != nil {
+		return err
+	}
+	log.Info().Msgf("Installed %q", unitPath)
+
+	if cmd.Root == "/" {
+		if err := systemctl(cmd.Root, "daemon-reload"); err != nil {
+			return err
+		}
+	}
+	if err := systemctl(cmd.Root, "enable", SystemdUnitName); err != nil {
+		return err
+	}
+	log.Info().Msgf("Enabled %q. Save bindings with 'rebind --persist --persist-backend=%s'", SystemdUnitName, PersistBackendService)
+	return nil
+}
+
+// Run executes the command
+func (cmd *_uninstallService) Run(globals *Globals) error {
+	log := globals.config.Logger()
+
+	// Re-run elevated
+	if err := reRunElevated(); err != nil {
+		return err
+	}
+
+	unitPath := filepath.Join(cmd.Root, PATH_SYSTEMD_SYSTEM, SystemdUnitName)
+	if _, err := os.Stat(unitPath); errors.Is(err, os.ErrNotExist) {
+		log.Warn().Msgf("%q is not installed", unitPath)
+		return nil
+	}
+	if err := systemctl(cmd.Root, "disable", SystemdUnitName); err != nil {
+		return err
+	}
+	if err := os.Remove(unitPath); err != nil {
+		return fmt.Errorf("failed to remove %q: %w", unitPath, err)
+	}
+	if cmd.Root == "/" {
+		if err := systemctl(cmd.Root, "daemon-reload"); err != nil {
+			return err
+		}
+	}
+	log.Info().Msgf("Removed %q", unitPath)
+	return nil
+}
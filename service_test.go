@@ -0,0 +1,99 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/rs/zerolog"
+)
+
+// TestInstallSystemdUnit tests writing the unit into a fake root
+func TestInstallSystemdUnit(t *testing.T) {
+	root := t.TempDir()
+	unitPath, err := installSystemdUnit(root, "/usr/local/bin/auto-vfio", PATH_BINDINGS)
+	if err != nil {
+		t.Fatalf("installSystemdUnit() error = %v", err)
+	}
+	if unitPath != filepath.Join(root, PATH_SYSTEMD_SYSTEM, SystemdUnitName) {
+		t.Errorf("installSystemdUnit() path = %v", unitPath)
+	}
+
+	unit := readTestFile(t, root, filepath.Join(PATH_SYSTEMD_SYSTEM, SystemdUnitName))
+	for _, expected := range []string{
+		"Type=oneshot\n",
+		"Before=sysinit.target display-manager.service shutdown.target\n",
+		"ConditionPathExists=" + PATH_BINDINGS + "\n",
+		`ExecStart="/usr/local/bin/auto-vfio" apply "--bindings-file=` + PATH_BINDINGS + "\"\n",
+		"WantedBy=sysinit.target\n",
+	} {
+		if !strings.Contains(unit, expected) {
+			t.Errorf("unit does not contain %q:\n%s", expected, unit)
+		}
+	}
+
+	// A boot where every saved device is already bound is not a failure of the unit
+	var noop *ExitCodeError
+	if err := bindExitError([]BindResult{{Action: BindActionNoop}}); !errors.As(err, &noop) {
+		t.Fatalf("bindExitError() of noop results got = %v", err)
+	}
+	if expected := fmt.Sprintf("SuccessExitStatus=%d\n", noop.Code); !strings.Contains(unit, expected) {
+		t.Errorf("unit does not contain %q:\n%s", expected, unit)
+	}
+}
+
+// TestSystemdUnitPaths tests paths with spaces, quotes and specifiers in the unit
+func TestSystemdUnitPaths(t *testing.T) {
+	unit, err := generateSystemdUnit(`/opt/my tools/auto-vfio "100%"`, "/etc/auto vfio/$bindings.json")
+	if err != nil {
+		t.Fatalf("generateSystemdUnit() error = %v", err)
+	}
+	for _, expected := range []string{
+		"ConditionPathExists=/etc/auto vfio/$bindings.json\n",
+		`ExecStart="/opt/my tools/auto-vfio \"100%%\"" apply "--bindings-file=/etc/auto vfio/$$bindings.json"` + "\n",
+	} {
+		if !strings.Contains(string(unit), expected) {
+			t.Errorf("unit does not contain %q:\n%s", expected, unit)
+		}
+	}
+	if _, err := generateSystemdUnit("/usr/local/bin/auto-vfio", "/etc/bindings\n.json"); err == nil {
+		t.Errorf("generateSystemdUnit() of a path with a line break expected an error")
+	}
+}
+
+// TestServiceBackend tests saving and removing bindings for the service
+func TestServiceBackend(t *testing.T) {
+	root := t.TempDir()
+	writeTestDevice(t, root, "0000:07:00.0", "10de", "2882")
+	log := zerolog.Nop()
+	backend, err := newPersistBackend(PersistBackendService, root, nil)
+	if err != nil {
+		t.Fatalf("newPersistBackend() error = %v", err)
+	}
+
+	if err := saveBinding(filepath.Join(root, PATH_BINDINGS), "0000:10:00.0", "pci-stub"); err != nil {
+		t.Fatalf("saveBinding() error = %v", err)
+	}
+	if err := backend.Persist(&log, []persistedDevice{{Bus: "0000:07:00.0", ID: "10de:2882"}}); err != nil {
+		t.Fatalf("Persist() error = %v", err)
+	}
+	bindings, err := readBindings(filepath.Join(root, PATH_BINDINGS))
+	if err != nil {
+		t.Fatalf("readBindings() error = %v", err)
+	}
+	expected := []savedBinding{{Bus: "0000:07:00.0", Driver: "vfio-pci"}, {Bus: "0000:10:00.0", Driver: "pci-stub"}}
+	if !reflect.DeepEqual(bindings, expected) {
+		t.Errorf("Persist() got = %v, expected %v", bindings, expected)
+	}
+
+	if err := backend.Unpersist(&log, []persistedDevice{{ID: "10de:2882"}}); err != nil {
+		t.Fatalf("Unpersist() error = %v", err)
+	}
+	bindings, _ = readBindings(filepath.Join(root, PATH_BINDINGS))
+	if !reflect.DeepEqual(bindings, expected[1:]) {
+		t.Errorf("Unpersist() got = %v, expected %v", bindings, expected[1:])
+	}
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+const (
+	// PATH_SNAPSHOT_METADATA is the host metadata at the root of a snapshot
+	PATH_SNAPSHOT_METADATA = "/auto-vfio-snapshot.json"
+
+	// snapshotFormat is the version of the snapshot layout, increased on incompatible changes
+	snapshotFormat = 1
+)
+
+// snapshotDeviceFiles are the attributes of a device, relative to its sysfs directory, that device discovery reads
+var snapshotDeviceFiles = []string{
+	"vendor", "device", "class", "subsystem_vendor", "subsystem_device", "revision", "irq", "modalias", "uevent",
+	"driver_override", "power_state", "power/runtime_status", "power/control", "d3cold_allowed", "numa_node",
+	"local_cpulist", "local_cpus", "current_link_speed", "current_link_width", "max_link_speed", "max_link_width",
+	"reset_method", "config",
+}
+
+// snapshotDeviceLinks are the symlinks of a device that device discovery reads
+var snapshotDeviceLinks = []string{"iommu_group", "driver"}
+
+// snapshotHostFiles are the host files, as globs, read by the read-only commands
+func snapshotHostFiles(release string) []string {
+	files := []string{PATH_KERNEL_OSRELEASE, PATH_PROC_CMDLINE, PATH_PROC_CPUINFO, PATH_OS_RELEASE, PATH_PCI_IDS_LOCAL, PATH_BINDINGS}
+	files = append(files, PATHS_PCI_IDS...)
+	files = append(files, cpuTopologyFiles...)
+	for _, name := range []string{"modules.alias", "modules.builtin", "modules.builtin.modinfo"} {
+		files = append(files, filepath.Join(PATH_LIB_MODULES, release, name))
+	}
+	for _, dir := range PATHS_MODPROBE_D {
+		files = append(files, filepath.Join(dir, "*.conf"))
+	}
+	for _, dir := range PATHS_UDEV_RULES_D {
+		files = append(files, filepath.Join(dir, "*.rules"))
+	}
+	for _, dir := range PATHS_LOADER_ENTRIES {
+		files = append(files, filepath.Join(dir, "*.conf"))
+	}
+	return append(files, PATH_DEFAULT_GRUB, PATH_KERNELSTUB_CONFIGURATION, filepath.Join(PATH_DRIVERCTL_D, "*"))
+}
+
+type _snapshot struct {
+	Output string `short:"f" help:"Tarball to write, - for stdout. Default: auto-vfio-snapshot-<hostname>-<time>.tar.gz" placeholder:"file"`
+}
+
+type SnapshotCmd struct {
+	Snapshot _snapshot `cmd:"" help:"Capture the sysfs attributes and host files auto-vfio reads into a tarball, for bug reports and --from-snapshot"`
+}
+
+// snapshotFlags are the flags of the read-only commands that can run against a snapshot
+type snapshotFlags struct {
+	FromSnapshot string `help:"Read the devices and host configuration from a tarball of 'snapshot' instead of this host" placeholder:"file" type:"existingfile"`
+}
+
+// SnapshotMetadata describes the host a snapshot was taken on
+type SnapshotMetadata struct {
+	Format        int
+	Created       time.Time
+	Hostname      string
+	OS            string
+	KernelRelease string
+	Cmdline       string
+	// Version is the auto-vfio version that took the snapshot
+	Version string
+	PciIds  string
+	Devices int
+}
+
+// newSnapshotMetadata describes the host below root
+func newSnapshotMetadata(root string, created time.Time) SnapshotMetadata {
+	hostname, _ := os.Hostname()
+	cmdline, _ := os.ReadFile(filepath.Join(root, PATH_PROC_CMDLINE))
+	meta := SnapshotMetadata{
+		Format:        snapshotFormat,
+		Created:       created,
+		Hostname:      hostname,
+		OS:            readOsRelease(root)["PRETTY_NAME"],
+		KernelRelease: kernelRelease(root),
+		Cmdline:       strings.TrimSpace(string(cmdline)),
+		Version:       version,
+	}
+	if db, err := pciIdsAt(root); err == nil {
+		meta.PciIds = db.String()
+	}
+	return meta
+}
+
+// snapshotWriter writes files below root into a tarball, once each
+type snapshotWriter struct {
+	tw      *tar.Writer
+	root    string
+	modTime time.Time
+	written map[string]bool
+}
+
+// name returns the name in the tarball of a path below root
+func (s *snapshotWriter) name(path string) string {
+	rel, _ := filepath.Rel(s.root, path)
+	return filepath.ToSlash(rel)
+}
+
+// add writes a file with the given content
+func (s *snapshotWriter) add(name string, content []byte) error {
+	if s.written[name] {
+		return nil
+	}
+	s.written[name] = true
+	header := &tar.Header{Typeflag: tar.TypeReg, Name: name, Mode: 0644, Size: int64(len(content)), ModTime: s.modTime}
+	if err := s.tw.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err := s.tw.Write(content)
+	return err
+}
+
+// addFile copies a file below root, if readable. Files of /proc and /sys are read whole, as their size is unknown
+func (s *snapshotWriter) addFile(path string) error {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	return s.add(s.name(path), content)
+}
+
+// addLink copies a symlink below root as is, if present
+func (s *snapshotWriter) addLink(path string) error {
+	target, err := os.Readlink(path)
+	if err != nil {
+		return nil
+	}
+	name := s.name(path)
+	if s.written[name] {
+		return nil
+	}
+	s.written[name] = true
+	return s.tw.WriteHeader(&tar.Header{Typeflag: tar.TypeSymlink, Name: name, Linkname: target, Mode: 0777, ModTime: s.modTime})
+}
+
+// writeSnapshot writes a gzipped tarball of the metadata, the PCI devices and the host files below root
+func writeSnapshot(w io.Writer, root string, meta SnapshotMetadata) error {
+	devicesPath := filepath.Join(root, PATH_SYS_BUS_PCI_DEVICES)
+	entries, err := os.ReadDir(devicesPath)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", devicesPath, err)
+	}
+	meta.Devices = len(entries)
+	metadata, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	gz := gzip.NewWriter(w)
+	s := &snapshotWriter{tw: tar.NewWriter(gz), root: root, modTime: meta.Created, written: map[string]bool{}}
+	if err := s.add(strings.TrimPrefix(PATH_SNAPSHOT_METADATA, "/"), metadata); err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		link := filepath.Join(devicesPath, entry.Name())
+		deviceDir := link
+		if target, err := os.Readlink(link); err == nil {
+			if err := s.addLink(link); err != nil {
+				return err
+			}
+			deviceDir = filepath.Join(devicesPath, target)
+		}
+		for _, file := range snapshotDeviceFiles {
+			if err := s.addFile(filepath.Join(deviceDir, file)); err != nil {
+				return err
+			}
+		}
+		for _, file := range snapshotDeviceLinks {
+			if err := s.addLink(filepath.Join(deviceDir, file)); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, pattern := range snapshotHostFiles(meta.KernelRelease) {
+		files, _ := filepath.Glob(filepath.Join(root, pattern))
+		for _, file := range files {
+			if err := s.addFile(file); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := s.tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// extractSnapshot extracts a snapshot below dir and returns its metadata.
+// Entries outside of dir, including through symlinks, are refused
+func extractSnapshot(file, dir string) (SnapshotMetadata, error) {
+	meta := SnapshotMetadata{}
+	f, err := os.Open(file)
+	if err != nil {
+		return meta, err
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return meta, fmt.Errorf("%s is not a snapshot: %w", file, err)
+	}
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return meta, fmt.Errorf("failed to read snapshot %s: %w", file, err)
+		}
+		name := filepath.FromSlash(header.Name)
+		if !filepath.IsLocal(name) {
+			return meta, fmt.Errorf("invalid path %q in snapshot %s", header.Name, file)
+		}
+		path := filepath.Join(dir, name)
+		if throughLink(dir, name) {
+			return meta, fmt.Errorf("invalid path %q through a link in snapshot %s", header.Name, file)
+		}
+		if _, err := os.Lstat(path); err == nil && header.Typeflag != tar.TypeDir {
+			return meta, fmt.Errorf("duplicate entry %q in snapshot %s", header.Name, file)
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return meta, err
+		}
+		switch header.Typeflag {
+		case tar.TypeReg:
+			content, err := io.ReadAll(tr)
+			if err != nil {
+				return meta, fmt.Errorf("failed to read %s from snapshot %s: %w", header.Name, file, err)
+			}
+			if err := os.WriteFile(path, content, 0644); err != nil {
+				return meta, err
+			}
+			if "/"+header.Name == PATH_SNAPSHOT_METADATA {
+				if err := json.Unmarshal(content, &meta); err != nil {
+					return meta, fmt.Errorf("invalid metadata in snapshot %s: %w", file, err)
+				}
+			}
+		case tar.TypeSymlink:
+			if filepath.IsAbs(header.Linkname) || !filepath.IsLocal(filepath.Join(filepath.Dir(name), header.Linkname)) {
+				return meta, fmt.Errorf("invalid link %q to %q in snapshot %s", header.Name, header.Linkname, file)
+			}
+			if err := os.Symlink(header.Linkname, path); err != nil {
+				return meta, err
+			}
+		case tar.TypeDir:
+			if err := os.MkdirAll(path, 0755); err != nil {
+				return meta, err
+			}
+		default:
+			return meta, fmt.Errorf("unsupported entry %q in snapshot %s", header.Name, file)
+		}
+	}
+	if meta.Format == 0 {
+		return meta, fmt.Errorf("%s is not a snapshot: %s is missing", file, PATH_SNAPSHOT_METADATA)
+	}
+	if meta.Format > snapshotFormat {
+		return meta, fmt.Errorf("snapshot %s has format %d, this version of auto-vfio reads up to %d", file, meta.Format, snapshotFormat)
+	}
+	return meta, nil
+}
+
+// throughLink tells whether a parent of name below dir is a symlink, which could lead out of dir
+func throughLink(dir, name string) bool {
+	for parent := filepath.Dir(name); parent != "."; parent = filepath.Dir(parent) {
+		if info, err := os.Lstat(filepath.Join(dir, parent)); err == nil && info.Mode()&os.ModeSymlink != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// root returns "/", or the snapshot of --from-snapshot extracted in a temporary directory that cleanup removes
+func (f *snapshotFlags) root(log *zerolog.Logger) (root string, cleanup func(), err error) {
+	if f.FromSnapshot == "" {
+		return "/", func() {}, nil
+	}
+	dir, err := os.MkdirTemp("", "auto-vfio-snapshot-")
+	if err != nil {
+		return "", nil, err
+	}
+	cleanup = func() { os.RemoveAll(dir) }
+	meta, err := extractSnapshot(f.FromSnapshot, dir)
+	if err != nil {
+		cleanup()
+		return "", nil, err
+	}
+	log.Info().Msgf("Reading snapshot of %s (%s, kernel %s) taken %s", meta.Hostname, meta.OS, meta.KernelRelease, meta.Created.Format(time.DateTime))
+	return dir, cleanup, nil
+}
+
+// Run executes the command
+func (cmd *_snapshot) Run(globals *Globals) error {
+	log := globals.config.Logger()
+
+	meta := newSnapshotMetadata("/", time.Now().UTC().Truncate(time.Second))
+	output := cmd.Output
+	if output == "" {
+		output = fmt.Sprintf("auto-vfio-snapshot-%s-%s.tar.gz", meta.Hostname, meta.Created.Format("20060102-150405"))
+	}
+
+	var w io.Writer = os.Stdout
+	if output != "-" {
+		f, err := os.Create(output)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	if err := writeSnapshot(w, "/", meta); err != nil {
+		return fmt.Errorf("failed to write snapshot: %w", err)
+	}
+	if output != "-" {
+		log.Info().Msgf("Wrote snapshot to %s", output)
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// TestSnapshot tests that a snapshot of the lspci fixture holds everything device discovery reads
+func TestSnapshot(t *testing.T) {
+	root := filepath.Join("testdata", "lspci", "host")
+	created := time.Date(2025, 1, 2, 15, 4, 5, 0, time.UTC)
+	var tarball bytes.Buffer
+	if err := writeSnapshot(&tarball, root, newSnapshotMetadata(root, created)); err != nil {
+		t.Fatalf("writeSnapshot() error = %v", err)
+	}
+	file := filepath.Join(t.TempDir(), "snapshot.tar.gz")
+	if err := os.WriteFile(file, tarball.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	meta, err := extractSnapshot(file, dir)
+	if err != nil {
+		t.Fatalf("extractSnapshot() error = %v", err)
+	}
+	if meta.Format != snapshotFormat || !meta.Created.Equal(created) || meta.KernelRelease != "6.6.0-fixture" || meta.Devices != 8 {
+		t.Errorf("extractSnapshot() metadata got = %+v", meta)
+	}
+
+	expected, err := parsePciDevices(root)
+	if err != nil {
+		t.Fatalf("parsePciDevices() error = %v", err)
+	}
+	got, err := parsePciDevices(dir)
+	if err != nil {
+		t.Fatalf("parsePciDevices() of the snapshot error = %v", err)
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("parsePciDevices() of the snapshot got = %+v, expected %+v", got, expected)
+	}
+}
+
+// TestExtractSnapshotRefusesEscapes tests that entries cannot be written outside of the extraction directory
+func TestExtractSnapshotRefusesEscapes(t *testing.T) {
+	metadata := &tar.Header{Typeflag: tar.TypeReg, Name: "auto-vfio-snapshot.json", Size: 12}
+	testCases := []struct {
+		name    string
+		headers []*tar.Header
+	}{
+		{"ParentPath", []*tar.Header{{Typeflag: tar.TypeReg, Name: "../escape"}}},
+		{"AbsoluteLink", []*tar.Header{{Typeflag: tar.TypeSymlink, Name: "sys/link", Linkname: "/etc"}}},
+		{"ParentLink", []*tar.Header{{Typeflag: tar.TypeSymlink, Name: "sys/link", Linkname: "../../etc"}}},
+		{"ThroughLink", []*tar.Header{
+			{Typeflag: tar.TypeSymlink, Name: "sys/a/link", Linkname: "../b"},
+			{Typeflag: tar.TypeSymlink, Name: "sys/a/link/escape", Linkname: "../../.."},
+		}},
+		{"MissingMetadata", []*tar.Header{{Typeflag: tar.TypeDir, Name: "sys/"}}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var tarball bytes.Buffer
+			gz := gzip.NewWriter(&tarball)
+			tw := tar.NewWriter(gz)
+			if tc.name != "MissingMetadata" {
+				tw.WriteHeader(metadata)
+				tw.Write([]byte(`{"Format":1}`))
+			}
+			for _, header := range tc.headers {
+				if err := tw.WriteHeader(header); err != nil {
+					t.Fatal(err)
+				}
+			}
+			tw.Close()
+			gz.Close()
+			file := filepath.Join(t.TempDir(), "snapshot.tar.gz")
+			if err := os.WriteFile(file, tarball.Bytes(), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := extractSnapshot(file, t.TempDir()); err == nil {
+				t.Errorf("extractSnapshot() expected an error")
+			}
+		})
+	}
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"text/tabwriter"
+)
+
+const (
+	PATH_PROC_CMDLINE = "/proc/cmdline"
+
+	StatusBound             = "bound"
+	StatusOk                = "ok"
+	StatusPersistedNotBound = "persisted-not-bound"
+	StatusBoundNotPersisted = "bound-not-persisted"
+	StatusStale             = "stale"
+)
+
+// PATHS_MODPROBE_D are the directories modprobe reads its configuration from
+var PATHS_MODPROBE_D = []string{"/etc/modprobe.d", "/run/modprobe.d", "/usr/local/lib/modprobe.d", "/usr/lib/modprobe.d", "/lib/modprobe.d"}
+
+// PATHS_UDEV_RULES_D are the directories udev reads its rules from
+var PATHS_UDEV_RULES_D = []string{"/etc/udev/rules.d", "/run/udev/rules.d", "/usr/lib/udev/rules.d", "/lib/udev/rules.d"}
+
+var udevVfioOverrideRegex = regexp.MustCompile(`ATTR\{driver_override\}\s*=\s*"vfio-pci"`)
+
+type _status struct {
+	Persisted     bool `short:"p" help:"Compare everything that binds devices to vfio-pci at boot with the live bindings"`
+	outputFlags   `embed:""`
+	snapshotFlags `embed:""`
+}
+
+type StatusCmd struct {
+	Status _status `cmd:"" aliases:"s" help:"Show the devices bound to vfio-pci"`
+}
+
+// persistedSource is a setting that binds a device to vfio-pci at boot, by id or by bus address
+type persistedSource struct {
+	Source string
+	File   string
+	ID     string
+	Bus    string
+}
+
+// String returns the source and the file it was found in
+func (s persistedSource) String() string {
+	return s.Source + ":" + s.File
+}
+
+// StatusEntry compares the live binding of a device with its persisted bindings
+type StatusEntry struct {
+	Bus     string
+	ID      string
+	Driver  string
+	Status  string
+	Sources []string
+}
+
+// liveDevice is a present device with its vendor:device id and driver
+type liveDevice struct {
+	Bus      string
+	ID       string
+	Driver   string
+	Class    string
+	Modalias string
+}
+
+// readLiveDevices reads the present devices below root
+func readLiveDevices(root string) ([]liveDevice, error) {
+	devicesPath := filepath.Join(root, PATH_SYS_BUS_PCI_DEVICES)
+	entries, err := os.ReadDir(devicesPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", devicesPath, err)
+	}
+	devices := []liveDevice{}
+	for _, entry := range entries {
+		id, err := readVendorDeviceIdFrom(devicesPath, entry.Name())
+		if err != nil {
+			continue
+		}
+		driver := ""
+		if link, err := os.Readlink(filepath.Join(devicesPath, entry.Name(), "driver")); err == nil {
+			driver = filepath.Base(link)
+		}
+		read := func(filename string) string {
+			value, _ := os.ReadFile(filepath.Join(devicesPath, entry.Name(), filename))
+			return strings.TrimPrefix(strings.TrimSpace(string(value)), "0x")
+		}
+		devices = append(devices, liveDevice{Bus: entry.Name(), ID: id, Driver: driver, Class: read("class"), Modalias: read("modalias")})
+	}
+	slices.SortFunc(devices, func(a, b liveDevice) int {
+		return NaturalCompare(a.Bus, b.Bus)
+	})
+	return devices, nil
+}
+
+// collectPersisted finds every setting below root that binds devices to vfio-pci at boot
+func collectPersisted(root string) []persistedSource {
+	sources := []persistedSource{}
+	addIds := func(source, file, value string) {
+		for _, id := range strings.Split(value, ",") {
+			if id != "" {
+				sources = append(sources, persistedSource{Source: source, File: file, ID: id})
+			}
+		}
+	}
+
+	// modprobe.d
+	for _, dir := range PATHS_MODPROBE_D {
+		files, _ := filepath.Glob(filepath.Join(root, dir, "*.conf"))
+		for _, file := range files {
+			conf, err := readModprobeConf(file)
+			if err != nil {
+				continue
+			}
+			addIds(PersistBackendModprobe, strings.TrimPrefix(file, strings.TrimSuffix(root, "/")), strings.Join(conf.VfioIds(), ","))
+		}
+	}
+
+	// Running kernel command line
+	if cmdline, err := os.ReadFile(filepath.Join(root, PATH_PROC_CMDLINE)); err == nil {
+		if value, ok := cmdlineValue(splitCmdline(string(cmdline)), "vfio-pci.ids"); ok {
+			addIds("cmdline", PATH_PROC_CMDLINE, value)
+		}
+	}
+
+	// Bootloader configuration for the next boot
+	if name, err := detectBootloader(root); err == nil {
+		if b, err := newBootloader(name, root); err == nil {
+			if args, err := b.Args(); err == nil {
+				if value, ok := cmdlineValue(args, "vfio-pci.ids"); ok {
+					addIds(name, b.Location(), value)
+				}
+			}
+		}
+	}
+
+	// driverctl
+	driverctl := &driverctlBackend{root: root}
+	if buses, err := driverctl.buses(); err == nil {
+		for _, bus := range buses {
+			sources = append(sources, persistedSource{Source: PersistBackendDriverctl, File: filepath.Join(PATH_DRIVERCTL_D, "pci-"+bus), Bus: bus})
+		}
+	}
+
+	// udev rules
+	for _, dir := range PATHS_UDEV_RULES_D {
+		files, _ := filepath.Glob(filepath.Join(root, dir, "*.rules"))
+		for _, file := range files {
+			content, err := os.ReadFile(file)
+			if err != nil {
+				continue
+			}
+			for _, line := range strings.Split(string(content), "\n") {
+				if strings.HasPrefix(strings.TrimSpace(line), "#") || !udevVfioOverrideRegex.MatchString(line) {
+					continue
+				}
+				for _, m := range udevKernelsRegex.FindAllStringSubmatch(line, -1) {
+					sources = append(sources, persistedSource{Source: PersistBackendUdev, File: filepath.Join(dir, filepath.Base(file)), Bus: m[1]})
+				}
+			}
+		}
+	}
+
+	// Bindings applied by the service
+	if bindings, err := readBindings(filepath.Join(root, PATH_BINDINGS)); err == nil {
+		for _, s := range bindings {
+			if s.Driver == "vfio-pci" {
+				sources = append(sources, persistedSource{Source: PersistBackendService, File: PATH_BINDINGS, Bus: s.Bus})
+			}
+		}
+	}
+
+	return sources
+}
+
+// comparePersisted compares the persisted sources with the live devices
+func comparePersisted(devices []liveDevice, sources []persistedSource) []StatusEntry {
+	entries := []StatusEntry{}
+	used := make([]bool, len(sources))
+	for _, dev := range devices {
+		entry := StatusEntry{Bus: dev.Bus, ID: dev.ID, Driver: dev.Driver, Sources: []string{}}
+		for i, s := range sources {
+			if s.Bus == dev.Bus || (s.Bus == "" && s.ID == dev.ID) {
+				entry.Sources = mergeIds(entry.Sources, s.String())
+				used[i] = true
+			}
+		}
+		switch {
+		case len(entry.Sources) > 0 && dev.Driver == "vfio-pci":
+			entry.Status = StatusOk
+		case len(entry.Sources) > 0:
+			entry.Status = StatusPersistedNotBound
+		case dev.Driver == "vfio-pci":
+			entry.Status = StatusBoundNotPersisted
+		default:
+			continue
+		}
+		entries = append(entries, entry)
+	}
+
+	// Sources matching no present device
+	for i, s := range sources {
+		if used[i] {
+			continue
+		}
+		i := slices.IndexFunc(entries, func(e StatusEntry) bool {
+			return e.Status == StatusStale && e.Bus == s.Bus && e.ID == s.ID
+		})
+		if i >= 0 {
+			entries[i].Sources = mergeIds(entries[i].Sources, s.String())
+			continue
+		}
+		entries = append(entries, StatusEntry{Bus: s.Bus, ID: s.ID, Status: StatusStale, Sources: []string{s.String()}})
+	}
+	return entries
+}
+
+// Run executes the command
+func (cmd *_status) Run(globals *Globals) error {
+	root, cleanup, err := cmd.root(globals.config.Logger())
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	devices, err := readLiveDevices(root)
+	if err != nil {
+		return err
+	}
+
+	var entries []StatusEntry
+	if cmd.Persisted {
+		entries = comparePersisted(devices, collectPersisted(root))
+	} else {
+		entries = []StatusEntry{}
+		for _, dev := range devices {
+			if dev.Driver == "vfio-pci" {
+				entries = append(entries, StatusEntry{Bus: dev.Bus, ID: dev.ID, Driver: dev.Driver, Status: StatusBound, Sources: []string{}})
+			}
+		}
+	}
+
+	if len(cmd.OutputFormat) > 0 {
+		out, err := yqOutput(globals, entries, cmd.YQ, cmd.OutputFormat)
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(out))
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "DEVICE\tID\tDRIVER\tSTATUS\tSOURCES")
+	for _, e := range entries {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", e.Bus, e.ID, e.Driver, e.Status, strings.Join(e.Sources, ", "))
+	}
+	return w.Flush()
+}
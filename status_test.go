@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"testing"
+	"time"
+)
+
+// writeTestStatusHost writes devices bound to vfio-pci and other drivers, with bindings persisted in several ways
+func writeTestStatusHost(t *testing.T, root string) {
+	t.Helper()
+	devices := []struct{ bus, vendor, device, driver string }{
+		{"0000:01:00.0", "10de", "2882", "vfio-pci"},
+		{"0000:01:00.1", "10de", "22be", "snd_hda_intel"},
+		{"0000:07:00.0", "1002", "73bf", "vfio-pci"},
+		{"0000:08:00.0", "8086", "1533", "vfio-pci"},
+		{"0000:09:00.0", "8086", "1533", "igb"},
+	}
+	for _, d := range devices {
+		writeTestDevice(t, root, d.bus, d.vendor, d.device)
+		driverPath := filepath.Join(root, "sys/bus/pci/drivers", d.driver)
+		if err := os.MkdirAll(driverPath, 0755); err != nil {
+			t.Fatalf("error creating directory: %v", err)
+		}
+		if err := os.Symlink(filepath.Join("..", "..", "drivers", d.driver), filepath.Join(root, PATH_SYS_BUS_PCI_DEVICES, d.bus, "driver")); err != nil {
+			t.Fatalf("error creating symlink: %v", err)
+		}
+	}
+	writeTestFile(t, root, PATH_VFIO_CONF, "options vfio-pci ids=10de:2882,10de:22be\n")
+	writeTestFile(t, root, PATH_PROC_CMDLINE, "root=/dev/sda2 vfio-pci.ids=10de:2882,1234:5678 quiet\n")
+	writeTestFile(t, root, "/etc/udev/rules.d/80-nic.rules",
+		"ACTION==\"add\", SUBSYSTEM==\"pci\", KERNELS==\"0000:08:00.0\", ATTR{driver_override}=\"vfio-pci\"\n")
+	writeTestFile(t, root, filepath.Join(PATH_DRIVERCTL_D, "pci-0000:0a:00.0"), "vfio-pci\n")
+}
+
+// TestStatusPersisted tests the comparison of persisted bindings with the live bindings
+func TestStatusPersisted(t *testing.T) {
+	root := t.TempDir()
+	writeTestStatusHost(t, root)
+
+	live, err := readLiveDevices(root)
+	if err != nil {
+		t.Fatalf("readLiveDevices() error = %v", err)
+	}
+	expected := []StatusEntry{
+		{Bus: "0000:01:00.0", ID: "10de:2882", Driver: "vfio-pci", Status: StatusOk, Sources: []string{"modprobe:/etc/modprobe.d/vfio.conf", "cmdline:/proc/cmdline"}},
+		{Bus: "0000:01:00.1", ID: "10de:22be", Driver: "snd_hda_intel", Status: StatusPersistedNotBound, Sources: []string{"modprobe:/etc/modprobe.d/vfio.conf"}},
+		{Bus: "0000:07:00.0", ID: "1002:73bf", Driver: "vfio-pci", Status: StatusBoundNotPersisted, Sources: []string{}},
+		{Bus: "0000:08:00.0", ID: "8086:1533", Driver: "vfio-pci", Status: StatusOk, Sources: []string{"udev:/etc/udev/rules.d/80-nic.rules"}},
+		{ID: "1234:5678", Status: StatusStale, Sources: []string{"cmdline:/proc/cmdline"}},
+		{Bus: "0000:0a:00.0", Status: StatusStale, Sources: []string{"driverctl:/etc/driverctl.d/pci-0000:0a:00.0"}},
+	}
+	actual := comparePersisted(live, collectPersisted(root))
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("comparePersisted() got =\n%+v\nexpected\n%+v", actual, expected)
+	}
+}
+
+// TestStatusSnapshot tests that the status of a snapshot is the status of the host it was taken on
+func TestStatusSnapshot(t *testing.T) {
+	root := t.TempDir()
+	writeTestStatusHost(t, root)
+	if err := saveBinding(filepath.Join(root, PATH_BINDINGS), "0000:07:00.0", "vfio-pci"); err != nil {
+		t.Fatalf("saveBinding() error = %v", err)
+	}
+
+	var tarball bytes.Buffer
+	if err := writeSnapshot(&tarball, root, newSnapshotMetadata(root, time.Now())); err != nil {
+		t.Fatalf("writeSnapshot() error = %v", err)
+	}
+	file := filepath.Join(t.TempDir(), "snapshot.tar.gz")
+	if err := os.WriteFile(file, tarball.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	if _, err := extractSnapshot(file, dir); err != nil {
+		t.Fatalf("extractSnapshot() error = %v", err)
+	}
+
+	status := func(root string) []StatusEntry {
+		live, err := readLiveDevices(root)
+		if err != nil {
+			t.Fatalf("readLiveDevices() error = %v", err)
+		}
+		return comparePersisted(live, collectPersisted(root))
+	}
+	expected := status(root)
+	actual := status(dir)
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("comparePersisted() of the snapshot got =\n%+v\nexpected\n%+v", actual, expected)
+	}
+	service := StatusEntry{Bus: "0000:07:00.0", ID: "1002:73bf", Driver: "vfio-pci", Status: StatusOk, Sources: []string{"service:" + PATH_BINDINGS}}
+	if !slices.ContainsFunc(actual, func(e StatusEntry) bool { return reflect.DeepEqual(e, service) }) {
+		t.Errorf("comparePersisted() of the snapshot got =\n%+v\nexpected to contain %+v", actual, service)
+	}
+}
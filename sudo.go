@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"os/exec"
@@ -13,8 +14,11 @@ func hasPasswordlessSudo() bool {
 	return err == nil
 }
 
+// reRunElevated re-runs the current executable with sudo when not root. A variable for tests to stub
+var reRunElevated = reRunWithSudo
+
 // Re-run the current executable with sudo
-func reRunElevated() error {
+func reRunWithSudo() error {
 	if os.Geteuid() == 0 {
 		return nil
 	}
@@ -38,6 +42,11 @@ func reRunElevated() error {
 
 	// Run and wait for completion
 	err = cmd.Run()
+	// Propagate the exit code of the elevated process
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		os.Exit(exitErr.ExitCode())
+	}
 	if err != nil {
 		return fmt.Errorf("sudo execution failed: %w", err)
 	}
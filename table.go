@@ -0,0 +1,209 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"slices"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	ColorAuto   = "auto"
+	ColorAlways = "always"
+	ColorNever  = "never"
+
+	colorReset = "\033[0m"
+	colorVfio  = "\033[32m"
+	colorHost  = "\033[33m"
+)
+
+// defaultListColumns are the table columns of list when only --sort is given
+var defaultListColumns = []string{"IommuGroup", "Bus", "Class", "DeviceClass", "VendorName", "DeviceName", "VendorID", "DeviceID", "KernelDriver"}
+
+// pciDeviceColumns returns the PciDevice fields usable as columns
+func pciDeviceColumns() []string {
+	t := reflect.TypeOf(PciDevice{})
+	columns := make([]string, 0, t.NumField())
+	for i := range t.NumField() {
+		columns = append(columns, t.Field(i).Name)
+	}
+	return columns
+}
+
+// resolveColumns returns the PciDevice field names of the columns, matched ignoring case
+func resolveColumns(columns []string) ([]string, error) {
+	available := pciDeviceColumns()
+	resolved := make([]string, 0, len(columns))
+	for _, column := range columns {
+		i := slices.IndexFunc(available, func(a string) bool { return strings.EqualFold(a, column) })
+		if i < 0 {
+			return nil, fmt.Errorf("unknown column %q. One of: %s", column, strings.Join(available, ", "))
+		}
+		resolved = append(resolved, available[i])
+	}
+	return resolved, nil
+}
+
+// columnValue returns the value of a PciDevice field as text
+func columnValue(dev PciDevice, column string) string {
+	if column == "KernelModules" {
+		return kernelModuleNames(dev.KernelModules)
+	}
+	return fmt.Sprint(reflect.ValueOf(dev).FieldByName(column).Interface())
+}
+
+// sortDevices sorts the devices by the columns in natural order, descending for columns suffixed with :desc
+func sortDevices(devices []PciDevice, columns []string) error {
+	type sortKey struct {
+		column     string
+		descending bool
+	}
+	keys := make([]sortKey, 0, len(columns))
+	for _, column := range columns {
+		name, order, _ := strings.Cut(column, ":")
+		if order != "" && order != "asc" && order != "desc" {
+			return fmt.Errorf("invalid sort order %q of column %q. One of: asc, desc", order, name)
+		}
+		descending := order == "desc"
+		resolved, err := resolveColumns([]string{name})
+		if err != nil {
+			return err
+		}
+		keys = append(keys, sortKey{resolved[0], descending})
+	}
+	slices.SortStableFunc(devices, func(a, b PciDevice) int {
+		for _, key := range keys {
+			c := compareColumnValues(columnValue(a, key.column), columnValue(b, key.column))
+			if key.descending {
+				c = -c
+			}
+			if c != 0 {
+				return c
+			}
+		}
+		return 0
+	})
+	return nil
+}
+
+// compareColumnValues compares values of equal length, like hex bus addresses and ids, as is and others in natural order
+func compareColumnValues(a, b string) int {
+	if len(a) == len(b) {
+		return strings.Compare(a, b)
+	}
+	return NaturalCompare(a, b)
+}
+
+// projectDevices returns the devices with only the columns, for structured output
+func projectDevices(devices []PciDevice, columns []string) []map[string]any {
+	projected := make([]map[string]any, 0, len(devices))
+	for _, dev := range devices {
+		row := map[string]any{}
+		for _, column := range columns {
+			row[column] = reflect.ValueOf(dev).FieldByName(column).Interface()
+		}
+		projected = append(projected, row)
+	}
+	return projected
+}
+
+// columnHeader turns a field name into a table header, e.g. IommuGroup into IOMMU GROUP
+func columnHeader(column string) string {
+	var header strings.Builder
+	runes := []rune(column)
+	for i, r := range runes {
+		if i > 0 && unicode.IsUpper(r) && (unicode.IsLower(runes[i-1]) || (i+1 < len(runes) && unicode.IsLower(runes[i+1]) && unicode.IsUpper(runes[i-1]))) {
+			header.WriteRune(' ')
+		}
+		header.WriteRune(unicode.ToUpper(r))
+	}
+	return header.String()
+}
+
+// useColor tells whether to colour the output for the --color value
+func useColor(color string, out *os.File) bool {
+	switch color {
+	case ColorAlways:
+		return true
+	case ColorNever:
+		return false
+	}
+	return os.Getenv("NO_COLOR") == "" && isTerminal(out)
+}
+
+// isTerminal tells whether out is a terminal
+func isTerminal(out *os.File) bool {
+	info, err := out.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// deviceColor returns the colour of a device row: vfio bound, host bound or none for unbound devices
+func deviceColor(dev PciDevice) string {
+	switch dev.KernelDriver {
+	case "":
+		return ""
+	case "vfio-pci", "pci-stub":
+		return colorVfio
+	}
+	return colorHost
+}
+
+// renderTable writes the rows aligned on columns of display width, so colours do not shift them
+func renderTable(w io.Writer, header []string, rows [][]string, colors []string) error {
+	widths := make([]int, len(header))
+	for _, row := range append([][]string{header}, rows...) {
+		for i, cell := range row {
+			widths[i] = max(widths[i], utf8.RuneCountInString(cell))
+		}
+	}
+	line := func(row []string) string {
+		var b strings.Builder
+		for i, cell := range row {
+			if i == len(row)-1 {
+				b.WriteString(cell)
+				break
+			}
+			b.WriteString(cell + strings.Repeat(" ", widths[i]-utf8.RuneCountInString(cell)+2))
+		}
+		return b.String()
+	}
+
+	if _, err := fmt.Fprintln(w, line(header)); err != nil {
+		return err
+	}
+	for i, row := range rows {
+		text := line(row)
+		if i < len(colors) && colors[i] != "" {
+			text = colors[i] + text + colorReset
+		}
+		if _, err := fmt.Fprintln(w, text); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// printDeviceTable prints the columns of the devices as a table
+func printDeviceTable(w io.Writer, devices []PciDevice, columns []string, color bool) error {
+	header := make([]string, 0, len(columns))
+	for _, column := range columns {
+		header = append(header, columnHeader(column))
+	}
+	rows := make([][]string, 0, len(devices))
+	colors := make([]string, 0, len(devices))
+	for _, dev := range devices {
+		row := make([]string, 0, len(columns))
+		for _, column := range columns {
+			row = append(row, columnValue(dev, column))
+		}
+		rows = append(rows, row)
+		if color {
+			colors = append(colors, deviceColor(dev))
+		}
+	}
+	return renderTable(w, header, rows, colors)
+}
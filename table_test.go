@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+// TestSortDevices tests natural and descending sorting by several columns
+func TestSortDevices(t *testing.T) {
+	devices := []PciDevice{
+		{Bus: "0000:0a:00.0", IommuGroup: "10", NumaNode: "1"},
+		{Bus: "0000:01:00.0", IommuGroup: "2", NumaNode: "0"},
+		{Bus: "0000:02:00.0", IommuGroup: "9", NumaNode: "1"},
+	}
+	testCases := []struct {
+		name     string
+		sort     []string
+		expected []string
+	}{
+		{"Natural", []string{"iommugroup"}, []string{"0000:01:00.0", "0000:02:00.0", "0000:0a:00.0"}},
+		{"DescendingThenAscending", []string{"NumaNode:desc", "bus:asc"}, []string{"0000:02:00.0", "0000:0a:00.0", "0000:01:00.0"}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := sortDevices(devices, tc.sort); err != nil {
+				t.Fatalf("sortDevices() error = %v", err)
+			}
+			buses := []string{}
+			for _, dev := range devices {
+				buses = append(buses, dev.Bus)
+			}
+			if !reflect.DeepEqual(buses, tc.expected) {
+				t.Errorf("sortDevices() got = %v, expected %v", buses, tc.expected)
+			}
+		})
+	}
+	if err := sortDevices(devices, []string{"bus:up"}); err == nil {
+		t.Errorf("sortDevices() expected an error for an invalid order")
+	}
+	if _, err := resolveColumns([]string{"nope"}); err == nil {
+		t.Errorf("resolveColumns() expected an error for an unknown column")
+	}
+}
+
+// TestPrintDeviceTable tests that coloured rows stay aligned with the others
+func TestPrintDeviceTable(t *testing.T) {
+	devices := []PciDevice{
+		{Bus: "0000:01:00.0", KernelDriver: "vfio-pci", IommuGroup: "12", KernelModules: []KernelModule{{Name: "nouveau"}, {Name: "nvidia"}}},
+		{Bus: "0000:0c:00.0", KernelDriver: "amdgpu", IommuGroup: "3"},
+		{Bus: "0000:0d:00.0", IommuGroup: "3"},
+	}
+	var out bytes.Buffer
+	if err := printDeviceTable(&out, devices, []string{"IommuGroup", "Bus", "KernelDriver", "KernelModules"}, true); err != nil {
+		t.Fatalf("printDeviceTable() error = %v", err)
+	}
+	expected := "IOMMU GROUP  BUS           KERNEL DRIVER  KERNEL MODULES\n" +
+		colorVfio + "12           0000:01:00.0  vfio-pci       nouveau, nvidia" + colorReset + "\n" +
+		colorHost + "3            0000:0c:00.0  amdgpu         " + colorReset + "\n" +
+		"3            0000:0d:00.0                 \n"
+	if out.String() != expected {
+		t.Errorf("printDeviceTable() got = %q, expected %q", out.String(), expected)
+	}
+	if header := columnHeader("D3ColdAllowed"); header != "D3COLD ALLOWED" {
+		t.Errorf("columnHeader() got = %q", header)
+	}
+}
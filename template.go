@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"text/template"
+	"unicode/utf8"
+)
+
+// DeviceGroup is an IOMMU group and its devices, in the data of list --template
+type DeviceGroup struct {
+	Group   string
+	Devices []PciDevice
+}
+
+// templateData is the data of list --template
+type templateData struct {
+	// Groups are the devices grouped by IOMMU group, in natural order of the groups
+	Groups []DeviceGroup
+	// Devices is the flat list of devices, sorted by --sort if given
+	Devices []PciDevice
+}
+
+// newTemplateData groups the devices by IOMMU group
+func newTemplateData(devices []PciDevice) templateData {
+	data := templateData{Groups: []DeviceGroup{}, Devices: devices}
+	for _, dev := range devices {
+		i := slices.IndexFunc(data.Groups, func(g DeviceGroup) bool { return g.Group == dev.IommuGroup })
+		if i < 0 {
+			data.Groups = append(data.Groups, DeviceGroup{Group: dev.IommuGroup})
+			i = len(data.Groups) - 1
+		}
+		data.Groups[i].Devices = append(data.Groups[i].Devices, dev)
+	}
+	slices.SortStableFunc(data.Groups, func(a, b DeviceGroup) int { return NaturalCompare(a.Group, b.Group) })
+	return data
+}
+
+// templateFuncs are the helpers of list --template
+var templateFuncs = template.FuncMap{
+	// join joins the items of a list, e.g. {{join ", " .KernelModules}}
+	"join": func(sep string, items any) (string, error) {
+		v := reflect.ValueOf(items)
+		if v.Kind() != reflect.Slice && v.Kind() != reflect.Array {
+			return "", fmt.Errorf("join: %T is not a list", items)
+		}
+		texts := make([]string, 0, v.Len())
+		for i := range v.Len() {
+			texts = append(texts, fmt.Sprint(v.Index(i).Interface()))
+		}
+		return strings.Join(texts, sep), nil
+	},
+	// pad pads the value with spaces to width, on the left if width is negative
+	"pad": func(width int, value any) string {
+		text := fmt.Sprint(value)
+		if width < 0 {
+			return strings.Repeat(" ", max(0, -width-utf8.RuneCountInString(text))) + text
+		}
+		return text + strings.Repeat(" ", max(0, width-utf8.RuneCountInString(text)))
+	},
+	"upper": func(value any) string {
+		return strings.ToUpper(fmt.Sprint(value))
+	},
+	// hex prefixes a hex id with 0x, e.g. {{hex (slice .Bus 5 7)}} for a libvirt address
+	"hex": func(value any) (string, error) {
+		switch v := value.(type) {
+		case int:
+			return fmt.Sprintf("%#x", v), nil
+		case string:
+			digits := strings.TrimPrefix(strings.ToLower(v), "0x")
+			if _, err := strconv.ParseUint(digits, 16, 64); err != nil {
+				return "", fmt.Errorf("hex: %q is not a hex number", v)
+			}
+			return "0x" + digits, nil
+		}
+		return "", fmt.Errorf("hex: unsupported value %v of type %T", value, value)
+	},
+}
+
+// parseListTemplate parses a template given inline, or read from a file when prefixed with @
+func parseListTemplate(text string) (*template.Template, error) {
+	if file, ok := strings.CutPrefix(text, "@"); ok {
+		content, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read template: %w", err)
+		}
+		text = string(content)
+	}
+	tmpl, err := template.New("list").Option("missingkey=error").Funcs(templateFuncs).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid template: %w", err)
+	}
+	return tmpl, nil
+}
+
+// printTemplate executes the template on the devices
+func printTemplate(w io.Writer, tmpl *template.Template, devices []PciDevice) error {
+	if err := tmpl.Execute(w, newTemplateData(devices)); err != nil {
+		return fmt.Errorf("failed to execute template: %w", err)
+	}
+	return nil
+}
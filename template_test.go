@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+)
+
+// TestPrintTemplate tests templates over the grouped and flat devices of the lspci fixture
+func TestPrintTemplate(t *testing.T) {
+	devices, err := parsePciDevices(filepath.Join("testdata", "lspci", "host"))
+	if err != nil {
+		t.Fatalf("parsePciDevices() error = %v", err)
+	}
+	devices, err = (&listFilters{Group: []string{"12", "15"}}).filter(nil, devices)
+	if err != nil {
+		t.Fatalf("filter() error = %v", err)
+	}
+	root := t.TempDir()
+	file := filepath.Join(root, "bash.tmpl")
+	writeTestFile(t, root, "bash.tmpl", `GPUS=({{range .Devices}}{{if eq .Class "0300"}}"{{.Bus}}" {{end}}{{end}})`)
+
+	testCases := []struct {
+		name     string
+		template string
+		expected string
+	}{
+		{
+			"Libvirt",
+			`{{range .Groups}}{{range .Devices}}<address domain='{{hex (slice .Bus 0 4)}}' bus='{{hex (slice .Bus 5 7)}}' slot='{{hex (slice .Bus 8 10)}}' function='{{hex (slice .Bus 11)}}'/>` + "\n{{end}}{{end}}",
+			"<address domain='0x0000' bus='0x01' slot='0x00' function='0x0'/>\n" +
+				"<address domain='0x0000' bus='0x01' slot='0x00' function='0x1'/>\n" +
+				"<address domain='0x0000' bus='0x0c' slot='0x00' function='0x0'/>\n",
+		},
+		{
+			"Groups",
+			`{{range .Groups}}| {{pad -3 .Group}} | {{range $i, $d := .Devices}}{{if $i}}, {{end}}{{upper $d.KernelDriver}}{{end}} | {{pad 8 (index .Devices 0).VendorID}}|` + "\n{{end}}",
+			"|  12 | VFIO-PCI, VFIO-PCI | 10de    |\n" +
+				"|  15 | AMDGPU | 1002    |\n",
+		},
+		{
+			"Join",
+			`{{range .Devices}}{{join "," .KernelModules}};{{end}}`,
+			"nouveau;snd_hda_intel;amdgpu;",
+		},
+		{"File", "@" + file, `GPUS=("0000:01:00.0" "0000:0c:00.0" )`},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			tmpl, err := parseListTemplate(tc.template)
+			if err != nil {
+				t.Fatalf("parseListTemplate() error = %v", err)
+			}
+			var out bytes.Buffer
+			if err := printTemplate(&out, tmpl, devices); err != nil {
+				t.Fatalf("printTemplate() error = %v", err)
+			}
+			if out.String() != tc.expected {
+				t.Errorf("printTemplate() got:\n%s\nexpected:\n%s", out.String(), tc.expected)
+			}
+		})
+	}
+
+	tmpl, err := parseListTemplate(`{{hex .Devices}}`)
+	if err != nil {
+		t.Fatalf("parseListTemplate() error = %v", err)
+	}
+	if err := printTemplate(&bytes.Buffer{}, tmpl, devices); err == nil {
+		t.Errorf("printTemplate() expected an error for hex of a list")
+	}
+	if _, err := parseListTemplate("@" + filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Errorf("parseListTemplate() expected an error for a missing file")
+	}
+}
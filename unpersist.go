@@ -0,0 +1,65 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+type _unpersist struct {
+	Bus          []string `short:"b" help:"Comma separated list of Bus addresses whose vendor:device ids to remove. Example: 0000:07:00.0,0000:07:00.1" placeholder:"bus-address1"`
+	ID           []string `short:"i" name:"id" help:"Comma separated list of vendor:device ids to remove. Example: 10de:2882,10de:22be" placeholder:"vendor:device"`
+	persistFlags `embed:""`
+}
+
+type UnpersistCmd struct {
+	Unpersist _unpersist `cmd:"" aliases:"u" help:"Stop persisting the binding of devices to vfio-pci across reboots"`
+}
+
+// Run executes the command
+func (cmd *_unpersist) Run(globals *Globals) error {
+	log := globals.config.Logger()
+
+	if len(cmd.Bus) == 0 && len(cmd.ID) == 0 {
+		return errors.New("at least one of --bus or --id is required")
+	}
+
+	// Re-run elevated
+	if err := reRunElevated(); err != nil {
+		return err
+	}
+
+	devices := []persistedDevice{}
+	for _, id := range cmd.ID {
+		devices = append(devices, persistedDevice{ID: id})
+	}
+	for _, dev := range cmd.Bus {
+		id, err := readVendorDeviceId(dev)
+		if err != nil {
+			return err
+		}
+		devices = append(devices, persistedDevice{Bus: dev, ID: id})
+	}
+
+	// With auto, the devices may be persisted by id, by bus address or for the service, so remove them from all
+	names := []string{cmd.PersistBackend}
+	if cmd.PersistBackend == PersistBackendAuto {
+		names = []string{detectPersistBackend("/"), detectAddressBackend("/"), PersistBackendService}
+	}
+	var errs []error
+	for _, name := range names {
+		backend, err := newPersistBackend(name, "/", devices)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if err := backend.Unpersist(log, devices); err != nil {
+			errs = append(errs, fmt.Errorf("failed to unpersist with %s: %w", backend.Name(), err))
+			continue
+		}
+		log.Info().Msgf("Removed %d devices from %s", len(devices), backend.Name())
+		if backend.RegenerateCommand() != "" {
+			log.Warn().Msgf("Run %q for the change to apply at next boot", backend.RegenerateCommand())
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -13,5 +13,10 @@ var version = "dev"
 // Run executes the command
 func (cmd *_version) Run(globals *Globals) error {
 	fmt.Println(version)
+	db, err := loadedPciIds()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("pci.ids %s\n", db)
 	return nil
 }
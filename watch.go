@@ -0,0 +1,309 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	UeventAdd    = "add"
+	UeventRemove = "remove"
+	UeventBind   = "bind"
+	UeventUnbind = "unbind"
+
+	// WatchResync is the action of the event sent when uevents were lost, after which the devices must be read again
+	WatchResync = "resync"
+
+	// ueventKernelGroup is the netlink multicast group of the uevents sent by the kernel, before udev
+	ueventKernelGroup = 1
+	// watchSettleDelay lets the bursts of uevents of a bind or a hotplug settle before list --watch prints again
+	watchSettleDelay = 250 * time.Millisecond
+)
+
+// watchedUevents are the uevent actions changing the PCI devices or their bindings
+var watchedUevents = []string{UeventAdd, UeventRemove, UeventBind, UeventUnbind}
+
+// errUeventsLost is returned by a ueventSource when uevents were dropped, e.g. on a socket buffer overrun.
+// The source keeps working
+var errUeventsLost = errors.New("uevents were lost")
+
+type _watch struct {
+	NDJSON bool   `help:"Print the events as newline delimited JSON"`
+	Record string `help:"Also append the raw uevents to this file, to replay them in tests" placeholder:"file"`
+}
+
+type WatchCmd struct {
+	Watch _watch `cmd:"" help:"Print PCI devices being added, removed, bound and unbound, from kernel uevents"`
+}
+
+// Uevent is a kernel uevent: its action, device path and environment
+type Uevent struct {
+	Action  string
+	DevPath string
+	Env     map[string]string
+}
+
+// ueventSource yields raw kernel uevent messages, one per call. It returns errUeventsLost when messages were dropped
+type ueventSource interface {
+	Receive() ([]byte, error)
+}
+
+// netlinkUevents receives the kernel uevents from a kobject uevent netlink socket
+type netlinkUevents struct {
+	fd  int
+	buf []byte
+}
+
+// newNetlinkUevents opens a kobject uevent netlink socket. It does not need root
+func newNetlinkUevents() (*netlinkUevents, error) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_KOBJECT_UEVENT)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open the uevent netlink socket: %w", err)
+	}
+	if err := syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK, Groups: ueventKernelGroup}); err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("failed to bind the uevent netlink socket: %w", err)
+	}
+	return &netlinkUevents{fd: fd, buf: make([]byte, 64*1024)}, nil
+}
+
+// Receive returns the next uevent message
+func (n *netlinkUevents) Receive() ([]byte, error) {
+	for {
+		size, _, err := syscall.Recvfrom(n.fd, n.buf, 0)
+		if errors.Is(err, syscall.EINTR) {
+			continue
+		}
+		// The kernel drops the uevents that do not fit in the socket buffer, e.g. during a burst of hotplugs
+		if errors.Is(err, syscall.ENOBUFS) {
+			return nil, fmt.Errorf("%w: %w", errUeventsLost, err)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to receive a uevent: %w", err)
+		}
+		return slices.Clone(n.buf[:size]), nil
+	}
+}
+
+// Close closes the socket
+func (n *netlinkUevents) Close() error {
+	return syscall.Close(n.fd)
+}
+
+// recordedUevents replays uevent messages recorded back to back as received, e.g. by watch --record
+type recordedUevents struct {
+	r      *bufio.Reader
+	header string
+}
+
+// newRecordedUevents replays the uevent messages of r
+func newRecordedUevents(r io.Reader) *recordedUevents {
+	return &recordedUevents{r: bufio.NewReader(r)}
+}
+
+// Receive returns the next recorded message, or io.EOF at the end of the recording.
+// A message starts with its action@devpath header, the only field without '='
+func (r *recordedUevents) Receive() ([]byte, error) {
+	var msg bytes.Buffer
+	if r.header != "" {
+		msg.WriteString(r.header)
+		r.header = ""
+	}
+	for {
+		field, err := r.r.ReadString(0)
+		if len(field) > 0 {
+			if isUeventHeader(strings.TrimSuffix(field, "\x00")) && msg.Len() > 0 {
+				r.header = field
+				return msg.Bytes(), nil
+			}
+			msg.WriteString(field)
+		}
+		if errors.Is(err, io.EOF) {
+			if msg.Len() > 0 {
+				return msg.Bytes(), nil
+			}
+			return nil, io.EOF
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// recordingUevents copies the messages of a source to a writer
+type recordingUevents struct {
+	source ueventSource
+	w      io.Writer
+}
+
+// Receive returns the next message of the source, after writing it
+func (r *recordingUevents) Receive() ([]byte, error) {
+	msg, err := r.source.Receive()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := r.w.Write(msg); err != nil {
+		return nil, fmt.Errorf("failed to record a uevent: %w", err)
+	}
+	return msg, nil
+}
+
+// isUeventHeader tells whether a field is the action@devpath header of a kernel uevent
+func isUeventHeader(field string) bool {
+	action, devPath, found := strings.Cut(field, "@")
+	return found && action != "" && strings.HasPrefix(devPath, "/") && !strings.Contains(action, "=")
+}
+
+// parseUevent parses a kernel uevent message: an action@devpath header and KEY=value fields, all NUL terminated
+func parseUevent(msg []byte) (Uevent, error) {
+	fields := strings.Split(strings.TrimSuffix(string(msg), "\x00"), "\x00")
+	if !isUeventHeader(fields[0]) {
+		return Uevent{}, fmt.Errorf("invalid uevent header %q", fields[0])
+	}
+	u := Uevent{Env: map[string]string{}}
+	u.Action, u.DevPath, _ = strings.Cut(fields[0], "@")
+	for _, field := range fields[1:] {
+		if key, value, found := strings.Cut(field, "="); found {
+			u.Env[key] = value
+		}
+	}
+	if action := u.Env["ACTION"]; action != "" && action != u.Action {
+		return Uevent{}, fmt.Errorf("uevent header action %q does not match ACTION=%s", u.Action, action)
+	}
+	return u, nil
+}
+
+// WatchEvent is a PCI device added, removed, bound or unbound
+type WatchEvent struct {
+	Time   time.Time
+	Action string
+	Bus    string
+	ID     string
+	Class  string
+	// Name is the class, vendor and device names
+	Name   string
+	Driver string
+	Seqnum string
+}
+
+// newWatchEvent returns the event of a uevent, false if it is not about a PCI device or its binding
+func newWatchEvent(db *pciIdsDatabase, u Uevent, now time.Time) (WatchEvent, bool) {
+	if u.Env["SUBSYSTEM"] != "pci" || !slices.Contains(watchedUevents, u.Action) {
+		return WatchEvent{}, false
+	}
+	e := WatchEvent{
+		Time:   now,
+		Action: u.Action,
+		Bus:    u.Env["PCI_SLOT_NAME"],
+		ID:     strings.ToLower(u.Env["PCI_ID"]),
+		Driver: u.Env["DRIVER"],
+		Seqnum: u.Env["SEQNUM"],
+	}
+	if e.Bus == "" {
+		e.Bus = u.DevPath[strings.LastIndex(u.DevPath, "/")+1:]
+	}
+	if class, ok := parseHexId(u.Env["PCI_CLASS"], 24); ok {
+		e.Class = fmt.Sprintf("%04x", class>>8)
+	}
+	if db != nil {
+		vendor, device, _ := strings.Cut(e.ID, ":")
+		subVendor, subDevice, _ := strings.Cut(strings.ToLower(u.Env["PCI_SUBSYS_ID"]), ":")
+		names := db.Names(vendor, device, e.Class, subVendor, subDevice)
+		e.Name = fmt.Sprintf("%s: %s %s", names.Class, names.Vendor, names.Device)
+	}
+	return e, true
+}
+
+// String formats the event for a terminal
+func (e WatchEvent) String() string {
+	text := fmt.Sprintf("%s %-6s %s [%s] %s", e.Time.Format(time.TimeOnly), e.Action, e.Bus, e.ID, e.Name)
+	if e.Driver != "" {
+		text += " driver: " + e.Driver
+	}
+	return text
+}
+
+// watchEvents calls handle with the events of the uevents of source, until source fails.
+// Lost uevents are handled as a WatchResync event
+func watchEvents(source ueventSource, db *pciIdsDatabase, handle func(WatchEvent) error) error {
+	for {
+		msg, err := source.Receive()
+		if errors.Is(err, errUeventsLost) {
+			if err := handle(WatchEvent{Time: time.Now(), Action: WatchResync}); err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		u, err := parseUevent(msg)
+		if err != nil {
+			continue
+		}
+		if e, ok := newWatchEvent(db, u, time.Now()); ok {
+			if err := handle(e); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// printWatchEvent prints an event as text or as a line of JSON
+func printWatchEvent(w io.Writer, e WatchEvent, ndjson bool) error {
+	if !ndjson {
+		_, err := fmt.Fprintln(w, e)
+		return err
+	}
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(w, string(line))
+	return err
+}
+
+// Run executes the command
+func (cmd *_watch) Run(globals *Globals) error {
+	log := globals.config.Logger()
+
+	db, err := loadedPciIds()
+	if err != nil {
+		return err
+	}
+	uevents, err := newNetlinkUevents()
+	if err != nil {
+		return err
+	}
+	defer uevents.Close()
+
+	var source ueventSource = uevents
+	if cmd.Record != "" {
+		record, err := os.OpenFile(cmd.Record, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			return fmt.Errorf("failed to open %s: %w", cmd.Record, err)
+		}
+		defer record.Close()
+		source = &recordingUevents{source: uevents, w: record}
+	}
+
+	log.Info().Msg("Watching PCI devices, press Ctrl+C to stop")
+	return watchEvents(source, db, func(e WatchEvent) error {
+		if e.Action == WatchResync {
+			log.Warn().Msg("Kernel uevents were lost, changes may be missing. Run 'list' to see the current devices")
+			if !cmd.NDJSON {
+				return nil
+			}
+		}
+		return printWatchEvent(os.Stdout, e, cmd.NDJSON)
+	})
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// TestWatchEvents replays the uevents of a virtio RNG unbound, bound, removed and rescanned, as recorded by watch --record
+func TestWatchEvents(t *testing.T) {
+	recording, err := os.ReadFile(filepath.Join("testdata", "uevents", "virtio-rng.uevents"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := embeddedPciIds()
+	if err != nil {
+		t.Fatalf("embeddedPciIds() error = %v", err)
+	}
+
+	events := []WatchEvent{}
+	err = watchEvents(newRecordedUevents(bytes.NewReader(recording)), db, func(e WatchEvent) error {
+		events = append(events, e)
+		return nil
+	})
+	if !errors.Is(err, io.EOF) {
+		t.Fatalf("watchEvents() error = %v, expected io.EOF", err)
+	}
+
+	// The events of the virtio child device are not about PCI devices
+	expected := []string{
+		"unbind 0000:00:06.0 [1af4:1044] ffff driver: ",
+		"bind 0000:00:06.0 [1af4:1044] ffff driver: virtio-pci",
+		"unbind 0000:00:06.0 [1af4:1044] ffff driver: ",
+		"remove 0000:00:06.0 [1af4:1044] ffff driver: ",
+		"add 0000:00:06.0 [1af4:1044] ffff driver: ",
+		"bind 0000:00:06.0 [1af4:1044] ffff driver: virtio-pci",
+	}
+	if len(events) != len(expected) {
+		t.Fatalf("watchEvents() got %d events %v, expected %d", len(events), events, len(expected))
+	}
+	for i, e := range events {
+		got := e.Action + " " + e.Bus + " [" + e.ID + "] " + e.Class + " driver: " + e.Driver
+		if got != expected[i] {
+			t.Errorf("event %d got = %q, expected %q", i, got, expected[i])
+		}
+	}
+	if name := events[1].Name; name != "Unassigned class: Red Hat, Inc. Virtio 1.0 RNG" {
+		t.Errorf("event name got = %q", name)
+	}
+	if seqnum := events[1].Seqnum; seqnum != "656" {
+		t.Errorf("event seqnum got = %q", seqnum)
+	}
+
+	var out bytes.Buffer
+	events[1].Time = time.Date(2025, 1, 2, 15, 4, 5, 0, time.UTC)
+	if err := printWatchEvent(&out, events[1], true); err != nil {
+		t.Fatalf("printWatchEvent() error = %v", err)
+	}
+	if !strings.HasPrefix(out.String(), `{"Time":"2025-01-02T15:04:05Z","Action":"bind","Bus":"0000:00:06.0"`) || strings.Count(out.String(), "\n") != 1 {
+		t.Errorf("printWatchEvent() NDJSON got = %q", out.String())
+	}
+}
+
+// lossyUevents returns the messages of a source with uevents lost after the first one
+type lossyUevents struct {
+	source   ueventSource
+	received int
+}
+
+func (l *lossyUevents) Receive() ([]byte, error) {
+	if l.received++; l.received == 2 {
+		return nil, fmt.Errorf("%w: %w", errUeventsLost, syscall.ENOBUFS)
+	}
+	return l.source.Receive()
+}
+
+// TestWatchEventsResync tests that lost uevents are a resync event, not the end of the watch
+func TestWatchEventsResync(t *testing.T) {
+	recording, err := os.ReadFile(filepath.Join("testdata", "uevents", "virtio-rng.uevents"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	actions := []string{}
+	source := &lossyUevents{source: newRecordedUevents(bytes.NewReader(recording))}
+	err = watchEvents(source, nil, func(e WatchEvent) error {
+		actions = append(actions, e.Action)
+		return nil
+	})
+	if !errors.Is(err, io.EOF) {
+		t.Fatalf("watchEvents() error = %v, expected io.EOF", err)
+	}
+	if len(actions) != 7 || actions[0] != WatchResync || actions[6] != UeventBind {
+		t.Errorf("watchEvents() got actions %v, expected a resync then the 6 recorded events", actions)
+	}
+}
+
+// TestParseUevent tests the parsing of kernel uevent messages
+func TestParseUevent(t *testing.T) {
+	u, err := parseUevent([]byte("bind@/devices/pci0000:00/0000:00:01.1/0000:01:00.0\x00ACTION=bind\x00SUBSYSTEM=pci\x00DRIVER=vfio-pci\x00"))
+	if err != nil {
+		t.Fatalf("parseUevent() error = %v", err)
+	}
+	if u.Action != UeventBind || u.DevPath != "/devices/pci0000:00/0000:00:01.1/0000:01:00.0" || u.Env["DRIVER"] != "vfio-pci" {
+		t.Errorf("parseUevent() got = %+v", u)
+	}
+	e, ok := newWatchEvent(nil, u, time.Now())
+	if !ok || e.Bus != "0000:01:00.0" {
+		t.Errorf("newWatchEvent() got = %+v, %v, expected the bus from the device path", e, ok)
+	}
+
+	for _, msg := range []string{"libudev\x00\xfe\xed\xca\xfe", "ACTION=add\x00", "add@/devices/x\x00ACTION=remove\x00"} {
+		if _, err := parseUevent([]byte(msg)); err == nil {
+			t.Errorf("parseUevent(%q) expected an error", msg)
+		}
+	}
+}
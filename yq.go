@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"bytes"
 	"container/list"
+	"encoding/json"
 	"fmt"
 	"os"
 
@@ -11,6 +12,12 @@ import (
 	logging "gopkg.in/op/go-logging.v1"
 )
 
+// outputFlags are the flags of commands that print results as a table or through yqEncode
+type outputFlags struct {
+	OutputFormat string `short:"o" help:"Output format of the results. Table if empty. One of: ${enum}" enum:"json, yaml, xml, toml, props, shell, csv, tsv," default:""`
+	YQ           string `short:"y" help:"YQ expression to apply to the results. Ignored if output format is not specified"`
+}
+
 // yq evaluates a yq expression on the given data and returns the result
 func yq(globals *Globals, expression string, data []byte) (*list.List, error) {
 	// Set up yq logging
@@ -109,3 +116,20 @@ func yqEncode(matchingNodes *list.List, outFormat string, outColor bool) ([]byte
 
 	return output.Bytes(), nil
 }
+
+// yqOutput marshals v to JSON, applies the yq expression and encodes the result in the given format
+func yqOutput(globals *Globals, v any, expression, outFormat string) ([]byte, error) {
+	jsonObject, err := json.Marshal(v)
+	if err != nil {
+		return nil, fmt.Errorf("error marshalling JSON: %w", err)
+	}
+	yqResult, err := yq(globals, expression, jsonObject)
+	if err != nil {
+		return nil, fmt.Errorf("error applying YQ expression: %w", err)
+	}
+	out, err := yqEncode(yqResult, outFormat, useColor(ColorAuto, os.Stdout))
+	if err != nil {
+		return nil, fmt.Errorf("error encoding output: %w", err)
+	}
+	return out, nil
+}